@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Camera Motion Metadata (CAMM) track built from the djmd IMU records, see
+// https://developers.google.com/streetview/publish/camm-spec. Each record
+// becomes two samples: a gyroscope packet (type 2, rad/s) and an
+// accelerometer packet (type 3, m/s²), each three little-endian float32
+// values after a 4-byte header.
+//
+// The media timescale is four times the IMU sample rate. A record's
+// gyroscope and accelerometer samples normally last two ticks each, so stts
+// stays short. Each record is placed on the tick nearest its video-aligned
+// movie time by stretching or shortening the accelerometer sample, which
+// keeps the track on the video clock however the IMU clock drifts. An empty
+// edit delays the track to the first record's movie time.
+
+const (
+	cammGyro  = 2
+	cammAccel = 3
+
+	cammSampleSize = 16
+)
+
+// buildCAMMTrack decodes the djmd streams of m into a CAMM track. The
+// samples are kept in a temporary file in dir until the track is closed.
+func buildCAMMTrack(m *mp4File, djmd []int, dir string) (*syntheticTrack, error) {
+	s, err := newSyntheticTrack(dir, "camm")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCAMMSamples(s, m, djmd); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func writeCAMMSamples(s *syntheticTrack, m *mp4File, djmd []int) error {
+	if err := checkIMUPlausible(m, djmd); err != nil {
+		return err
+	}
+	r := newIMUReader(m, djmd)
+	// Without a reference video, VideoTime is the movie time.
+	if err := r.alignTo(-1); err != nil {
+		return err
+	}
+	units := imuUnits{Gyro: "rad", Accel: "ms2"}
+
+	var prev IMUSample
+	var start, prevTick int64
+	have := false
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if rec.VideoTime < 0 {
+			continue
+		}
+		if !have {
+			// The sample rate is known once the first header is read.
+			s.track.Timescale = uint32(math.Round(4 * float64(r.header.SampleRate)))
+		}
+		tick := int64(math.Round(rec.VideoTime * float64(s.track.Timescale)))
+		if !have {
+			start = tick
+		} else {
+			// Keep room for both samples of the previous record.
+			if tick < prevTick+3 {
+				tick = prevTick + 3
+			}
+			if err := addCAMMRecord(s, prev, uint32(tick-prevTick-2)); err != nil {
+				return err
+			}
+		}
+		prev, prevTick, have = rec.Sample(units), tick, true
+	}
+	if !have {
+		return fmt.Errorf("IMU data not found")
+	}
+	if err := addCAMMRecord(s, prev, 2); err != nil {
+		return err
+	}
+	return s.finish(m.Timescale, uint64(start), "CameraMetadataMotionHandler")
+}
+
+// addCAMMRecord writes the gyroscope and accelerometer samples of smp;
+// accelDelta is the time until the next record's gyroscope sample.
+func addCAMMRecord(s *syntheticTrack, smp IMUSample, accelDelta uint32) error {
+	if err := s.addSample(cammPacket(cammGyro, smp.GyroX, smp.GyroY, smp.GyroZ), 2); err != nil {
+		return err
+	}
+	return s.addSample(cammPacket(cammAccel, smp.AccelX, smp.AccelY, smp.AccelZ), accelDelta)
+}
+
+func cammPacket(typ uint16, x, y, z float64) []byte {
+	b := make([]byte, 4, cammSampleSize)
+	binary.LittleEndian.PutUint16(b[2:], typ)
+	for _, v := range []float64{x, y, z} {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(v)))
+	}
+	return b
+}
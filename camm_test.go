@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testMotionIMU returns a djmd track of one packet at 400 Hz with 2000
+// deg/s and 8 g full scale: the camera turns at 1000 deg/s about X, then
+// lies still with 1 g on Z, then turns back at 500 deg/s. The packet lasts
+// duration ticks of timescale.
+func testMotionIMU(timescale, duration uint32) *testTrack {
+	chans := [][10]int16{
+		{16384, 0, 0, 0, 0, 4096},
+		{0, 0, 0, 0, 0, 4096},
+		{-8192, 0, 0, 2048, 0, 4096},
+	}
+	b := testIMUPacket(400, 2000, 8, 0, chans)
+	return &testTrack{
+		handler:  "meta",
+		entry:    makeBox("djmd", make([]byte, 8)),
+		mdhd:     makeFullBox("mdhd", 0, 0, u32s(0, 0, timescale, duration), []byte{0x55, 0xc4, 0, 0}),
+		stts:     []sttsEntry{{1, duration}},
+		sizes:    []uint32{uint32(len(b))},
+		perChunk: 1,
+		samples:  [][]byte{b},
+	}
+}
+
+// remuxSynthetic writes s alone into a MOV and returns its track and
+// samples.
+func remuxSynthetic(t *testing.T, m *mp4File, s *syntheticTrack) (*mp4Track, [][]byte) {
+	t.Helper()
+	out := filepath.Join(t.TempDir(), "out.mov")
+	if err := remuxTracks(context.Background(), m, out, ftypQuickTime, nil, s); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := openMP4(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if len(dst.Tracks) != 1 {
+		t.Fatalf("got %d tracks, want 1", len(dst.Tracks))
+	}
+	tr := dst.Tracks[0]
+	it, err := tr.samples()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples [][]byte
+	for smp, ok := it.Next(); ok; smp, ok = it.Next() {
+		b, err := dst.readSample(smp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, b)
+	}
+	return tr, samples
+}
+
+func TestCAMMTrack(t *testing.T) {
+	tests := []struct {
+		name                string
+		timescale, duration uint32
+		stts                []sttsEntry
+	}{
+		// Records 2.5 ms apart are 4 ticks; each packet lasts half of that.
+		{"on time", 400, 3, []sttsEntry{{6, 2}}},
+		// A packet lasting 10 ms spreads its records 3.3 ms apart, which
+		// the accelerometer samples absorb.
+		{"stretched", 1000, 10, []sttsEntry{{1, 2}, {1, 3}, {1, 2}, {1, 4}, {2, 2}}},
+	}
+	rad, g := math.Pi/180, standardGravity
+	want := []struct {
+		typ     uint16
+		x, y, z float64
+	}{
+		{cammGyro, 1000 * rad, 0, 0},
+		{cammAccel, 0, 0, 1 * g},
+		{cammGyro, 0, 0, 0},
+		{cammAccel, 0, 0, 1 * g},
+		{cammGyro, -500 * rad, 0, 0},
+		{cammAccel, 0.5 * g, 0, 1 * g},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		in := filepath.Join(dir, "in.mp4")
+		writeTestMP4(t, in, []*testTrack{testMotionIMU(tt.timescale, tt.duration)})
+		m, err := openMP4(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := buildCAMMTrack(m, []int{0}, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, samples := remuxSynthetic(t, m, s)
+		s.Close()
+		m.Close()
+
+		if tr.Format != "camm" || tr.Timescale != 1600 {
+			t.Errorf("%s: format %s, timescale %d", tt.name, tr.Format, tr.Timescale)
+		}
+		if !reflect.DeepEqual(tr.stts, tt.stts) {
+			t.Errorf("%s: stts %v, want %v", tt.name, tr.stts, tt.stts)
+		}
+		if len(samples) != len(want) {
+			t.Fatalf("%s: got %d samples, want %d", tt.name, len(samples), len(want))
+		}
+		for i, w := range want {
+			b := samples[i]
+			if len(b) != cammSampleSize || binary.LittleEndian.Uint16(b) != 0 {
+				t.Errorf("%s: sample %d: % x", tt.name, i, b)
+				continue
+			}
+			typ := binary.LittleEndian.Uint16(b[2:])
+			var v [3]float32
+			for j := range v {
+				v[j] = math.Float32frombits(binary.LittleEndian.Uint32(b[4+4*j:]))
+			}
+			if typ != w.typ || v != [3]float32{float32(w.x), float32(w.y), float32(w.z)} {
+				t.Errorf("%s: sample %d: type %d %v, want %d %v", tt.name, i, typ, v, w.typ, [3]float64{w.x, w.y, w.z})
+			}
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"osv2mov/internal/protowire"
+)
+
+// Lens calibration carried in the dbgi track. DJI does not document the
+// dbgi messages, and the field numbers below have not been confirmed
+// against footage with a known calibration; they are the layout this
+// decoder assumes:
+//
+//	packet           5: calibration (message)
+//	calibration      1: lens (repeated message)
+//	                 2: extrinsics (message)
+//	lens             1: lens id (varint, 0 = front, 1 = rear)
+//	                 2: fx, 3: fy, 4: cx, 5: cy (float, pixels)
+//	                 6: distortion k1..k4 (repeated float)
+//	                 7: width, 8: height (varint, pixels)
+//	extrinsics       1: rotation of the rear lens relative to the front,
+//	                    row-major 3x3 (repeated float)
+//	                 2: translation in metres (repeated float)
+//
+// Because the layout is a guess, the commands that use it need
+// -experimental-lens, and a calibration whose values no fisheye lens could
+// have is rejected rather than used.
+const (
+	dbgiCalibrationField = 5
+
+	calibLensField       = 1
+	calibExtrinsicsField = 2
+
+	lensIDField         = 1
+	lensFxField         = 2
+	lensFyField         = 3
+	lensCxField         = 4
+	lensCyField         = 5
+	lensDistortionField = 6
+	lensWidthField      = 7
+	lensHeightField     = 8
+
+	extrRotationField    = 1
+	extrTranslationField = 2
+)
+
+// maxCalibrationSearchPackets bounds how many dbgi packets are scanned.
+const maxCalibrationSearchPackets = 1024
+
+type lensIntrinsics struct {
+	Lens           string     `json:"lens"`
+	ID             int        `json:"id"`
+	Width          int        `json:"width"`
+	Height         int        `json:"height"`
+	Model          string     `json:"model"`
+	FocalLength    [2]float64 `json:"focal_length"`    // fx, fy in pixels
+	PrincipalPoint [2]float64 `json:"principal_point"` // cx, cy in pixels
+	Distortion     []float64  `json:"distortion"`      // k1..k4
+}
+
+type lensExtrinsics struct {
+	Rotation    [9]float64 `json:"rotation"`    // rear relative to front, row-major
+	Translation [3]float64 `json:"translation"` // metres
+}
+
+type lensCalibration struct {
+	Lenses     []lensIntrinsics `json:"lenses"`
+	Extrinsics *lensExtrinsics  `json:"extrinsics,omitempty"`
+}
+
+func (c *lensCalibration) lens(id int) *lensIntrinsics {
+	for i := range c.Lenses {
+		if c.Lenses[i].ID == id {
+			return &c.Lenses[i]
+		}
+	}
+	return nil
+}
+
+func lensName(id int) string {
+	switch id {
+	case 0:
+		return "front"
+	case 1:
+		return "rear"
+	}
+	return fmt.Sprintf("lens%d", id)
+}
+
+// readLensCalibration scans dbgi packets until both lenses have been seen.
+func readLensCalibration(m *mp4File, streamIndices []int) (*lensCalibration, error) {
+	cal := &lensCalibration{}
+streams:
+	for _, idx := range streamIndices {
+		pr, err := newPacketReader(m, idx)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < maxCalibrationSearchPackets; i++ {
+			p, err := pr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			decodeDbgiPacket(p.Data, cal)
+			if cal.lens(0) != nil && cal.lens(1) != nil && cal.Extrinsics != nil {
+				break streams
+			}
+		}
+	}
+	if len(cal.Lenses) == 0 {
+		return nil, fmt.Errorf("lens calibration not found in dbgi data")
+	}
+	if err := cal.check(); err != nil {
+		return nil, fmt.Errorf("implausible lens calibration in dbgi data: %v", err)
+	}
+	return cal, nil
+}
+
+// check rejects values that a misread field would give: the bounds hold
+// for any fisheye lens.
+func (c *lensCalibration) check() error {
+	for i := range c.Lenses {
+		if err := c.Lenses[i].check(); err != nil {
+			return fmt.Errorf("%s lens: %v", c.Lenses[i].Lens, err)
+		}
+	}
+	if e := c.Extrinsics; e != nil {
+		if err := checkRotation(e.Rotation); err != nil {
+			return fmt.Errorf("extrinsics: %v", err)
+		}
+		for _, v := range e.Translation {
+			if !(math.Abs(v) < 0.5) {
+				return fmt.Errorf("extrinsics: translation %v m", e.Translation)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *lensIntrinsics) check() error {
+	if l.Width <= 0 || l.Height <= 0 || l.Width > 16384 || l.Height > 16384 {
+		return fmt.Errorf("calibration size %dx%d", l.Width, l.Height)
+	}
+	w, h := float64(l.Width), float64(l.Height)
+	fx, fy := l.FocalLength[0], l.FocalLength[1]
+	cx, cy := l.PrincipalPoint[0], l.PrincipalPoint[1]
+	// A fisheye covering 180° or more has f well below the width.
+	if !(fx >= 0.1*w && fx <= 2*w && fy >= 0.1*h && fy <= 2*h) {
+		return fmt.Errorf("focal length %g, %g is not of the order of the %dx%d frame", fx, fy, l.Width, l.Height)
+	}
+	if math.Abs(fx/fy-1) > 0.1 {
+		return fmt.Errorf("focal lengths %g and %g differ by more than 10%%", fx, fy)
+	}
+	if !(cx > 0 && cx < w && cy > 0 && cy < h) {
+		return fmt.Errorf("principal point (%g, %g) outside the %dx%d frame", cx, cy, l.Width, l.Height)
+	}
+	if len(l.Distortion) > 4 {
+		return fmt.Errorf("%d distortion coefficients, want at most 4", len(l.Distortion))
+	}
+	for _, k := range l.Distortion {
+		if !(math.Abs(k) < 1) {
+			return fmt.Errorf("distortion coefficient %g", k)
+		}
+	}
+	return nil
+}
+
+// checkRotation fails unless the row-major matrix r is orthonormal with
+// determinant +1.
+func checkRotation(r [9]float64) error {
+	const tol = 1e-3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			dot := r[3*i]*r[3*j] + r[3*i+1]*r[3*j+1] + r[3*i+2]*r[3*j+2]
+			want := 0.0
+			if i == j {
+				want = 1
+			}
+			if !(math.Abs(dot-want) <= tol) {
+				return fmt.Errorf("rotation %v is not orthonormal", r)
+			}
+		}
+	}
+	det := r[0]*(r[4]*r[8]-r[5]*r[7]) - r[1]*(r[3]*r[8]-r[5]*r[6]) + r[2]*(r[3]*r[7]-r[4]*r[6])
+	if !(math.Abs(det-1) <= tol) {
+		return fmt.Errorf("rotation %v has determinant %g, want +1", r, det)
+	}
+	return nil
+}
+
+func decodeDbgiPacket(b []byte, cal *lensCalibration) {
+	fields, _ := protowire.Parse(b)
+	for _, f := range fields {
+		if f.Num != dbgiCalibrationField || f.Wire != protowire.BytesType {
+			continue
+		}
+		inner, _ := protowire.Parse(f.Bytes)
+		for _, g := range inner {
+			if g.Wire != protowire.BytesType {
+				continue
+			}
+			switch g.Num {
+			case calibLensField:
+				if l, ok := decodeLens(g.Bytes); ok && cal.lens(l.ID) == nil {
+					cal.Lenses = append(cal.Lenses, l)
+				}
+			case calibExtrinsicsField:
+				if e, ok := decodeExtrinsics(g.Bytes); ok && cal.Extrinsics == nil {
+					cal.Extrinsics = e
+				}
+			}
+		}
+	}
+}
+
+func decodeLens(b []byte) (lensIntrinsics, bool) {
+	l := lensIntrinsics{Model: "fisheye_kb4"}
+	fields, err := protowire.Parse(b)
+	if err != nil {
+		return l, false
+	}
+	for _, f := range fields {
+		switch f.Num {
+		case lensIDField:
+			l.ID = int(f.Value)
+		case lensWidthField:
+			l.Width = int(f.Value)
+		case lensHeightField:
+			l.Height = int(f.Value)
+		case lensFxField, lensFyField, lensCxField, lensCyField:
+			v := f.Floats()
+			if len(v) != 1 {
+				continue
+			}
+			switch f.Num {
+			case lensFxField:
+				l.FocalLength[0] = v[0]
+			case lensFyField:
+				l.FocalLength[1] = v[0]
+			case lensCxField:
+				l.PrincipalPoint[0] = v[0]
+			case lensCyField:
+				l.PrincipalPoint[1] = v[0]
+			}
+		case lensDistortionField:
+			l.Distortion = append(l.Distortion, f.Floats()...)
+		}
+	}
+	if l.FocalLength[0] == 0 || l.FocalLength[1] == 0 {
+		return l, false
+	}
+	l.Lens = lensName(l.ID)
+	return l, true
+}
+
+func decodeExtrinsics(b []byte) (*lensExtrinsics, bool) {
+	fields, err := protowire.Parse(b)
+	if err != nil {
+		return nil, false
+	}
+	var rot, trans []float64
+	for _, f := range fields {
+		switch f.Num {
+		case extrRotationField:
+			rot = append(rot, f.Floats()...)
+		case extrTranslationField:
+			trans = append(trans, f.Floats()...)
+		}
+	}
+	if len(rot) != 9 {
+		return nil, false
+	}
+	e := &lensExtrinsics{}
+	copy(e.Rotation[:], rot)
+	copy(e.Translation[:], trans)
+	return e, true
+}
+
+func writeLensCalibrationJSON(input string, streamIndices []int, out string) error {
+	m, err := openMP4(input)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	cal, err := readLensCalibration(m, streamIndices)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(cal, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeOutputFile(out, append(b, '\n'))
+}
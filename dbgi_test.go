@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testLensCalibration = &lensCalibration{
+	Lenses: []lensIntrinsics{
+		{
+			Lens: "front", ID: 0, Width: 3840, Height: 3840, Model: "fisheye_kb4",
+			FocalLength:    [2]float64{1024.5, 1024.25},
+			PrincipalPoint: [2]float64{1920, 1919.5},
+			Distortion:     []float64{0.0625, -0.015625, 0.00390625, -0.0009765625},
+		},
+		{
+			Lens: "rear", ID: 1, Width: 3840, Height: 3840, Model: "fisheye_kb4",
+			FocalLength:    [2]float64{1030, 1030.5},
+			PrincipalPoint: [2]float64{1921.25, 1918.75},
+			Distortion:     []float64{0.125, -0.03125, 0.0078125, 0},
+		},
+	},
+	Extrinsics: &lensExtrinsics{
+		Rotation:    [9]float64{-1, 0, 0, 0, 1, 0, 0, 0, -1},
+		Translation: [3]float64{0, 0, -0.03125},
+	},
+}
+
+// testCalibration returns a copy of testLensCalibration.
+func testCalibration() *lensCalibration {
+	c := *testLensCalibration
+	c.Lenses = append([]lensIntrinsics(nil), c.Lenses...)
+	for i := range c.Lenses {
+		c.Lenses[i].Distortion = append([]float64(nil), c.Lenses[i].Distortion...)
+	}
+	e := *c.Extrinsics
+	c.Extrinsics = &e
+	return &c
+}
+
+// testDbgiPacket encodes cal in the dbgi layout dbgi.go assumes.
+func testDbgiPacket(cal *lensCalibration) []byte {
+	f32 := func(num int, v float64) []byte { return pbFixed32(num, math.Float32bits(float32(v))) }
+	var parts [][]byte
+	for _, l := range cal.Lenses {
+		lens := pbCat(pbUint(lensIDField, uint64(l.ID)),
+			f32(lensFxField, l.FocalLength[0]), f32(lensFyField, l.FocalLength[1]),
+			f32(lensCxField, l.PrincipalPoint[0]), f32(lensCyField, l.PrincipalPoint[1]),
+			pbUint(lensWidthField, uint64(l.Width)), pbUint(lensHeightField, uint64(l.Height)))
+		for _, k := range l.Distortion {
+			lens = append(lens, f32(lensDistortionField, k)...)
+		}
+		parts = append(parts, pbBytes(calibLensField, lens))
+	}
+	if e := cal.Extrinsics; e != nil {
+		var extr []byte
+		for _, v := range e.Rotation {
+			extr = append(extr, f32(extrRotationField, v)...)
+		}
+		parts = append(parts, pbBytes(calibExtrinsicsField, extr))
+	}
+	return pbBytes(dbgiCalibrationField, parts...)
+}
+
+func TestDecodeDbgiPacket(t *testing.T) {
+	cal := &lensCalibration{}
+	decodeDbgiPacket(readHexFixture(t, "dbgi_packet.hex"), cal)
+	if !reflect.DeepEqual(cal, testLensCalibration) {
+		t.Errorf("calibration = %+v\nwant %+v", cal, testLensCalibration)
+	}
+
+	// A lens or extrinsics seen again in a later packet does not replace
+	// the first.
+	decodeDbgiPacket(pbBytes(dbgiCalibrationField,
+		pbBytes(calibLensField, pbUint(lensIDField, 0), pbFixed32(lensFxField, 0x3f800000), pbFixed32(lensFyField, 0x3f800000))), cal)
+	if !reflect.DeepEqual(cal, testLensCalibration) {
+		t.Errorf("calibration changed by a second packet: %+v", cal)
+	}
+}
+
+func TestDecodeLensWithoutFocalLength(t *testing.T) {
+	if _, ok := decodeLens(pbCat(pbUint(lensIDField, 1), pbUint(lensWidthField, 100))); ok {
+		t.Errorf("lens without focal length accepted")
+	}
+}
+
+func TestWriteLensCalibrationJSON(t *testing.T) {
+	// The calibration follows a packet without one.
+	packets := [][]byte{pbUint(1, 7), readHexFixture(t, "dbgi_packet.hex")}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dbgi.mp4")
+	writeTestMP4(t, path, []*testTrack{{
+		handler:  "meta",
+		entry:    makeBox("dbgi", make([]byte, 8)),
+		mdhd:     makeFullBox("mdhd", 0, 0, u32s(0, 0, 1000, 20), []byte{0x55, 0xc4, 0, 0}),
+		stts:     []sttsEntry{{2, 10}},
+		sizes:    []uint32{uint32(len(packets[0])), uint32(len(packets[1]))},
+		perChunk: 2,
+		samples:  packets,
+	}})
+	out := filepath.Join(dir, "lens.json")
+	if err := writeLensCalibrationJSON(path, []int{0}, out); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got lensCalibration
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, testLensCalibration) {
+		t.Errorf("lens.json = %s", b)
+	}
+}
+
+func TestLensCalibrationCheck(t *testing.T) {
+	if err := testLensCalibration.check(); err != nil {
+		t.Fatalf("fixture rejected: %v", err)
+	}
+	tests := []struct {
+		name string
+		edit func(c *lensCalibration)
+		want string
+	}{
+		{"no size", func(c *lensCalibration) { c.Lenses[0].Width = 0 }, "calibration size 0x3840"},
+		{"focal length in metres", func(c *lensCalibration) { c.Lenses[1].FocalLength = [2]float64{0.0024, 0.0024} }, "rear lens: focal length"},
+		{"focal length too long", func(c *lensCalibration) { c.Lenses[0].FocalLength[0] = 9000 }, "not of the order"},
+		{"unequal focal lengths", func(c *lensCalibration) { c.Lenses[0].FocalLength[1] = 1300 }, "differ by more than 10%"},
+		{"principal point outside", func(c *lensCalibration) { c.Lenses[0].PrincipalPoint[1] = 4000 }, "principal point"},
+		{"NaN principal point", func(c *lensCalibration) { c.Lenses[0].PrincipalPoint[0] = math.NaN() }, "principal point"},
+		{"large distortion", func(c *lensCalibration) { c.Lenses[1].Distortion[2] = 12 }, "distortion coefficient 12"},
+		{"too many coefficients", func(c *lensCalibration) { c.Lenses[1].Distortion = make([]float64, 5) }, "5 distortion coefficients"},
+		{"scaled rotation", func(c *lensCalibration) { c.Extrinsics.Rotation[4] = 2 }, "not orthonormal"},
+		{"reflection", func(c *lensCalibration) { c.Extrinsics.Rotation = [9]float64{1, 0, 0, 0, 1, 0, 0, 0, -1} }, "determinant -1"},
+		{"far translation", func(c *lensCalibration) { c.Extrinsics.Translation[2] = 3 }, "translation"},
+	}
+	for _, tt := range tests {
+		c := testCalibration()
+		tt.edit(c)
+		if err := c.check(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestWriteLensCalibrationJSONImplausible(t *testing.T) {
+	// A complete calibration with a 1-pixel front focal length, as a
+	// misread field might give.
+	cal := testCalibration()
+	cal.Lenses[0].FocalLength = [2]float64{1, 1}
+	packet := testDbgiPacket(cal)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dbgi.mp4")
+	writeTestMP4(t, path, []*testTrack{{
+		handler:  "meta",
+		entry:    makeBox("dbgi", make([]byte, 8)),
+		mdhd:     makeFullBox("mdhd", 0, 0, u32s(0, 0, 1000, 10), []byte{0x55, 0xc4, 0, 0}),
+		stts:     []sttsEntry{{1, 10}},
+		sizes:    []uint32{uint32(len(packet))},
+		perChunk: 1,
+		samples:  [][]byte{packet},
+	}})
+	out := filepath.Join(dir, "lens.json")
+	err := writeLensCalibrationJSON(path, []int{0}, out)
+	if err == nil || !strings.Contains(err.Error(), "implausible lens calibration") {
+		t.Errorf("error %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("output written for an implausible calibration")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// Orientation from the djmd IMU records by sensor fusion. The filters
+// track a unit quaternion q that rotates vectors from the IMU frame into an
+// earth frame whose Z axis points up. Without a magnetometer the heading
+// around Z is only integrated from the gyroscope and drifts slowly; tilt is
+// held by the accelerometer.
+//
+// The filters start from the tilt of the first accelerometer reading, so
+// they need no settling time.
+
+const (
+	defaultMadgwickBeta      = 0.05 // rad/s
+	defaultComplementaryGain = 0.5  // 1/s
+)
+
+type quat [4]float64 // w, x, y, z
+
+func (a quat) mul(b quat) quat {
+	return quat{
+		a[0]*b[0] - a[1]*b[1] - a[2]*b[2] - a[3]*b[3],
+		a[0]*b[1] + a[1]*b[0] + a[2]*b[3] - a[3]*b[2],
+		a[0]*b[2] - a[1]*b[3] + a[2]*b[0] + a[3]*b[1],
+		a[0]*b[3] + a[1]*b[2] - a[2]*b[1] + a[3]*b[0],
+	}
+}
+
+func (q quat) conj() quat {
+	return quat{q[0], -q[1], -q[2], -q[3]}
+}
+
+func (q quat) normalize() quat {
+	n := math.Sqrt(q[0]*q[0] + q[1]*q[1] + q[2]*q[2] + q[3]*q[3])
+	if n == 0 {
+		return quat{1, 0, 0, 0}
+	}
+	return quat{q[0] / n, q[1] / n, q[2] / n, q[3] / n}
+}
+
+// rotate returns q v q*.
+func (q quat) rotate(v [3]float64) [3]float64 {
+	r := q.mul(quat{0, v[0], v[1], v[2]}).mul(q.conj())
+	return [3]float64{r[1], r[2], r[3]}
+}
+
+// up returns the earth's up direction in the IMU frame.
+func (q quat) up() [3]float64 {
+	return q.conj().rotate([3]float64{0, 0, 1})
+}
+
+// quatFromTo returns the shortest rotation taking unit vector a to b.
+func quatFromTo(a, b [3]float64) quat {
+	d := dot3(a, b)
+	if d < -0.999999 {
+		// Opposite vectors: turn half way round any perpendicular axis.
+		axis := cross3(a, [3]float64{1, 0, 0})
+		if dot3(axis, axis) < 1e-12 {
+			axis = cross3(a, [3]float64{0, 1, 0})
+		}
+		return quat{0, axis[0], axis[1], axis[2]}.normalize()
+	}
+	c := cross3(a, b)
+	return quat{1 + d, c[0], c[1], c[2]}.normalize()
+}
+
+func dot3(a, b [3]float64) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func cross3(a, b [3]float64) [3]float64 {
+	return [3]float64{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+func unit3(v [3]float64) ([3]float64, bool) {
+	n := math.Sqrt(dot3(v, v))
+	if n == 0 {
+		return v, false
+	}
+	return [3]float64{v[0] / n, v[1] / n, v[2] / n}, true
+}
+
+// fusionFilter estimates orientation from gyroscope (rad/s) and
+// accelerometer readings; the accelerometer scale does not matter.
+type fusionFilter interface {
+	update(gyro, accel [3]float64, dt float64)
+	orientation() quat
+}
+
+// newFusionFilter returns the named filter; gain <= 0 selects its default
+// gain.
+func newFusionFilter(name string, gain float64) (fusionFilter, error) {
+	if math.IsNaN(gain) || math.IsInf(gain, 0) {
+		return nil, fmt.Errorf("invalid fusion gain: %g", gain)
+	}
+	switch name {
+	case "madgwick":
+		return &madgwickFilter{beta: fusionGain(name, gain)}, nil
+	case "complementary":
+		return &complementaryFilter{gain: fusionGain(name, gain)}, nil
+	}
+	return nil, fmt.Errorf("invalid fusion filter: %s (expected madgwick or complementary)", name)
+}
+
+// fusionGain returns the gain the named filter runs with.
+func fusionGain(name string, gain float64) float64 {
+	if gain > 0 {
+		return gain
+	}
+	if name == "complementary" {
+		return defaultComplementaryGain
+	}
+	return defaultMadgwickBeta
+}
+
+// initialTilt aligns the measured up direction with the earth's Z axis.
+func initialTilt(accel [3]float64) (quat, bool) {
+	a, ok := unit3(accel)
+	if !ok {
+		return quat{}, false
+	}
+	return quatFromTo(a, [3]float64{0, 0, 1}), true
+}
+
+// madgwickFilter is the IMU variant of Madgwick's gradient descent filter;
+// beta is the correction rate in rad/s.
+type madgwickFilter struct {
+	q    quat
+	beta float64
+	init bool
+}
+
+func (f *madgwickFilter) orientation() quat { return f.q }
+
+func (f *madgwickFilter) update(gyro, accel [3]float64, dt float64) {
+	if !f.init {
+		f.q, f.init = initialTilt(accel)
+		return
+	}
+	q0, q1, q2, q3 := f.q[0], f.q[1], f.q[2], f.q[3]
+	// Rate of change from the gyroscope, in the IMU frame.
+	dq := f.q.mul(quat{0, gyro[0], gyro[1], gyro[2]})
+	for i := range dq {
+		dq[i] *= 0.5
+	}
+	if a, ok := unit3(accel); ok {
+		// Gradient of the error between the measured and the expected up
+		// direction.
+		s := quat{
+			4*q0*q2*q2 + 2*q2*a[0] + 4*q0*q1*q1 - 2*q1*a[1],
+			4*q1*q3*q3 - 2*q3*a[0] + 4*q0*q0*q1 - 2*q0*a[1] - 4*q1 + 8*q1*q1*q1 + 8*q1*q2*q2 + 4*q1*a[2],
+			4*q0*q0*q2 + 2*q0*a[0] + 4*q2*q3*q3 - 2*q3*a[1] - 4*q2 + 8*q2*q1*q1 + 8*q2*q2*q2 + 4*q2*a[2],
+			4*q1*q1*q3 - 2*q1*a[0] + 4*q2*q2*q3 - 2*q2*a[1],
+		}
+		if s != (quat{}) {
+			s = s.normalize()
+			for i := range dq {
+				dq[i] -= f.beta * s[i]
+			}
+		}
+	}
+	for i := range f.q {
+		f.q[i] += dq[i] * dt
+	}
+	f.q = f.q.normalize()
+}
+
+// complementaryFilter integrates the gyroscope and pulls the tilt towards
+// the accelerometer, proportional to the angle between them (Mahony's
+// filter without the integral term); gain is the correction rate in 1/s.
+type complementaryFilter struct {
+	q    quat
+	gain float64
+	init bool
+}
+
+func (f *complementaryFilter) orientation() quat { return f.q }
+
+func (f *complementaryFilter) update(gyro, accel [3]float64, dt float64) {
+	if !f.init {
+		f.q, f.init = initialTilt(accel)
+		return
+	}
+	w := gyro
+	if a, ok := unit3(accel); ok {
+		e := cross3(a, f.q.up())
+		for i := range w {
+			w[i] += f.gain * e[i]
+		}
+	}
+	dq := f.q.mul(quat{0, w[0], w[1], w[2]})
+	for i := range f.q {
+		f.q[i] += 0.5 * dq[i] * dt
+	}
+	f.q = f.q.normalize()
+}
+
+// fuseIMU runs f over the records of r and calls emit with each record and
+// the orientation after it. Time steps come from the video-aligned record
+// times; implausible steps fall back to the nominal sample period.
+func fuseIMU(r *imuReader, f fusionFilter, emit func(rec IMURecord, q quat) error) error {
+	units := imuUnits{Gyro: "rad", Accel: "g"}
+	var prev float64
+	have := false
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		dt := rec.VideoTime - prev
+		if !have || dt <= 0 || dt > 0.1 {
+			dt = 1 / float64(r.header.SampleRate)
+		}
+		prev, have = rec.VideoTime, true
+
+		smp := rec.Sample(units)
+		f.update([3]float64{smp.GyroX, smp.GyroY, smp.GyroZ}, [3]float64{smp.AccelX, smp.AccelY, smp.AccelZ}, dt)
+		if err := emit(rec, f.orientation()); err != nil {
+			return err
+		}
+	}
+	if !have {
+		return fmt.Errorf("IMU data not found")
+	}
+	return nil
+}
+
+// euler returns the yaw, pitch and roll of q in degrees for the IMU axes
+// (X forward, Y left, Z up), applied in that order: yaw turns left about
+// the vertical, pitch raises the nose and roll lowers the right side.
+func (q quat) euler() (yaw, pitch, roll float64) {
+	w, x, y, z := q[0], q[1], q[2], q[3]
+	deg := 180 / math.Pi
+	yaw = math.Atan2(2*(w*z+x*y), 1-2*(y*y+z*z)) * deg
+	pitch = -math.Asin(math.Max(-1, math.Min(1, 2*(w*y-z*x)))) * deg
+	roll = math.Atan2(2*(w*x+y*z), 1-2*(x*x+y*y)) * deg
+	return yaw, pitch, roll
+}
+
+// imuToCamera maps an IMU-frame vector into the front lens camera frame
+// used for stitching (X right, Y down, Z forward), taking the IMU axes as X
+// forward, Y left and Z up.
+func imuToCamera(v [3]float64) [3]float64 {
+	return [3]float64{-v[1], -v[2], v[0]}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// GoPro Metadata Format (GPMF) export, see
+// https://github.com/gopro/gpmf-parser. The IMU records are grouped into
+// one payload per second of movie time, each laid out as
+//
+//	DEVC
+//	  DVID, DVNM
+//	  STRM  STMP, TSMP, STNM, SIUN, SCAL, GYRO (rad/s)
+//	  STRM  STMP, TSMP, STNM, SIUN, SCAL, ACCL (m/s²)
+//
+// Values are big-endian int16 triples divided by SCAL. STMP is the movie
+// time of the payload's first sample in microseconds and TSMP the number of
+// samples written so far, including the payload.
+
+const (
+	gpmfDeviceID   = 1
+	gpmfDeviceName = "DJI OSMO 360"
+
+	gpmfTimescale = 1000 // gpmd track ticks per second
+)
+
+// gpmfKLV encodes one key-length-value entry, padding data to 32 bits.
+func gpmfKLV(key string, typ byte, size, repeat int, data []byte) []byte {
+	b := make([]byte, 8, 8+len(data)+3)
+	copy(b, key)
+	b[4] = typ
+	b[5] = byte(size)
+	binary.BigEndian.PutUint16(b[6:], uint16(repeat))
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func gpmfNest(key string, children ...[]byte) []byte {
+	var data []byte
+	for _, c := range children {
+		data = append(data, c...)
+	}
+	// Children are 32-bit aligned, so the nest is sized in 4-byte units.
+	return gpmfKLV(key, 0, 4, len(data)/4, data)
+}
+
+func gpmfString(key, s string) []byte {
+	return gpmfKLV(key, 'c', len(s), 1, []byte(s))
+}
+
+func gpmfUint32(key string, v uint32) []byte {
+	return gpmfKLV(key, 'L', 4, 1, binary.BigEndian.AppendUint32(nil, v))
+}
+
+func gpmfUint64(key string, v uint64) []byte {
+	return gpmfKLV(key, 'J', 8, 1, binary.BigEndian.AppendUint64(nil, v))
+}
+
+// gpmfScale picks the largest integer SCAL that keeps fullScale within
+// int16.
+func gpmfScale(fullScale float64) int16 {
+	if fullScale <= 0 {
+		return 1
+	}
+	s := math.Floor(math.MaxInt16 / fullScale)
+	return int16(math.Max(1, math.Min(s, math.MaxInt16)))
+}
+
+// gpmfStream encodes one STRM of xyz triples. values holds the triples in
+// physical units.
+func gpmfStream(key, name, unit string, scal int16, start uint64, total uint32, values [][3]float64) []byte {
+	data := make([]byte, 0, len(values)*6)
+	for _, v := range values {
+		for _, x := range v {
+			c := math.Round(x * float64(scal))
+			c = math.Max(math.MinInt16, math.Min(math.MaxInt16, c))
+			data = binary.BigEndian.AppendUint16(data, uint16(int16(c)))
+		}
+	}
+	return gpmfNest("STRM",
+		gpmfUint64("STMP", start),
+		gpmfUint32("TSMP", total),
+		gpmfString("STNM", name),
+		gpmfString("SIUN", unit),
+		gpmfKLV("SCAL", 's', 2, 1, binary.BigEndian.AppendUint16(nil, uint16(scal))),
+		gpmfKLV(key, 's', 6, len(values), data),
+	)
+}
+
+// gpmfPayload collects the records of one second of movie time.
+type gpmfPayload struct {
+	second int64
+	start  uint64 // movie time of the first record in µs
+	gyro   [][3]float64
+	accel  [][3]float64
+	gscal  int16
+	ascal  int16
+}
+
+func (p *gpmfPayload) encode(total uint32) []byte {
+	return gpmfNest("DEVC",
+		gpmfUint32("DVID", gpmfDeviceID),
+		gpmfString("DVNM", gpmfDeviceName),
+		gpmfStream("GYRO", "Gyroscope", "rad/s", p.gscal, p.start, total, p.gyro),
+		gpmfStream("ACCL", "Accelerometer", "m/s\xb2", p.ascal, p.start, total, p.accel),
+	)
+}
+
+// writeGPMFPayloads groups the djmd IMU records of m into one-second GPMF
+// payloads on the movie timeline. emit receives each payload with its start
+// and duration in gpmd track ticks; seconds without records are skipped
+// and covered by the previous payload's duration.
+func writeGPMFPayloads(m *mp4File, djmd []int, emit func(payload []byte, start uint64, duration uint32) error) error {
+	if err := checkIMUPlausible(m, djmd); err != nil {
+		return err
+	}
+	r := newIMUReader(m, djmd)
+	// Without a reference video, VideoTime is the movie time.
+	if err := r.alignTo(-1); err != nil {
+		return err
+	}
+	units := imuUnits{Gyro: "rad", Accel: "ms2"}
+
+	var cur *gpmfPayload
+	var total uint32
+	var last float64
+	flush := func(duration uint32) error {
+		total += uint32(len(cur.gyro))
+		return emit(cur.encode(total), uint64(cur.second)*gpmfTimescale, duration)
+	}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if rec.VideoTime < 0 {
+			continue
+		}
+		sec := int64(rec.VideoTime)
+		if cur != nil && sec != cur.second {
+			if err := flush(uint32(sec-cur.second) * gpmfTimescale); err != nil {
+				return err
+			}
+			cur = nil
+		}
+		if cur == nil {
+			// The scale follows the sensor range of the payload's first
+			// record.
+			cur = &gpmfPayload{
+				second: sec,
+				start:  uint64(math.Round(rec.VideoTime * 1e6)),
+				gscal:  gpmfScale(rec.GyroScale * 32768 * math.Pi / 180),
+				ascal:  gpmfScale(rec.AccelScale * 32768 * standardGravity),
+			}
+		}
+		smp := rec.Sample(units)
+		cur.gyro = append(cur.gyro, [3]float64{smp.GyroX, smp.GyroY, smp.GyroZ})
+		cur.accel = append(cur.accel, [3]float64{smp.AccelX, smp.AccelY, smp.AccelZ})
+		last = rec.VideoTime
+	}
+	if cur == nil {
+		return fmt.Errorf("IMU data not found")
+	}
+	// The last payload ends one sample period after its last record.
+	end := last + 1/float64(r.header.SampleRate)
+	d := uint32(math.Ceil((end - float64(cur.second)) * gpmfTimescale))
+	return flush(max(d, 1))
+}
+
+// writeGPMFBin writes the GPMF payloads back to back, as a raw gpmd track
+// dump would hold them.
+func writeGPMFBin(input string, djmd []int, out string) error {
+	m, err := openMP4(input)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	f, err := createOutput(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	err = writeGPMFPayloads(m, djmd, func(payload []byte, _ uint64, _ uint32) error {
+		_, err := w.Write(payload)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// buildGPMFTrack decodes the djmd streams of m into a gpmd track with one
+// payload per sample.
+func buildGPMFTrack(m *mp4File, djmd []int, dir string) (*syntheticTrack, error) {
+	s, err := newSyntheticTrack(dir, "gpmd")
+	if err != nil {
+		return nil, err
+	}
+	s.track.Timescale = gpmfTimescale
+	var start uint64
+	first := true
+	err = writeGPMFPayloads(m, djmd, func(payload []byte, t uint64, duration uint32) error {
+		if first {
+			start, first = t, false
+		}
+		return s.addSample(payload, duration)
+	})
+	if err == nil {
+		err = s.finish(m.Timescale, start, "GoPro MET")
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
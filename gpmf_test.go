@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// gpmfEntry is one decoded KLV entry; nests keep their children.
+type gpmfEntry struct {
+	key          string
+	typ          byte
+	size, repeat int
+	data         []byte
+	children     []gpmfEntry
+}
+
+func parseGPMF(t *testing.T, b []byte) []gpmfEntry {
+	t.Helper()
+	var out []gpmfEntry
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("truncated KLV header % x", b)
+		}
+		e := gpmfEntry{key: string(b[:4]), typ: b[4], size: int(b[5]), repeat: int(binary.BigEndian.Uint16(b[6:]))}
+		n := e.size * e.repeat
+		padded := (n + 3) &^ 3
+		if len(b) < 8+padded {
+			t.Fatalf("%s: %d bytes of data, have %d", e.key, padded, len(b)-8)
+		}
+		e.data = b[8 : 8+n]
+		if e.typ == 0 {
+			e.children = parseGPMF(t, e.data)
+		}
+		out = append(out, e)
+		b = b[8+padded:]
+	}
+	return out
+}
+
+func gpmfFind(t *testing.T, entries []gpmfEntry, key string) gpmfEntry {
+	t.Helper()
+	for _, e := range entries {
+		if e.key == key {
+			return e
+		}
+	}
+	t.Fatalf("%s not found", key)
+	return gpmfEntry{}
+}
+
+func TestGPMFKLV(t *testing.T) {
+	if got, want := gpmfString("DVNM", "abcde"), []byte("DVNMc\x05\x00\x01abcde\x00\x00\x00"); !reflect.DeepEqual(got, want) {
+		t.Errorf("string = % x, want % x", got, want)
+	}
+	nest := gpmfNest("DEVC", gpmfUint32("DVID", 1))
+	if want := []byte("DEVC\x00\x04\x00\x03DVIDL\x04\x00\x01\x00\x00\x00\x01"); !reflect.DeepEqual(nest, want) {
+		t.Errorf("nest = % x, want % x", nest, want)
+	}
+	for fullScale, want := range map[float64]int16{0: 1, 32767: 1, 1e6: 1, 8 * standardGravity: 417, 2000 * math.Pi / 180: 938, 0.5: math.MaxInt16} {
+		if got := gpmfScale(fullScale); got != want {
+			t.Errorf("gpmfScale(%g) = %d, want %d", fullScale, got, want)
+		}
+	}
+}
+
+func TestGPMFTrack(t *testing.T) {
+	tests := []struct {
+		name   string
+		imu    *testTrack
+		stts   []sttsEntry
+		counts []uint32 // TSMP of each payload
+	}{
+		{"one payload", testMotionIMU(400, 3), []sttsEntry{{1, 8}}, []uint32{3}},
+		// 1.2 s of records: a full second, then the rest.
+		{"two payloads", testStillIMU(12), []sttsEntry{{1, 1000}, {1, 200}}, []uint32{400, 480}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		in := filepath.Join(dir, "in.mp4")
+		writeTestMP4(t, in, []*testTrack{tt.imu})
+		m, err := openMP4(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := buildGPMFTrack(m, []int{0}, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, samples := remuxSynthetic(t, m, s)
+		s.Close()
+		m.Close()
+
+		if tr.Format != "gpmd" || tr.Timescale != gpmfTimescale {
+			t.Errorf("%s: format %s, timescale %d", tt.name, tr.Format, tr.Timescale)
+		}
+		if !reflect.DeepEqual(tr.stts, tt.stts) {
+			t.Errorf("%s: stts %v, want %v", tt.name, tr.stts, tt.stts)
+		}
+		if len(samples) != len(tt.counts) {
+			t.Fatalf("%s: got %d payloads, want %d", tt.name, len(samples), len(tt.counts))
+		}
+		for i, b := range samples {
+			devc := parseGPMF(t, b)
+			if len(devc) != 1 || devc[0].key != "DEVC" {
+				t.Fatalf("%s: payload %d is not one DEVC", tt.name, i)
+			}
+			if dvnm := gpmfFind(t, devc[0].children, "DVNM"); string(dvnm.data) != gpmfDeviceName {
+				t.Errorf("%s: DVNM %q", tt.name, dvnm.data)
+			}
+			for _, strm := range devc[0].children[2:] {
+				if stmp := binary.BigEndian.Uint64(gpmfFind(t, strm.children, "STMP").data); stmp != uint64(i)*1e6 {
+					t.Errorf("%s: payload %d: STMP %d", tt.name, i, stmp)
+				}
+				if tsmp := binary.BigEndian.Uint32(gpmfFind(t, strm.children, "TSMP").data); tsmp != tt.counts[i] {
+					t.Errorf("%s: payload %d: TSMP %d, want %d", tt.name, i, tsmp, tt.counts[i])
+				}
+			}
+		}
+	}
+}
+
+func TestGPMFValues(t *testing.T) {
+	in := filepath.Join(t.TempDir(), "in.mp4")
+	writeTestMP4(t, in, []*testTrack{testMotionIMU(400, 3)})
+	var payloads [][]byte
+	src, err := openMP4(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	err = writeGPMFPayloads(src, []int{0}, func(p []byte, _ uint64, _ uint32) error {
+		payloads = append(payloads, p)
+		return nil
+	})
+	if err != nil || len(payloads) != 1 {
+		t.Fatalf("writeGPMFPayloads: %d payloads, %v", len(payloads), err)
+	}
+	// Values are int16 counts of 1/SCAL.
+	devc := parseGPMF(t, payloads[0])[0].children
+	for _, tt := range []struct {
+		key    string
+		scal   int16
+		values []int16
+	}{
+		// 1000 and -500 deg/s at 938 counts per rad/s.
+		{"GYRO", 938, []int16{16371, 0, 0, 0, 0, 0, -8186, 0, 0}},
+		// 1 g and 0.5 g at 417 counts per m/s².
+		{"ACCL", 417, []int16{0, 0, 4089, 0, 0, 4089, 2045, 0, 4089}},
+	} {
+		var strm gpmfEntry
+		for _, e := range devc {
+			if e.key == "STRM" && e.children[len(e.children)-1].key == tt.key {
+				strm = e
+			}
+		}
+		if strm.key == "" {
+			t.Fatalf("%s stream not found", tt.key)
+		}
+		if scal := int16(binary.BigEndian.Uint16(gpmfFind(t, strm.children, "SCAL").data)); scal != tt.scal {
+			t.Errorf("%s: SCAL %d, want %d", tt.key, scal, tt.scal)
+		}
+		v := gpmfFind(t, strm.children, tt.key)
+		if v.typ != 's' || v.size != 6 || v.repeat != 3 {
+			t.Errorf("%s: type %c, size %d, repeat %d", tt.key, v.typ, v.size, v.repeat)
+		}
+		var got []int16
+		for i := 0; i+1 < len(v.data); i += 2 {
+			got = append(got, int16(binary.BigEndian.Uint16(v.data[i:])))
+		}
+		if !reflect.DeepEqual(got, tt.values) {
+			t.Errorf("%s: values %v, want %v", tt.key, got, tt.values)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+)
+
+// Gyroflow .gcsv export. One log is written per lens next to the MOV files,
+// named so that Gyroflow picks it up automatically for <base>_<lens>.mov.
+//
+// Samples are stored as raw sensor counts; the header scales convert them
+// to seconds (tscale), rad/s (gscale) and g (ascale). Timestamps are the
+// video-aligned record times in microseconds, so t = 0 is the first frame
+// of the lens's own video track.
+
+const gcsvTimeScale = 1e-6
+
+// gcsvOrientation returns the IMU axis orientation of a lens in Gyroflow
+// notation. Gyroflow's camera frame has X right, Y up and Z pointing back
+// from the lens; letter j names the IMU axis that gives camera axis j, and
+// a lowercase letter inverts it. The string is derived from imuToCamera
+// and, for the rear lens, the rotation the stitcher assumes without
+// extrinsics, so the two cannot disagree.
+func gcsvOrientation(lens int) string {
+	rot := [9]float64{1, 0, 0, 0, 1, 0, 0, 0, 1}
+	if lens == 1 {
+		rot = rearLensRotation
+	}
+	var s [3]byte
+	for i, name := range []byte("XYZ") {
+		var e [3]float64
+		e[i] = 1
+		c := imuToCamera(e)
+		// Into the lens frame with the transposed rotation, then from
+		// X right, Y down, Z forward to Gyroflow's axes.
+		l := [3]float64{
+			rot[0]*c[0] + rot[3]*c[1] + rot[6]*c[2],
+			rot[1]*c[0] + rot[4]*c[1] + rot[7]*c[2],
+			rot[2]*c[0] + rot[5]*c[1] + rot[8]*c[2],
+		}
+		for j, v := range [3]float64{l[0], -l[1], -l[2]} {
+			if v > 0.5 {
+				s[j] = name
+			} else if v < -0.5 {
+				s[j] = name + 'a' - 'A'
+			}
+		}
+	}
+	return string(s[:])
+}
+
+// writeGyroflowLogs writes <base>_front.gcsv and <base>_rear.gcsv from the
+// djmd streams, each aligned to the matching video track.
+func writeGyroflowLogs(input string, djmd, vids []int, subdir, base string, log io.Writer, verbose bool, outs *outputSet) error {
+	if len(vids) == 0 {
+		return fmt.Errorf("no video streams found")
+	}
+	m, err := openMP4(input)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if err := checkIMUPlausible(m, djmd); err != nil {
+		return err
+	}
+
+	for i, vidIdx := range vids {
+		if i >= 2 {
+			break
+		}
+		lens := lensName(i)
+		out := filepath.Join(subdir, fmt.Sprintf("%s_%s.gcsv", base, lens))
+		if write, err := outs.check(out, ""); err != nil {
+			return err
+		} else if !write {
+			continue
+		}
+		if verbose {
+			fmt.Fprintf(log, "Outputting Gyroflow log: %s\n", out)
+		}
+		r := newIMUReader(m, djmd)
+		if err := r.alignTo(vidIdx); err != nil {
+			return err
+		}
+		video := fmt.Sprintf("%s_%s.mov", base, lens)
+		if err := writeGCSV(r, out, base+"_"+lens, gcsvOrientation(i), video); err != nil {
+			return err
+		}
+		outs.done(out, "")
+		if verbose {
+			fmt.Fprintf(log, "Gyroflow log completed: %s (%d records)\n", out, r.stats.Records)
+		}
+	}
+	return nil
+}
+
+func writeGCSV(r *imuReader, out, id, orientation, video string) error {
+	// The scales go in the header, so take them from the first record.
+	first, err := r.Read()
+	if err == io.EOF {
+		return fmt.Errorf("IMU data not found")
+	}
+	if err != nil {
+		return err
+	}
+	gscale := first.GyroScale * math.Pi / 180
+	ascale := first.AccelScale
+
+	f, err := createOutput(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	fmt.Fprintf(w, "GYROFLOW IMU LOG\n")
+	fmt.Fprintf(w, "version,1.3\n")
+	fmt.Fprintf(w, "id,%s\n", id)
+	fmt.Fprintf(w, "orientation,%s\n", orientation)
+	fmt.Fprintf(w, "vendor,DJI\n")
+	fmt.Fprintf(w, "videofilename,%s\n", video)
+	fmt.Fprintf(w, "tscale,%g\n", gcsvTimeScale)
+	fmt.Fprintf(w, "gscale,%.12g\n", gscale)
+	fmt.Fprintf(w, "ascale,%.12g\n", ascale)
+	fmt.Fprintf(w, "t,gx,gy,gz,ax,ay,az\n")
+
+	rec := first
+	for {
+		// Records are written in the counts of the first header; rescale
+		// if a later header changes the sensor range.
+		g, a := 1.0, 1.0
+		if rec.GyroScale != first.GyroScale {
+			g = rec.GyroScale / first.GyroScale
+		}
+		if rec.AccelScale != first.AccelScale {
+			a = rec.AccelScale / first.AccelScale
+		}
+		fmt.Fprintf(w, "%d,%d,%d,%d,%d,%d,%d\n",
+			int64(math.Round(rec.VideoTime/gcsvTimeScale)),
+			gcsvCount(rec.Ch0, g), gcsvCount(rec.Ch1, g), gcsvCount(rec.Ch2, g),
+			gcsvCount(rec.Ch3, a), gcsvCount(rec.Ch4, a), gcsvCount(rec.Ch5, a))
+
+		rec, err = r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+func gcsvCount(v int16, scale float64) int64 {
+	if scale == 1 {
+		return int64(v)
+	}
+	return int64(math.Round(float64(v) * scale))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// applyGCSVOrientation maps IMU vector v to Gyroflow's camera frame as
+// Gyroflow reads the orientation string.
+func applyGCSVOrientation(orientation string, v [3]float64) [3]float64 {
+	var out [3]float64
+	for j, c := range orientation {
+		axis := strings.IndexRune("XYZ", c)
+		sign := 1.0
+		if axis < 0 {
+			axis, sign = strings.IndexRune("xyz", c), -1
+		}
+		out[j] = sign * v[axis]
+	}
+	return out
+}
+
+func TestGCSVOrientation(t *testing.T) {
+	// Gravity reads +1 g up the IMU Z axis while level.
+	v := [3]float64{0.25, -0.5, 1}
+	c := imuToCamera(v)
+	tests := []struct {
+		lens int
+		want string
+		cam  [3]float64 // v in the lens camera frame: X right, Y up, Z back
+	}{
+		{0, "yZx", [3]float64{c[0], -c[1], -c[2]}},
+		{1, "YZX", [3]float64{-c[0], -c[1], c[2]}},
+	}
+	for _, tt := range tests {
+		got := gcsvOrientation(tt.lens)
+		if got != tt.want {
+			t.Errorf("lens %d: orientation %s, want %s", tt.lens, got, tt.want)
+		}
+		if cam := applyGCSVOrientation(got, v); cam != tt.cam {
+			t.Errorf("lens %d: %s maps %v to %v, imuToCamera gives %v", tt.lens, got, v, cam, tt.cam)
+		}
+	}
+}
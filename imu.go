@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+
+	"osv2mov/internal/protowire"
+)
+
+func decodeDataTrackToCSVCombined(input string, streamIndices []int, videoIndex int, out string, timeBase string, units imuUnits) (imuStats, error) {
+	m, err := openMP4(input)
+	if err != nil {
+		return imuStats{}, err
+	}
+	defer m.Close()
+
+	r := newIMUReader(m, streamIndices)
+	r.timeBase = timeBase
+	if err := r.alignTo(videoIndex); err != nil {
+		return imuStats{}, err
+	}
+	if err := writeIMUCSV(r, out, units); err != nil {
+		return imuStats{}, err
+	}
+	return r.stats, nil
+}
+
+// imuDeviceTickHz is the rate of the hardware timestamp stored in each IMU
+// record. DJI does not document the djmd format, so the 1 MHz rate is an
+// assumption that has not been checked against a clock of known rate. It
+// affects the device time base and the gap statistics only; the default
+// sample time base does not use the counter.
+const imuDeviceTickHz = 1_000_000
+
+// imuStats summarizes the hardware clock as seen while reading records.
+type imuStats struct {
+	Records   int
+	Gaps      int     // intervals longer than 1.5 nominal sample periods
+	MaxGap    float64 // longest interval in seconds
+	Wraps     int     // 32-bit counter wraparounds
+	Backsteps int     // counter moved backwards by more than half its range
+}
+
+// imuReader decodes IMU records from one or more djmd streams, one packet
+// at a time, so memory use does not grow with the recording length.
+type imuReader struct {
+	m       *mp4File
+	streams []int
+	packets *packetReader
+	pending []IMURecord
+	header  imuHeader
+	next    int
+
+	// timeBase selects how Timestamp is computed: "sample" derives it from
+	// the sample index, "device" from the unwrapped hardware counter.
+	timeBase string
+	lastTick uint32
+	elapsed  uint64
+	stats    imuStats
+
+	// Presentation start and frame duration of the reference video track,
+	// in seconds on the movie timeline.
+	videoStart    float64
+	frameDuration float64
+}
+
+func newIMUReader(m *mp4File, streams []int) *imuReader {
+	return &imuReader{m: m, streams: streams, header: defaultIMUHeader, timeBase: "sample"}
+}
+
+// Read returns the next record, or io.EOF when all streams are exhausted.
+func (r *imuReader) Read() (IMURecord, error) {
+	for len(r.pending) == 0 {
+		if r.packets == nil {
+			if len(r.streams) == 0 {
+				return IMURecord{}, io.EOF
+			}
+			pr, err := newPacketReader(r.m, r.streams[0])
+			if err != nil {
+				return IMURecord{}, err
+			}
+			r.packets = pr
+			r.streams = r.streams[1:]
+		}
+		p, err := r.packets.Read()
+		if err == io.EOF {
+			r.packets = nil
+			continue
+		}
+		if err != nil {
+			return IMURecord{}, err
+		}
+		r.pending = decodeIMUData(p.Data, &r.header)
+		r.anchor(p, r.packets.t)
+	}
+
+	rec := r.pending[0]
+	r.pending = r.pending[1:]
+	// サンプルインデックスを連続させる
+	rec.SampleIndex = r.next
+	r.trackDeviceTime(rec.DeviceTime)
+	if r.timeBase == "device" {
+		rec.Timestamp = float64(r.elapsed) / imuDeviceTickHz
+	} else {
+		rec.Timestamp = float64(r.next) / float64(r.header.SampleRate)
+	}
+	r.next++
+	r.stats.Records++
+	return rec, nil
+}
+
+// alignTo selects the video track that VideoTime and Frame refer to.
+// A negative index leaves them relative to the start of the movie.
+func (r *imuReader) alignTo(videoIndex int) error {
+	if videoIndex < 0 {
+		return nil
+	}
+	if videoIndex >= len(r.m.Tracks) {
+		return fmt.Errorf("video stream index %d out of range", videoIndex)
+	}
+	v := r.m.Tracks[videoIndex]
+	// Frame 0 is the media time selected by the first non-empty edit.
+	var first float64
+	for _, e := range v.Edits {
+		if e.MediaTime != -1 {
+			first = float64(e.MediaTime) / float64(v.Timescale)
+			break
+		}
+	}
+	r.videoStart = v.movieTime(first, r.m.Timescale)
+	r.frameDuration = v.frameDuration()
+	return nil
+}
+
+// anchor spreads the records of one packet evenly over the packet's
+// presentation interval and converts them to video-relative time.
+func (r *imuReader) anchor(p packet, t *mp4Track) {
+	n := len(r.pending)
+	for i := range r.pending {
+		media := p.PTS + p.Duration*float64(i)/float64(n)
+		vt := t.movieTime(media, r.m.Timescale) - r.videoStart
+		r.pending[i].VideoTime = vt
+		r.pending[i].Frame = -1
+		if r.frameDuration > 0 {
+			r.pending[i].Frame = int(math.Floor(vt/r.frameDuration + 1e-9))
+		}
+	}
+}
+
+// trackDeviceTime advances the unwrapped hardware clock and records gaps,
+// wraparounds and backward steps.
+func (r *imuReader) trackDeviceTime(tick uint32) {
+	if r.stats.Records == 0 {
+		r.lastTick = tick
+		return
+	}
+	nominal := float64(imuDeviceTickHz) / float64(r.header.SampleRate)
+	prev := r.lastTick
+	delta := tick - prev
+	r.lastTick = tick
+	if delta >= 1<<31 {
+		// A large unsigned delta means the counter went backwards; keep
+		// time monotonic by assuming one nominal period elapsed.
+		r.stats.Backsteps++
+		r.elapsed += uint64(nominal)
+		return
+	}
+	if tick < prev {
+		r.stats.Wraps++
+	}
+	r.elapsed += uint64(delta)
+	if float64(delta) > 1.5*nominal {
+		r.stats.Gaps++
+		if sec := float64(delta) / imuDeviceTickHz; sec > r.stats.MaxGap {
+			r.stats.MaxGap = sec
+		}
+	}
+}
+
+type IMURecord struct {
+	Timestamp                                        float64
+	SampleIndex                                      int
+	DeviceTime                                       uint32  // hardware timestamp
+	VideoTime                                        float64 // seconds since the first video frame
+	Frame                                            int     // index of the video frame shown at VideoTime
+	Ch0, Ch1, Ch2, Ch3, Ch4, Ch5, Ch6, Ch7, Ch8, Ch9 int16
+	GyroScale                                        float64 // deg/s per LSB
+	AccelScale                                       float64 // g per LSB
+}
+
+// imuHeader holds the decoded djmd header block (payload field 2). There
+// is no published description of the block; the layout below, all little
+// endian uint32, is an assumption and the meaning of every word is
+// unconfirmed:
+//
+//	[0:4]   sample rate in Hz
+//	[4:8]   gyroscope full scale in deg/s
+//	[8:12]  accelerometer full scale in g
+//	[12:16] sensor ID
+//	[16:20] axis orientation code
+//	[20:]   further words, not yet identified
+//
+// The ranges are only taken when they are a common sensor setting, and Raw
+// keeps the whole block so that it can be reinterpreted.
+type imuHeader struct {
+	SampleRate  float32  `json:"sample_rate_hz"`
+	GyroRange   float64  `json:"gyro_range_dps"`
+	AccelRange  float64  `json:"accel_range_g"`
+	SensorID    uint32   `json:"sensor_id"`
+	Orientation uint32   `json:"axis_orientation"`
+	Extra       []uint32 `json:"extra,omitempty"`
+	Raw         string   `json:"raw,omitempty"` // hex; empty when no header was seen
+}
+
+var defaultIMUHeader = imuHeader{SampleRate: 800, GyroRange: 2000, AccelRange: 16}
+
+var (
+	validGyroRanges  = map[uint32]bool{125: true, 250: true, 500: true, 1000: true, 2000: true, 4000: true}
+	validAccelRanges = map[uint32]bool{2: true, 4: true, 8: true, 16: true, 32: true}
+)
+
+// parseIMUHeader updates hdr from a header block. Ranges that are not a
+// known sensor setting keep their previous value.
+func parseIMUHeader(b []byte, hdr *imuHeader) {
+	if len(b) < 20 {
+		return
+	}
+	if rate := binary.LittleEndian.Uint32(b[0:4]); rate > 0 {
+		hdr.SampleRate = float32(rate)
+	}
+	if g := binary.LittleEndian.Uint32(b[4:8]); validGyroRanges[g] {
+		hdr.GyroRange = float64(g)
+	}
+	if a := binary.LittleEndian.Uint32(b[8:12]); validAccelRanges[a] {
+		hdr.AccelRange = float64(a)
+	}
+	hdr.SensorID = binary.LittleEndian.Uint32(b[12:16])
+	hdr.Orientation = binary.LittleEndian.Uint32(b[16:20])
+	hdr.Extra = nil
+	for i := 20; i+4 <= len(b); i += 4 {
+		hdr.Extra = append(hdr.Extra, binary.LittleEndian.Uint32(b[i:i+4]))
+	}
+	hdr.Raw = hex.EncodeToString(b)
+}
+
+// maxHeaderSearchPackets bounds how far readIMUHeader looks into a stream.
+const maxHeaderSearchPackets = 256
+
+// readIMUHeader returns the first header block of a djmd stream. The
+// boolean result is false when none was found and defaults are returned.
+func readIMUHeader(m *mp4File, streamIndex int) (imuHeader, bool, error) {
+	hdr := defaultIMUHeader
+	pr, err := newPacketReader(m, streamIndex)
+	if err != nil {
+		return hdr, false, err
+	}
+	for i := 0; i < maxHeaderSearchPackets; i++ {
+		p, err := pr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return hdr, false, err
+		}
+		decodeIMUData(p.Data, &hdr)
+		if hdr.Raw != "" {
+			return hdr, true, nil
+		}
+	}
+	return hdr, false, nil
+}
+
+// writeIMUHeaderJSON writes the header of each djmd stream to
+// <base>_djmd_<n>_header.json.
+func writeIMUHeaderJSON(input string, streamIndices []int, subdir, base string, log io.Writer, verbose bool, outs *outputSet) error {
+	m, err := openMP4(input)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	for i, idx := range streamIndices {
+		out := filepath.Join(subdir, base+"_djmd_"+strconv.Itoa(i)+"_header.json")
+		if write, err := outs.check(out, ""); err != nil {
+			return err
+		} else if !write {
+			continue
+		}
+		hdr, found, err := readIMUHeader(m, idx)
+		if err != nil {
+			return err
+		}
+		doc := struct {
+			Stream int       `json:"stream"`
+			Found  bool      `json:"found"`
+			Header imuHeader `json:"header"`
+		}{idx, found, hdr}
+		b, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return err
+		}
+		if verbose {
+			fmt.Fprintf(log, "Creating DJMD header file: %s\n", out)
+		}
+		if err := writeOutputFile(out, append(b, '\n')); err != nil {
+			return err
+		}
+		outs.done(out, "")
+	}
+	return nil
+}
+
+func decodeIMUData(b []byte, hdr *imuHeader) []IMURecord {
+	var records []IMURecord
+	fields, _ := protowire.Parse(b)
+	for _, f := range fields {
+		if f.Num == 3 && f.Wire == protowire.BytesType {
+			imuRecords := parseIMUPayload(f.Bytes, hdr)
+			records = append(records, imuRecords...)
+		}
+	}
+	return records
+}
+
+func parseIMUPayload(payload []byte, hdr *imuHeader) []IMURecord {
+	var records []IMURecord
+	fields, _ := protowire.Parse(payload)
+	for _, f := range fields {
+		if f.Wire != protowire.BytesType {
+			continue
+		}
+		switch f.Num {
+		case 2:
+			parseIMUHeader(f.Bytes, hdr)
+		case 3:
+			records = parseIMURecords(f.Bytes, *hdr)
+		}
+	}
+	return records
+}
+
+func parseIMURecords(imuData []byte, hdr imuHeader) []IMURecord {
+	var records []IMURecord
+	recordSize := 24
+
+	for i := 0; i+recordSize <= len(imuData); i += recordSize {
+		record := imuData[i : i+recordSize]
+
+		deviceTime := binary.LittleEndian.Uint32(record[0:4])
+		ch0 := int16(binary.LittleEndian.Uint16(record[4:6]))
+		ch1 := int16(binary.LittleEndian.Uint16(record[6:8]))
+		ch2 := int16(binary.LittleEndian.Uint16(record[8:10]))
+		ch3 := int16(binary.LittleEndian.Uint16(record[10:12]))
+		ch4 := int16(binary.LittleEndian.Uint16(record[12:14]))
+		ch5 := int16(binary.LittleEndian.Uint16(record[14:16]))
+		ch6 := int16(binary.LittleEndian.Uint16(record[16:18]))
+		ch7 := int16(binary.LittleEndian.Uint16(record[18:20]))
+		ch8 := int16(binary.LittleEndian.Uint16(record[20:22]))
+		ch9 := int16(binary.LittleEndian.Uint16(record[22:24]))
+
+		sampleIndex := len(records)
+		timeSec := float64(sampleIndex) / float64(hdr.SampleRate)
+
+		imuRecord := IMURecord{
+			Timestamp:   timeSec,
+			SampleIndex: sampleIndex,
+			DeviceTime:  deviceTime,
+			Ch0:         ch0,
+			Ch1:         ch1,
+			Ch2:         ch2,
+			Ch3:         ch3,
+			Ch4:         ch4,
+			Ch5:         ch5,
+			Ch6:         ch6,
+			Ch7:         ch7,
+			Ch8:         ch8,
+			Ch9:         ch9,
+			GyroScale:   hdr.GyroRange / 32768,
+			AccelScale:  hdr.AccelRange / 32768,
+		}
+
+		records = append(records, imuRecord)
+	}
+
+	return records
+}
+
+const standardGravity = 9.80665
+
+// imuUnits selects the physical units of decoded samples.
+type imuUnits struct {
+	Gyro  string // "rad" (rad/s) or "deg" (deg/s)
+	Accel string // "ms2" (m/s²) or "g"
+}
+
+func (u imuUnits) gyroLabel() string {
+	if u.Gyro == "deg" {
+		return "deg/s"
+	}
+	return "rad/s"
+}
+
+func (u imuUnits) accelLabel() string {
+	if u.Accel == "g" {
+		return "g"
+	}
+	return "m/s2"
+}
+
+// IMUSample is an IMURecord with the sensor channels converted to physical
+// units. Ch0-Ch2 are taken as the gyroscope X/Y/Z axes and Ch3-Ch5 as the
+// accelerometer X/Y/Z axes, scaled by the header full scale over 32768;
+// Ch6-Ch9 carry auxiliary values whose meaning is not known and are passed
+// through raw. The channel mapping and scaling are inferred, not
+// documented, which is why the raw channels stay available in the record
+// and in every CSV row.
+type IMUSample struct {
+	IMURecord
+	GyroX, GyroY, GyroZ    float64
+	AccelX, AccelY, AccelZ float64
+	Aux                    [4]int16
+}
+
+func (r IMURecord) Sample(u imuUnits) IMUSample {
+	g := r.GyroScale
+	if u.Gyro != "deg" {
+		g *= math.Pi / 180
+	}
+	a := r.AccelScale
+	if u.Accel != "g" {
+		a *= standardGravity
+	}
+	return IMUSample{
+		IMURecord: r,
+		GyroX:     float64(r.Ch0) * g,
+		GyroY:     float64(r.Ch1) * g,
+		GyroZ:     float64(r.Ch2) * g,
+		AccelX:    float64(r.Ch3) * a,
+		AccelY:    float64(r.Ch4) * a,
+		AccelZ:    float64(r.Ch5) * a,
+		Aux:       [4]int16{r.Ch6, r.Ch7, r.Ch8, r.Ch9},
+	}
+}
+
+// imuCheckRecords is the number of records checkIMUPlausible averages,
+// about 2.5 s at 400 Hz.
+const imuCheckRecords = 1024
+
+// checkIMUPlausible reads the first records of streams and fails unless
+// they decode to believable values: a mean accelerometer magnitude near
+// 1 g, which holds for a camera at rest or carried by hand, and a mean
+// rotation rate well inside the gyroscope full scale. The outputs built
+// on the inferred channel mapping and scaling call it first, so a layout
+// that differs from the assumed one fails them instead of producing
+// nonsense. The IMU CSV is not checked: its raw channels are what the
+// decoding is verified against.
+func checkIMUPlausible(m *mp4File, streams []int) error {
+	r := newIMUReader(m, streams)
+	units := imuUnits{Gyro: "deg", Accel: "g"}
+	var accel, gyro, fullScale float64
+	n := 0
+	for ; n < imuCheckRecords; n++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		s := rec.Sample(units)
+		accel += math.Sqrt(s.AccelX*s.AccelX + s.AccelY*s.AccelY + s.AccelZ*s.AccelZ)
+		gyro += math.Sqrt(s.GyroX*s.GyroX + s.GyroY*s.GyroY + s.GyroZ*s.GyroZ)
+		fullScale = rec.GyroScale * 32768
+	}
+	if n == 0 {
+		return fmt.Errorf("IMU data not found")
+	}
+	accel /= float64(n)
+	gyro /= float64(n)
+	if accel < 0.7 || accel > 1.3 {
+		return fmt.Errorf("implausible IMU data: mean acceleration %.2f g over the first %d records, expected about 1 g", accel, n)
+	}
+	if gyro > fullScale/2 {
+		return fmt.Errorf("implausible IMU data: mean rotation rate %.0f deg/s over the first %d records, full scale %.0f deg/s", gyro, n, fullScale)
+	}
+	return nil
+}
+
+// writeIMUCSV writes the records of r in physical units, followed by the
+// raw channel values.
+func writeIMUCSV(r *imuReader, out string, units imuUnits) error {
+	f, err := createOutput(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	gu, au := units.gyroLabel(), units.accelLabel()
+	header := fmt.Sprintf("Timestamp(s),SampleIndex,DeviceTime,VideoTime(s),Frame,"+
+		"GyroX(%[1]s),GyroY(%[1]s),GyroZ(%[1]s),AccelX(%[2]s),AccelY(%[2]s),AccelZ(%[2]s),Aux0,Aux1,Aux2,Aux3,"+
+		"Ch0,Ch1,Ch2,Ch3,Ch4,Ch5,Ch6,Ch7,Ch8,Ch9\n", gu, au)
+	if _, err := w.WriteString(header); err != nil {
+		return err
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		smp := record.Sample(units)
+		line := fmt.Sprintf("%.6f,%d,%d,%.6f,%d,%.6f,%.6f,%.6f,%.6f,%.6f,%.6f,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d\n",
+			smp.Timestamp,
+			smp.SampleIndex,
+			smp.DeviceTime,
+			smp.VideoTime,
+			smp.Frame,
+			smp.GyroX, smp.GyroY, smp.GyroZ,
+			smp.AccelX, smp.AccelY, smp.AccelZ,
+			smp.Aux[0], smp.Aux[1], smp.Aux[2], smp.Aux[3],
+			record.Ch0, record.Ch1, record.Ch2, record.Ch3, record.Ch4,
+			record.Ch5, record.Ch6, record.Ch7, record.Ch8, record.Ch9)
+
+		if _, err := w.WriteString(line); err != nil {
+			return err
+		}
+	}
+
+	if r.stats.Records == 0 {
+		return fmt.Errorf("IMU data not found")
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Commit()
+}
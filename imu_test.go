@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/hex"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readHexFixture reads a testdata file of hex bytes with # comments.
+func readHexFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	src, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digits strings.Builder
+	for _, line := range strings.Split(string(src), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		digits.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+	b, err := hex.DecodeString(digits.String())
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return b
+}
+
+// testPacketTrack returns a djmd track holding packet as its only sample,
+// lasting duration ms.
+func testPacketTrack(packet []byte, duration uint32) *testTrack {
+	return &testTrack{
+		handler:  "meta",
+		entry:    makeBox("djmd", make([]byte, 8)),
+		mdhd:     makeFullBox("mdhd", 0, 0, u32s(0, 0, 1000, duration), []byte{0x55, 0xc4, 0, 0}),
+		stts:     []sttsEntry{{1, duration}},
+		sizes:    []uint32{uint32(len(packet))},
+		perChunk: 1,
+		samples:  [][]byte{packet},
+	}
+}
+
+var testIMUHeader = imuHeader{
+	SampleRate:  400,
+	GyroRange:   1000,
+	AccelRange:  8,
+	SensorID:    106,
+	Orientation: 3,
+	Extra:       []uint32{1, 0},
+	Raw:         "90010000e8030000080000006a000000030000000100000000000000",
+}
+
+func TestDecodeIMUHeader(t *testing.T) {
+	hdr := defaultIMUHeader
+	decodeIMUData(readHexFixture(t, "djmd_packet.hex"), &hdr)
+	if !reflect.DeepEqual(hdr, testIMUHeader) {
+		t.Errorf("header = %+v\nwant %+v", hdr, testIMUHeader)
+	}
+}
+
+func TestReadIMUHeader(t *testing.T) {
+	packet := readHexFixture(t, "djmd_packet.hex")
+	path := filepath.Join(t.TempDir(), "djmd.mp4")
+	writeTestMP4(t, path, []*testTrack{testPacketTrack(packet, 10)})
+	m, err := openMP4(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	hdr, found, err := readIMUHeader(m, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !reflect.DeepEqual(hdr, testIMUHeader) {
+		t.Errorf("readIMUHeader = %+v, %v\nwant %+v", hdr, found, testIMUHeader)
+	}
+}
+
+func TestParseIMUHeaderUnknownRanges(t *testing.T) {
+	// Ranges that are no known sensor setting keep the previous value.
+	b, _ := hex.DecodeString("2003000007000000030000000000000000000000")
+	hdr := defaultIMUHeader
+	parseIMUHeader(b, &hdr)
+	if hdr.SampleRate != 800 || hdr.GyroRange != 2000 || hdr.AccelRange != 16 {
+		t.Errorf("header = %+v", hdr)
+	}
+	hdr = defaultIMUHeader
+	parseIMUHeader(b[:16], &hdr)
+	if hdr.Raw != "" {
+		t.Errorf("short block was decoded: %+v", hdr)
+	}
+}
+
+func TestDecodeIMUSamples(t *testing.T) {
+	hdr := defaultIMUHeader
+	recs := decodeIMUData(readHexFixture(t, "djmd_packet.hex"), &hdr)
+	if len(recs) != 2 {
+		t.Fatalf("decoded %d records, want 2", len(recs))
+	}
+	if recs[0].DeviceTime != 1000000 || recs[1].DeviceTime != 1002500 {
+		t.Errorf("device times %d, %d", recs[0].DeviceTime, recs[1].DeviceTime)
+	}
+	raw := [10]int16{recs[0].Ch0, recs[0].Ch1, recs[0].Ch2, recs[0].Ch3, recs[0].Ch4,
+		recs[0].Ch5, recs[0].Ch6, recs[0].Ch7, recs[0].Ch8, recs[0].Ch9}
+	if raw != [10]int16{100, -100, 0, 4096, -4096, 32767, 1, 2, 3, -1} {
+		t.Errorf("channels = %v", raw)
+	}
+
+	// 1000 deg/s and 8 g full scale over 32768 counts.
+	tests := []struct {
+		gyro, accel [3]float64
+	}{
+		{[3]float64{3.0517578125, -3.0517578125, 0}, [3]float64{1, -1, 7.999755859375}},
+		{[3]float64{-1000, 999.969482421875, 0.030517578125}, [3]float64{0, 0, -1}},
+	}
+	near := func(a, b [3]float64, scale float64) bool {
+		for i := range a {
+			if math.Abs(a[i]-b[i]*scale) > 1e-9 {
+				return false
+			}
+		}
+		return true
+	}
+	for i, tt := range tests {
+		for _, u := range []struct {
+			units       imuUnits
+			gyro, accel float64
+		}{
+			{imuUnits{Gyro: "deg", Accel: "g"}, 1, 1},
+			{imuUnits{Gyro: "rad", Accel: "ms2"}, math.Pi / 180, standardGravity},
+		} {
+			s := recs[i].Sample(u.units)
+			gyro := [3]float64{s.GyroX, s.GyroY, s.GyroZ}
+			accel := [3]float64{s.AccelX, s.AccelY, s.AccelZ}
+			if !near(gyro, tt.gyro, u.gyro) || !near(accel, tt.accel, u.accel) {
+				t.Errorf("record %d in %s, %s: gyro %v, accel %v", i, u.units.gyroLabel(), u.units.accelLabel(), gyro, accel)
+			}
+		}
+	}
+	if s := recs[0].Sample(imuUnits{}); s.Aux != [4]int16{1, 2, 3, -1} {
+		t.Errorf("aux = %v", s.Aux)
+	}
+}
+
+func TestWriteIMUCSV(t *testing.T) {
+	packet := readHexFixture(t, "djmd_packet.hex")
+	dir := t.TempDir()
+	path := filepath.Join(dir, "djmd.mp4")
+	writeTestMP4(t, path, []*testTrack{testPacketTrack(packet, 5)})
+	// The fixture's values are far from a camera at rest; the CSV is
+	// written anyway, raw channels included.
+	out := filepath.Join(dir, "imu.csv")
+	if _, err := decodeDataTrackToCSVCombined(path, []int{0}, -1, out, "sample", imuUnits{Gyro: "deg", Accel: "g"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	want := []string{
+		"Timestamp(s),SampleIndex,DeviceTime,VideoTime(s),Frame,GyroX(deg/s),GyroY(deg/s),GyroZ(deg/s),AccelX(g),AccelY(g),AccelZ(g),Aux0,Aux1,Aux2,Aux3,Ch0,Ch1,Ch2,Ch3,Ch4,Ch5,Ch6,Ch7,Ch8,Ch9",
+		"0.000000,0,1000000,0.000000,-1,3.051758,-3.051758,0.000000,1.000000,-1.000000,7.999756,1,2,3,-1,100,-100,0,4096,-4096,32767,1,2,3,-1",
+		"0.002500,1,1002500,0.002500,-1,-1000.000000,999.969482,0.030518,0.000000,0.000000,-1.000000,0,0,0,0,-32768,32767,1,0,0,-4096,0,0,0,0",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("CSV:\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCheckIMUPlausible(t *testing.T) {
+	// 80 records at 400 Hz with 2000 deg/s and 8 g full scale, all alike.
+	steady := func(c [10]int16) *testTrack {
+		chans := make([][10]int16, 80)
+		for i := range chans {
+			chans[i] = c
+		}
+		return testPacketTrack(testIMUPacket(400, 2000, 8, 0, chans), 200)
+	}
+	for _, tt := range []struct {
+		name string
+		imu  *testTrack
+		want string
+	}{
+		{"still", steady([10]int16{5: 4096}), ""},
+		{"turning", steady([10]int16{0: 8192, 4: -1024, 5: 4096}), ""},
+		// 1 g read with a 16 g full scale taken for 8 g.
+		{"wrong scale", steady([10]int16{5: 8192}), "mean acceleration 2.00 g"},
+		{"no gravity", steady([10]int16{}), "mean acceleration 0.00 g"},
+		{"saturated gyroscope", steady([10]int16{0: 30000, 5: 4096}), "mean rotation rate 1831 deg/s"},
+		{"fixture", testPacketTrack(readHexFixture(t, "djmd_packet.hex"), 5), "mean acceleration"},
+	} {
+		path := filepath.Join(t.TempDir(), "in.mp4")
+		writeTestMP4(t, path, []*testTrack{tt.imu})
+		m, err := openMP4(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkIMUPlausible(m, []int{0})
+		m.Close()
+		if (err == nil) != (tt.want == "") || (err != nil && !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Package protowire walks the Protocol Buffers wire format without a
+// schema. Fields are returned in the order they appear; length-delimited
+// payloads can be classified heuristically when their type is unknown.
+package protowire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Wire types.
+const (
+	VarintType  = 0
+	Fixed64Type = 1
+	BytesType   = 2
+	Fixed32Type = 5
+)
+
+// ReadVarint decodes the varint at b[i:] and returns its value and length,
+// or a length of 0 if it is truncated or longer than 64 bits.
+func ReadVarint(b []byte, i int) (uint64, int) {
+	var v uint64
+	var shift uint
+	start := i
+	for i < len(b) {
+		c := b[i]
+		v |= uint64(c&0x7F) << shift
+		i++
+		if c < 0x80 {
+			return v, i - start
+		}
+		shift += 7
+		if shift > 63 {
+			break
+		}
+	}
+	return 0, 0
+}
+
+// Field is one field of a message.
+type Field struct {
+	Num   int
+	Wire  int
+	Value uint64 // varint, fixed32 and fixed64 values
+	Bytes []byte // length-delimited payload
+}
+
+// Parse splits b into its fields. On error the fields before the bad one
+// are returned with it.
+func Parse(b []byte) ([]Field, error) {
+	var fields []Field
+	i := 0
+	for i < len(b) {
+		key, n := ReadVarint(b, i)
+		if n == 0 {
+			return fields, fmt.Errorf("invalid field key at offset %d", i)
+		}
+		i += n
+		f := Field{Num: int(key >> 3), Wire: int(key & 0x7)}
+		switch f.Wire {
+		case VarintType:
+			v, m := ReadVarint(b, i)
+			if m == 0 {
+				return fields, fmt.Errorf("invalid varint at offset %d", i)
+			}
+			f.Value = v
+			i += m
+		case Fixed64Type:
+			if i+8 > len(b) {
+				return fields, fmt.Errorf("truncated fixed64 at offset %d", i)
+			}
+			f.Value = binary.LittleEndian.Uint64(b[i:])
+			i += 8
+		case BytesType:
+			l, m := ReadVarint(b, i)
+			if m == 0 || l > uint64(len(b)-i-m) {
+				return fields, fmt.Errorf("invalid length at offset %d", i)
+			}
+			i += m
+			f.Bytes = b[i : i+int(l)]
+			i += int(l)
+		case Fixed32Type:
+			if i+4 > len(b) {
+				return fields, fmt.Errorf("truncated fixed32 at offset %d", i)
+			}
+			f.Value = uint64(binary.LittleEndian.Uint32(b[i:]))
+			i += 4
+		default:
+			return fields, fmt.Errorf("unsupported wire type %d at offset %d", f.Wire, i)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// Floats returns the float values carried by a float or double field,
+// accepting both single values and packed arrays.
+func (f Field) Floats() []float64 {
+	switch f.Wire {
+	case Fixed32Type:
+		return []float64{float64(math.Float32frombits(uint32(f.Value)))}
+	case Fixed64Type:
+		return []float64{math.Float64frombits(f.Value)}
+	case BytesType:
+		if len(f.Bytes)%4 != 0 {
+			return nil
+		}
+		out := make([]float64, 0, len(f.Bytes)/4)
+		for i := 0; i < len(f.Bytes); i += 4 {
+			out = append(out, float64(math.Float32frombits(binary.LittleEndian.Uint32(f.Bytes[i:]))))
+		}
+		return out
+	}
+	return nil
+}
+
+// Heuristic interpretation of length-delimited fields, used when no schema
+// is available.
+const (
+	KindMessage = "message"
+	KindString  = "string"
+	KindFloats  = "packed fixed32"
+	KindVarints = "packed varint"
+	KindBytes   = "bytes"
+)
+
+// GuessKind returns the most likely kind of the length-delimited payload b.
+func GuessKind(b []byte) string {
+	if len(b) == 0 {
+		return KindBytes
+	}
+	if IsPrintable(b) {
+		return KindString
+	}
+	if fields, err := Parse(b); err == nil && len(fields) > 0 && plausibleFields(fields) {
+		return KindMessage
+	}
+	if len(b)%4 == 0 && len(b) >= 8 {
+		return KindFloats
+	}
+	if _, ok := PackedVarints(b); ok && len(b) >= 2 {
+		return KindVarints
+	}
+	return KindBytes
+}
+
+// IsPrintable reports whether b is text: printable ASCII and whitespace.
+func IsPrintable(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 && c != '\n' && c != '\r' && c != '\t' || c >= 0x7F {
+			return false
+		}
+	}
+	return true
+}
+
+// plausibleFields rejects parses that technically succeed on random data:
+// field numbers must be small and groups are never used.
+func plausibleFields(fields []Field) bool {
+	for _, f := range fields {
+		if f.Num <= 0 || f.Num > 1<<16 {
+			return false
+		}
+	}
+	return true
+}
+
+// PackedVarints decodes b as a packed repeated varint field.
+func PackedVarints(b []byte) ([]uint64, bool) {
+	var out []uint64
+	for i := 0; i < len(b); {
+		v, n := ReadVarint(b, i)
+		if n == 0 {
+			return nil, false
+		}
+		out = append(out, v)
+		i += n
+	}
+	return out, true
+}
+
+// Zigzag decodes a sint32/sint64 value.
+func Zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
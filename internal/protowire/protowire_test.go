@@ -0,0 +1,149 @@
+package protowire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Wire format encoders for building test messages.
+
+func pbKey(num, wire int) []byte {
+	return binary.AppendUvarint(nil, uint64(num)<<3|uint64(wire))
+}
+
+func pbUint(num int, v uint64) []byte {
+	return binary.AppendUvarint(pbKey(num, VarintType), v)
+}
+
+func pbFixed32(num int, v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(pbKey(num, Fixed32Type), v)
+}
+
+func pbFixed64(num int, v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(pbKey(num, Fixed64Type), v)
+}
+
+func pbString(num int, s string) []byte {
+	b := binary.AppendUvarint(pbKey(num, BytesType), uint64(len(s)))
+	return append(b, s...)
+}
+
+func pbCat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestReadVarint(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		v    uint64
+		n    int
+		desc string
+	}{
+		{[]byte{0}, 0, 1, "zero"},
+		{[]byte{0x96, 0x01}, 150, 2, "two bytes"},
+		{binary.AppendUvarint(nil, math.MaxUint64), math.MaxUint64, 10, "max"},
+		{[]byte{0x80}, 0, 0, "truncated"},
+		{bytes.Repeat([]byte{0x80}, 11), 0, 0, "too long"},
+	}
+	for _, tt := range tests {
+		if v, n := ReadVarint(tt.in, 0); v != tt.v || n != tt.n {
+			t.Errorf("%s: ReadVarint = %d, %d; want %d, %d", tt.desc, v, n, tt.v, tt.n)
+		}
+	}
+	if v, n := ReadVarint([]byte{0xff, 0x96, 0x01}, 1); v != 150 || n != 2 {
+		t.Errorf("ReadVarint at offset 1 = %d, %d", v, n)
+	}
+}
+
+func TestParse(t *testing.T) {
+	in := pbCat(pbUint(1, 150), pbFixed64(2, 1<<40), pbString(3, "abc"), pbFixed32(4, 7), pbUint(1<<20, 1))
+	want := []Field{
+		{Num: 1, Wire: VarintType, Value: 150},
+		{Num: 2, Wire: Fixed64Type, Value: 1 << 40},
+		{Num: 3, Wire: BytesType, Bytes: []byte("abc")},
+		{Num: 4, Wire: Fixed32Type, Value: 7},
+		{Num: 1 << 20, Wire: VarintType, Value: 1},
+	}
+	got, err := Parse(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want string
+	}{
+		{[]byte{0x80}, "invalid field key"},
+		{pbKey(1, VarintType), "invalid varint"},
+		{pbCat(pbKey(1, Fixed64Type), make([]byte, 7)), "truncated fixed64"},
+		{pbCat(pbKey(1, Fixed32Type), make([]byte, 3)), "truncated fixed32"},
+		{pbCat(pbKey(1, BytesType), []byte{5, 'a'}), "invalid length"},
+		{pbCat(pbKey(1, BytesType), binary.AppendUvarint(nil, math.MaxUint64)), "invalid length"},
+		{pbKey(1, 3), "unsupported wire type 3"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.in)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(% x): error %v, want %q", tt.in, err, tt.want)
+		}
+	}
+	// The fields before the error are still returned.
+	if fields, err := Parse(pbCat(pbUint(1, 2), []byte{0x80})); err == nil || len(fields) != 1 {
+		t.Errorf("Parse kept %d fields, error %v", len(fields), err)
+	}
+}
+
+func TestFieldFloats(t *testing.T) {
+	packed := binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, math.Float32bits(1.5)), math.Float32bits(-3))
+	tests := []struct {
+		f    Field
+		want []float64
+	}{
+		{Field{Wire: Fixed32Type, Value: uint64(math.Float32bits(0.25))}, []float64{0.25}},
+		{Field{Wire: Fixed64Type, Value: math.Float64bits(-2.5)}, []float64{-2.5}},
+		{Field{Wire: BytesType, Bytes: packed}, []float64{1.5, -3}},
+		{Field{Wire: BytesType, Bytes: packed[:5]}, nil},
+		{Field{Wire: VarintType, Value: 1}, nil},
+	}
+	for _, tt := range tests {
+		if got := tt.f.Floats(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Floats(%+v) = %v, want %v", tt.f, got, tt.want)
+		}
+	}
+}
+
+func TestGuessBytesKind(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want string
+	}{
+		{nil, KindBytes},
+		{[]byte("DJI Osmo 360"), KindString},
+		{pbCat(pbUint(1, 3), pbFixed32(2, 9)), KindMessage},
+		{binary.LittleEndian.AppendUint64(nil, math.Float64bits(math.Pi)), KindFloats},
+		{[]byte{0xff, 0x01, 0x20}, KindVarints},
+		{[]byte{0x07, 0xff}, KindBytes},
+	}
+	for _, tt := range tests {
+		if got := GuessKind(tt.in); got != tt.want {
+			t.Errorf("GuessKind(% x) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestZigzag(t *testing.T) {
+	for in, want := range map[uint64]int64{0: 0, 1: -1, 2: 1, 3: -2, math.MaxUint64: math.MinInt64, math.MaxUint64 - 1: math.MaxInt64} {
+		if got := Zigzag(in); got != want {
+			t.Errorf("Zigzag(%d) = %d, want %d", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Horizon leveling for stitched equirectangular output. The fused IMU
+// orientation gives the earth's vertical for every video frame; a second
+// v360 pass (e to e) turns each frame so that this vertical points straight
+// down the image while the view keeps the camera's heading. The per-frame
+// yaw/pitch/roll reach v360 as sendcmd commands, which are only emitted
+// when an angle changes by levelThreshold or more, since v360 rebuilds its
+// tables on every command.
+
+const levelThreshold = 0.05 // degrees
+
+// levelMatrix returns the rotation from the leveled view to the camera
+// frame (X right, Y down, Z forward), given the earth's up direction in the
+// camera frame.
+func levelMatrix(up [3]float64) [9]float64 {
+	y, ok := unit3([3]float64{-up[0], -up[1], -up[2]})
+	if !ok {
+		return [9]float64{1, 0, 0, 0, 1, 0, 0, 0, 1}
+	}
+	var x, z [3]float64
+	// Forward is the camera's optical axis made horizontal; when the camera
+	// looks straight up or down, build the view from its X axis instead.
+	fwd := [3]float64{0, 0, 1}
+	d := dot3(fwd, y)
+	if z, ok = unit3([3]float64{fwd[0] - d*y[0], fwd[1] - d*y[1], fwd[2] - d*y[2]}); ok && math.Abs(d) < 0.999 {
+		x = cross3(y, z)
+	} else {
+		right := [3]float64{1, 0, 0}
+		d = dot3(right, y)
+		x, _ = unit3([3]float64{right[0] - d*y[0], right[1] - d*y[1], right[2] - d*y[2]})
+		z = cross3(x, y)
+	}
+	// The view axes are the columns.
+	return [9]float64{x[0], y[0], z[0], x[1], y[1], z[1], x[2], y[2], z[2]}
+}
+
+// eulerYPR decomposes m = Ry(yaw)·Rx(pitch)·Rz(roll), the rotation order of
+// stitchRotation and of v360's default rorder, into degrees.
+func eulerYPR(m [9]float64) (yaw, pitch, roll float64) {
+	deg := 180 / math.Pi
+	pitch = math.Asin(math.Max(-1, math.Min(1, -m[5]))) * deg
+	yaw = math.Atan2(m[2], m[8]) * deg
+	roll = math.Atan2(m[3], m[4]) * deg
+	return yaw, pitch, roll
+}
+
+// angleDiff returns the difference of two angles in degrees, wrapped to
+// ±180.
+func angleDiff(a, b float64) float64 {
+	return math.Remainder(a-b, 360)
+}
+
+// writeLevelCommands fuses the djmd IMU data of input and writes the
+// sendcmd file that levels each frame of the front lens video. The view
+// rotation of opts is applied on top. It returns the angles of the first
+// frame.
+func writeLevelCommands(input string, st osvStreams, opts *stitchOptions, out string) ([3]float64, error) {
+	var first [3]float64
+	if len(st.DJMD) == 0 {
+		return first, fmt.Errorf("no djmd streams found; leveling needs the IMU data")
+	}
+	f, err := newFusionFilter(opts.Fusion, opts.FusionGain)
+	if err != nil {
+		return first, err
+	}
+	m, err := openMP4(input)
+	if err != nil {
+		return first, err
+	}
+	defer m.Close()
+	if err := checkIMUPlausible(m, st.DJMD); err != nil {
+		return first, err
+	}
+	r := newIMUReader(m, st.DJMD)
+	if err := r.alignTo(st.Video[0]); err != nil {
+		return first, err
+	}
+
+	file, err := createOutput(out)
+	if err != nil {
+		return first, err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+
+	view := stitchRotation(opts.Yaw, opts.Pitch, opts.Roll)
+	var last [3]float64
+	lastFrame, sent := -1, 0
+	err = fuseIMU(r, f, func(rec IMURecord, q quat) error {
+		if rec.VideoTime < 0 || rec.Frame <= lastFrame {
+			return nil
+		}
+		lastFrame = rec.Frame
+		yaw, pitch, roll := eulerYPR(mulMat3(levelMatrix(imuToCamera(q.up())), view))
+		a := [3]float64{yaw, pitch, roll}
+		if sent > 0 {
+			changed := false
+			for i := range a {
+				if math.Abs(angleDiff(a[i], last[i])) >= levelThreshold {
+					changed = true
+				}
+			}
+			if !changed {
+				return nil
+			}
+		} else {
+			first = a
+		}
+		last = a
+		sent++
+		_, err := fmt.Fprintf(w, "%.6f v360@level yaw %.3f, v360@level pitch %.3f, v360@level roll %.3f;\n",
+			float64(rec.Frame)*r.frameDuration, yaw, pitch, roll)
+		return err
+	})
+	if err == nil && sent == 0 {
+		err = fmt.Errorf("no IMU data within the video")
+	}
+	if err != nil {
+		return first, err
+	}
+	if opts.Verbose {
+		fmt.Printf("Leveling: %d rotation updates over %d frames\n", sent, lastFrame+1)
+	}
+	if err := w.Flush(); err != nil {
+		return first, err
+	}
+	return first, file.Commit()
+}
+
+// levelFilter returns the filter chain appended to the stitched video to
+// apply the commands in cmdFile, starting from the first frame's angles.
+func levelFilter(cmdFile string, first [3]float64) (string, error) {
+	if strings.Contains(cmdFile, "'") {
+		return "", fmt.Errorf("unsupported character in path: %s", cmdFile)
+	}
+	// Quoted for the filtergraph, with option-level escapes inside.
+	path := strings.NewReplacer(`\`, `\\`, `:`, `\:`).Replace(cmdFile)
+	return fmt.Sprintf(",sendcmd=f='%s',v360@level=input=e:output=e:yaw=%.3f:pitch=%.3f:roll=%.3f",
+		path, first[0], first[1], first[2]), nil
+}
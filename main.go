@@ -1,18 +1,21 @@
 package main
 
 import (
-	"bufio"
-	"encoding/binary"
-	"encoding/hex"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 func main() {
@@ -33,18 +36,26 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
+	// Only the commands that write outputs watch for interrupts; the
+	// others keep the default handler and stop on the first Ctrl-C.
 	case "extract", "e":
-		cmdExtractWithFlags()
+		cmdExtractWithFlags(interruptContext())
+	case "stitch", "s":
+		cmdStitchWithFlags(interruptContext())
+	case "inject", "j":
+		cmdInjectWithFlags(interruptContext())
+	case "protodump", "pd":
+		cmdProtodumpWithFlags()
 	case "help", "h", "--help", "-h":
 		usage()
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
-		fmt.Fprintln(os.Stderr, "Available commands: inspect, extract, help")
+		fmt.Fprintln(os.Stderr, "Available commands: inspect, extract, stitch, inject, protodump, help")
 		os.Exit(2)
 	}
 }
 
-func cmdExtractWithFlags() {
+func cmdExtractWithFlags(ctx context.Context) {
 	fs := flag.NewFlagSet("extract", flag.ExitOnError)
 
 	outputDir := fs.String("o", "", "Output directory (default: same as input file)")
@@ -54,18 +65,50 @@ func cmdExtractWithFlags() {
 	metaModeLong := fs.String("meta", "decode", "Metadata processing mode: raw|decode|both")
 
 	movMode := fs.Bool("mov", true, "Burn audio to MOV file")
+	keepMode := fs.Bool("k", false, "Keep djmd/dbgi data tracks and the thumbnail in the MOV files")
+	keepModeLong := fs.Bool("keep-data", false, "Keep djmd/dbgi data tracks and the thumbnail in the MOV files")
+	cammMode := fs.Bool("camm", false, "Embed IMU data as a CAMM motion track in the MOV files")
+	gpmfMode := fs.String("gpmf", "", "GoPro GPMF telemetry output: bin|mov|both")
 	separateMode := fs.Bool("s", false, "Separate files")
 	separateModeLong := fs.Bool("separate", false, "Separate files")
 
 	csvMode := fs.Bool("c", false, "Output IMU data in CSV format")
 	csvModeLong := fs.Bool("csv", false, "Output IMU data in CSV format")
 
+	gcsvMode := fs.Bool("g", false, "Output Gyroflow .gcsv logs per lens")
+	gcsvModeLong := fs.Bool("gcsv", false, "Output Gyroflow .gcsv logs per lens")
+
+	orientMode := fs.String("orient", "", "Output fused orientation: csv|json")
+	orientRate := fs.String("orient-rate", "frame", "Orientation rows: frame|sample")
+	fusion := fs.String("fusion", "madgwick", "Fusion filter for -orient: madgwick|complementary")
+	fusionGainFlag := fs.Float64("fusion-gain", 0, "Fusion filter gain (default: 0.05 madgwick, 0.5 complementary)")
+
+	lensMode := fs.Bool("l", false, "Output lens calibration from dbgi as JSON")
+	lensModeLong := fs.Bool("lens", false, "Output lens calibration from dbgi as JSON")
+	experimentalLens := fs.Bool("experimental-lens", false, "Allow -l to decode the unconfirmed dbgi calibration layout")
+
 	forceMode := fs.Bool("f", false, "Overwrite existing files")
 	forceModeLong := fs.Bool("force", false, "Overwrite existing files")
 
+	updateMode := fs.Bool("u", false, "Skip outputs that are up to date; write missing or stale ones")
+	updateModeLong := fs.Bool("update", false, "Skip outputs that are up to date; write missing or stale ones")
+
 	verboseMode := fs.Bool("v", false, "Show detailed output")
 	verboseModeLong := fs.Bool("verbose", false, "Show detailed output")
 
+	jobs := fs.Int("j", 1, "Number of files processed in parallel (directory input)")
+	jobsLong := fs.Int("jobs", 1, "Number of files processed in parallel (directory input)")
+
+	timeBase := fs.String("t", "", "IMU time base: sample|device")
+	timeBaseLong := fs.String("timebase", "", "IMU time base: sample|device")
+
+	gyroUnit := fs.String("gyro-unit", "rad", "Gyroscope unit: rad|deg")
+	accelUnit := fs.String("accel-unit", "ms2", "Accelerometer unit: ms2|g")
+
+	protoFile := fs.String("proto", "", "Schema for djmd/dbgi: .proto file or FileDescriptorSet")
+	djmdMsg := fs.String("djmd-msg", "", "Message type of djmd packets in the -proto schema")
+	dbgiMsg := fs.String("dbgi-msg", "", "Message type of dbgi packets in the -proto schema")
+
 	fs.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: osv2mov extract [options] <input.osv> or <input_directory>\n")
 		fmt.Fprintf(os.Stderr, "   or: osv2mov e [options] <input.osv> or <input_directory>\n\n")
@@ -76,14 +119,50 @@ func cmdExtractWithFlags() {
 		fmt.Fprintf(os.Stderr, "         Metadata processing mode: raw|decode|both (default: decode)\n")
 		fmt.Fprintf(os.Stderr, "  -mov\n")
 		fmt.Fprintf(os.Stderr, "         Burn audio to MOV file (default: enabled)\n")
+		fmt.Fprintf(os.Stderr, "  -k, -keep-data\n")
+		fmt.Fprintf(os.Stderr, "         Keep djmd/dbgi data tracks and the thumbnail in the MOV files\n")
+		fmt.Fprintf(os.Stderr, "  -camm\n")
+		fmt.Fprintf(os.Stderr, "         Embed IMU data as a CAMM motion track in the MOV files\n")
+		fmt.Fprintf(os.Stderr, "  -gpmf string\n")
+		fmt.Fprintf(os.Stderr, "         GoPro GPMF telemetry: bin (<name>_gpmf.bin) | mov (gpmd track) | both\n")
 		fmt.Fprintf(os.Stderr, "  -s, -separate\n")
 		fmt.Fprintf(os.Stderr, "         Separate files\n")
 		fmt.Fprintf(os.Stderr, "  -c, -csv\n")
 		fmt.Fprintf(os.Stderr, "         Output IMU data in CSV format\n")
+		fmt.Fprintf(os.Stderr, "  -g, -gcsv\n")
+		fmt.Fprintf(os.Stderr, "         Output Gyroflow .gcsv logs per lens\n")
+		fmt.Fprintf(os.Stderr, "  -orient string\n")
+		fmt.Fprintf(os.Stderr, "         Output fused orientation (quaternion and Euler angles): csv | json\n")
+		fmt.Fprintf(os.Stderr, "  -orient-rate string\n")
+		fmt.Fprintf(os.Stderr, "         Orientation rows: frame (one per video frame) | sample (default: frame)\n")
+		fmt.Fprintf(os.Stderr, "  -fusion string\n")
+		fmt.Fprintf(os.Stderr, "         Fusion filter: madgwick | complementary (default: madgwick)\n")
+		fmt.Fprintf(os.Stderr, "  -fusion-gain float\n")
+		fmt.Fprintf(os.Stderr, "         Fusion filter gain (default: 0.05 for madgwick, 0.5 for complementary)\n")
+		fmt.Fprintf(os.Stderr, "  -l, -lens\n")
+		fmt.Fprintf(os.Stderr, "         Output lens calibration from dbgi as JSON (requires -experimental-lens)\n")
+		fmt.Fprintf(os.Stderr, "  -experimental-lens\n")
+		fmt.Fprintf(os.Stderr, "         Allow -l to decode the dbgi calibration, whose layout is unconfirmed\n")
+		fmt.Fprintf(os.Stderr, "  -t, -timebase string\n")
+		fmt.Fprintf(os.Stderr, "         IMU time base: sample|device (default: sample)\n")
+		fmt.Fprintf(os.Stderr, "  -gyro-unit string\n")
+		fmt.Fprintf(os.Stderr, "         Gyroscope unit in CSV: rad (rad/s) | deg (deg/s) (default: rad)\n")
+		fmt.Fprintf(os.Stderr, "  -accel-unit string\n")
+		fmt.Fprintf(os.Stderr, "         Accelerometer unit in CSV: ms2 (m/s²) | g (default: ms2)\n")
+		fmt.Fprintf(os.Stderr, "  -proto string\n")
+		fmt.Fprintf(os.Stderr, "         Schema for djmd/dbgi: .proto file or FileDescriptorSet\n")
+		fmt.Fprintf(os.Stderr, "  -djmd-msg string\n")
+		fmt.Fprintf(os.Stderr, "         Message type of djmd packets; writes <name>_djmd.jsonl\n")
+		fmt.Fprintf(os.Stderr, "  -dbgi-msg string\n")
+		fmt.Fprintf(os.Stderr, "         Message type of dbgi packets; writes <name>_dbgi.jsonl\n")
 		fmt.Fprintf(os.Stderr, "  -f, -force\n")
 		fmt.Fprintf(os.Stderr, "         Overwrite existing files\n")
+		fmt.Fprintf(os.Stderr, "  -u, -update\n")
+		fmt.Fprintf(os.Stderr, "         Skip outputs that are up to date and write only missing or stale ones\n")
 		fmt.Fprintf(os.Stderr, "  -v, -verbose\n")
 		fmt.Fprintf(os.Stderr, "         Show detailed output\n")
+		fmt.Fprintf(os.Stderr, "  -j, -jobs int\n")
+		fmt.Fprintf(os.Stderr, "         Number of files processed in parallel for directory input (default: 1)\n")
 		fmt.Fprintf(os.Stderr, "  -h, -help\n")
 		fmt.Fprintf(os.Stderr, "         Show this help\n\n")
 		fmt.Fprintf(os.Stderr, "Examples:\n")
@@ -91,6 +170,10 @@ func cmdExtractWithFlags() {
 		fmt.Fprintf(os.Stderr, "  osv2mov extract -o output_dir input.osv\n")
 		fmt.Fprintf(os.Stderr, "  osv2mov e -s -c input_directory\n")
 		fmt.Fprintf(os.Stderr, "  osv2mov extract --separate --csv input_directory\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov extract -j 4 -o output_dir input_directory\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov extract -u -c -o output_dir input_directory\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov extract -proto osmo.proto -djmd-msg FrameMeta input.osv\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov extract -orient json -fusion complementary input.osv\n")
 	}
 
 	if err := fs.Parse(os.Args[2:]); err != nil {
@@ -124,44 +207,184 @@ func cmdExtractWithFlags() {
 		meta = *metaModeLong
 	}
 
-	separate := *separateMode || *separateModeLong
-	csv := *csvMode || *csvModeLong
-	force := *forceMode || *forceModeLong
-	verbose := *verboseMode || *verboseModeLong
+	tb := *timeBase
+	if tb == "" {
+		tb = *timeBaseLong
+	}
+	if tb == "" {
+		tb = "sample"
+	}
+	if tb != "sample" && tb != "device" {
+		fmt.Fprintf(os.Stderr, "Error: invalid time base: %s (expected sample or device)\n", tb)
+		os.Exit(2)
+	}
 
-	if verbose {
+	if *gpmfMode != "" && *gpmfMode != "bin" && *gpmfMode != "mov" && *gpmfMode != "both" {
+		fmt.Fprintf(os.Stderr, "Error: invalid GPMF mode: %s (expected bin, mov or both)\n", *gpmfMode)
+		os.Exit(2)
+	}
+
+	nJobs := *jobs
+	if nJobs == 1 {
+		nJobs = *jobsLong
+	}
+	if nJobs < 1 {
+		fmt.Fprintf(os.Stderr, "Error: invalid number of jobs: %d\n", nJobs)
+		os.Exit(2)
+	}
+
+	if *orientMode != "" && *orientMode != "csv" && *orientMode != "json" {
+		fmt.Fprintf(os.Stderr, "Error: invalid orientation format: %s (expected csv or json)\n", *orientMode)
+		os.Exit(2)
+	}
+	if *orientRate != "frame" && *orientRate != "sample" {
+		fmt.Fprintf(os.Stderr, "Error: invalid orientation rate: %s (expected frame or sample)\n", *orientRate)
+		os.Exit(2)
+	}
+	if _, err := newFusionFilter(*fusion, *fusionGainFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	if (*lensMode || *lensModeLong) && !*experimentalLens {
+		fmt.Fprintln(os.Stderr, "Error: -l decodes a dbgi layout that has not been confirmed; add -experimental-lens to use it")
+		os.Exit(2)
+	}
+
+	if *gyroUnit != "rad" && *gyroUnit != "deg" {
+		fmt.Fprintf(os.Stderr, "Error: invalid gyro unit: %s (expected rad or deg)\n", *gyroUnit)
+		os.Exit(2)
+	}
+	if *accelUnit != "ms2" && *accelUnit != "g" {
+		fmt.Fprintf(os.Stderr, "Error: invalid accel unit: %s (expected ms2 or g)\n", *accelUnit)
+		os.Exit(2)
+	}
+
+	opts := &extractOptions{
+		MetaMode: meta,
+		MOV:      *movMode,
+		KeepData: *keepMode || *keepModeLong,
+		CAMM:     *cammMode,
+		GPMF:     *gpmfMode,
+		Separate: *separateMode || *separateModeLong,
+		CSV:      *csvMode || *csvModeLong,
+		GCSV:     *gcsvMode || *gcsvModeLong,
+		Lens:     *lensMode || *lensModeLong,
+		Orient: orientationOptions{
+			Format: *orientMode,
+			Rate:   *orientRate,
+			Filter: *fusion,
+			Gain:   *fusionGainFlag,
+		},
+		Force:    *forceMode || *forceModeLong,
+		Update:   *updateMode || *updateModeLong,
+		Verbose:  *verboseMode || *verboseModeLong,
+		Jobs:     nJobs,
+		Log:      os.Stdout,
+		TimeBase: tb,
+		Units:    imuUnits{Gyro: *gyroUnit, Accel: *accelUnit},
+	}
+
+	if *protoFile != "" {
+		if *djmdMsg == "" && *dbgiMsg == "" {
+			fmt.Fprintln(os.Stderr, "Error: -proto requires -djmd-msg and/or -dbgi-msg")
+			os.Exit(2)
+		}
+		schema, err := loadProtoSchema(*protoFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		opts.Schema = schema
+		if *djmdMsg != "" {
+			if opts.DjmdMsg, err = schema.message(*djmdMsg); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(2)
+			}
+		}
+		if *dbgiMsg != "" {
+			if opts.DbgiMsg, err = schema.message(*dbgiMsg); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(2)
+			}
+		}
+	} else if *djmdMsg != "" || *dbgiMsg != "" {
+		fmt.Fprintln(os.Stderr, "Error: -djmd-msg and -dbgi-msg require -proto")
+		os.Exit(2)
+	}
+
+	if opts.Verbose {
 		fmt.Printf("Input: %s\n", input)
 		fmt.Printf("Output directory: %s\n", outdir)
-		fmt.Printf("Metadata mode: %s\n", meta)
-		fmt.Printf("MOV output: %v\n", *movMode)
-		fmt.Printf("Separate files: %v\n", separate)
-		fmt.Printf("CSV output: %v\n", csv)
-		fmt.Printf("Force overwrite: %v\n", force)
+		fmt.Printf("Metadata mode: %s\n", opts.MetaMode)
+		fmt.Printf("MOV output: %v\n", opts.MOV)
+		fmt.Printf("Keep data tracks: %v\n", opts.KeepData)
+		fmt.Printf("CAMM track: %v\n", opts.CAMM)
+		if opts.GPMF != "" {
+			fmt.Printf("GPMF output: %s\n", opts.GPMF)
+		}
+		fmt.Printf("Separate files: %v\n", opts.Separate)
+		fmt.Printf("CSV output: %v\n", opts.CSV)
+		fmt.Printf("Gyroflow output: %v\n", opts.GCSV)
+		fmt.Printf("Lens calibration output: %v\n", opts.Lens)
+		if opts.Orient.Format != "" {
+			fmt.Printf("Orientation output: %s per %s (%s)\n", opts.Orient.Format, opts.Orient.Rate, opts.Orient.Filter)
+		}
+		if opts.Schema != nil {
+			fmt.Printf("Protobuf schema: %s\n", *protoFile)
+		}
+		fmt.Printf("IMU time base: %s\n", opts.TimeBase)
+		fmt.Printf("IMU units: %s, %s\n", opts.Units.gyroLabel(), opts.Units.accelLabel())
+		fmt.Printf("Force overwrite: %v\n", opts.Force)
+		fmt.Printf("Update mode: %v\n", opts.Update)
 		fmt.Println()
 	}
 
-	if err := processInput(input, outdir, meta, *movMode, separate, csv, force, verbose); err != nil {
+	if err := processInput(ctx, input, outdir, opts); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
-func processInput(input, outdir, metaMode string, movMode, separateMode, csvMode, force, verbose bool) error {
+type extractOptions struct {
+	MetaMode string
+	MOV      bool
+	KeepData bool
+	CAMM     bool
+	GPMF     string
+	Separate bool
+	CSV      bool
+	GCSV     bool
+	Lens     bool
+	Orient   orientationOptions // Format "" disables the export
+	Force    bool
+	Update   bool // skip outputs that are up to date
+	Verbose  bool
+	Jobs     int
+	Log      io.Writer // destination of the verbose output
+	TimeBase string
+	Units    imuUnits
+	Schema   *protoSchema
+	DjmdMsg  *protoMessage
+	DbgiMsg  *protoMessage
+}
+
+func processInput(ctx context.Context, input, outdir string, opts *extractOptions) error {
 	fileInfo, err := os.Stat(input)
 	if err != nil {
 		return fmt.Errorf("failed to check input path: %v", err)
 	}
 
 	if fileInfo.IsDir() {
-		return processDirectory(input, outdir, metaMode, movMode, separateMode, csvMode, force, verbose)
+		return processDirectory(ctx, input, outdir, opts)
 	} else {
-		return cmdExtract(input, outdir, metaMode, movMode, separateMode, csvMode, force, verbose)
+		return cmdExtract(ctx, input, outdir, opts)
 	}
 }
 
-func processDirectory(inputDir, outdir, metaMode string, movMode, separateMode, csvMode, force, verbose bool) error {
-	if verbose {
-		fmt.Printf("Searching for OSV files in directory: %s\n", inputDir)
+func processDirectory(ctx context.Context, inputDir, outdir string, opts *extractOptions) error {
+	if opts.Verbose {
+		fmt.Fprintf(opts.Log, "Searching for OSV files in directory: %s\n", inputDir)
 	}
 
 	osvFiles, err := findOSVFiles(inputDir)
@@ -173,45 +396,142 @@ func processDirectory(inputDir, outdir, metaMode string, movMode, separateMode,
 		return fmt.Errorf("no OSV files found in directory: %s", inputDir)
 	}
 
-	if verbose {
-		fmt.Printf("Found %d OSV files\n", len(osvFiles))
-		fmt.Println()
+	if opts.Verbose {
+		fmt.Fprintf(opts.Log, "Found %d OSV files\n", len(osvFiles))
+		fmt.Fprintln(opts.Log)
 	}
 
-	for i, osvFile := range osvFiles {
-		if verbose {
-			fmt.Printf("Processing (%d/%d): %s\n", i+1, len(osvFiles), filepath.Base(osvFile))
-			fmt.Println(strings.Repeat("-", 50))
-		}
+	dirs, conflicts := batchOutputDirs(inputDir, outdir, osvFiles)
 
-		fileOutdir := outdir
-		if fileOutdir == "" {
-			if filepath.IsAbs(osvFile) {
-				fileOutdir = filepath.Dir(osvFile)
-			} else {
-				fileOutdir = "."
+	// Each worker writes the log of its file to a buffer, which is printed
+	// once the file and all files before it are done, so the output reads
+	// as if the files had been processed one by one. A single worker logs
+	// straight to stdout.
+	jobs := max(1, min(opts.Jobs, len(osvFiles)))
+	results := make([]batchResult, len(osvFiles))
+	for i := range results {
+		results[i].done = make(chan struct{})
+	}
+	next := make(chan int)
+	for w := 0; w < jobs; w++ {
+		go func() {
+			for i := range next {
+				r := &results[i]
+				o := *opts
+				if jobs > 1 {
+					o.Log = &r.log
+				}
+				switch {
+				case ctx.Err() != nil:
+					// Interrupted: the remaining files are not started.
+					r.err, r.skipped = context.Cause(ctx), true
+				case conflicts[i] != nil:
+					r.err = conflicts[i]
+				default:
+					r.err = processBatchFile(ctx, osvFiles[i], dirs[i], i, len(osvFiles), &o)
+				}
+				close(r.done)
+			}
+		}()
+	}
+	go func() {
+		for i := range osvFiles {
+			next <- i
+		}
+		close(next)
+	}()
+
+	var failed []string
+	for i := range results {
+		r := &results[i]
+		<-r.done
+		opts.Log.Write(r.log.Bytes())
+		if r.err != nil && !r.skipped {
+			failed = append(failed, filepath.Base(osvFiles[i]))
+			fmt.Fprintf(os.Stderr, "Warning: Failed to process %s: %v\n", filepath.Base(osvFiles[i]), r.err)
+			if opts.Verbose {
+				fmt.Fprintln(opts.Log)
 			}
 		}
+	}
+
+	if opts.Verbose {
+		fmt.Fprintf(opts.Log, "All OSV files processed (%d files)\n", len(osvFiles))
+	}
+	if len(failed) > 0 && len(osvFiles) > 1 {
+		fmt.Fprintf(os.Stderr, "%d of %d files failed: %s\n", len(failed), len(osvFiles), strings.Join(failed, ", "))
+	}
+
+	return context.Cause(ctx)
+}
+
+type batchResult struct {
+	log     bytes.Buffer
+	err     error
+	skipped bool
+	done    chan struct{}
+}
+
+func processBatchFile(ctx context.Context, osvFile, outdir string, i, n int, opts *extractOptions) error {
+	if opts.Verbose {
+		fmt.Fprintf(opts.Log, "Processing (%d/%d): %s\n", i+1, n, filepath.Base(osvFile))
+		fmt.Fprintln(opts.Log, strings.Repeat("-", 50))
+	}
+	if err := cmdExtract(ctx, osvFile, outdir, opts); err != nil {
+		return err
+	}
+	if opts.Verbose {
+		fmt.Fprintf(opts.Log, "Completed: %s\n", filepath.Base(osvFile))
+		fmt.Fprintln(opts.Log)
+	}
+	return nil
+}
 
-		if err := cmdExtract(osvFile, fileOutdir, metaMode, movMode, separateMode, csvMode, force, verbose); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: Failed to process %s: %v\n", filepath.Base(osvFile), err)
-			if verbose {
-				fmt.Println()
+// batchOutputDirs returns the output directory of each file. Files whose
+// <outdir>/<basename> subdirectories would coincide, such as CAM_0001.OSV
+// in two different card folders, get their folder relative to inputDir
+// appended to outdir instead. Any file still sharing a subdirectory with
+// an earlier one gets a conflict error rather than overwriting its outputs.
+func batchOutputDirs(inputDir, outdir string, files []string) ([]string, []error) {
+	dirs := make([]string, len(files))
+	key := func(i int) string {
+		base := strings.TrimSuffix(filepath.Base(files[i]), filepath.Ext(files[i]))
+		// Case-insensitive file systems would merge names differing in case.
+		return strings.ToLower(filepath.Clean(filepath.Join(dirs[i], base)))
+	}
+	count := map[string]int{}
+	for i, f := range files {
+		dirs[i] = outdir
+		if dirs[i] == "" {
+			if filepath.IsAbs(f) {
+				dirs[i] = filepath.Dir(f)
+			} else {
+				dirs[i] = "."
 			}
+		}
+		count[key(i)]++
+	}
+	for i, f := range files {
+		if count[key(i)] < 2 {
 			continue
 		}
-
-		if verbose {
-			fmt.Printf("Completed: %s\n", filepath.Base(osvFile))
-			fmt.Println()
+		if rel, err := filepath.Rel(inputDir, filepath.Dir(f)); err == nil && rel != "." {
+			dirs[i] = filepath.Join(dirs[i], rel)
 		}
 	}
 
-	if verbose {
-		fmt.Printf("All OSV files processed (%d files)\n", len(osvFiles))
+	conflicts := make([]error, len(files))
+	owner := map[string]int{}
+	for i := range files {
+		k := key(i)
+		if j, ok := owner[k]; ok {
+			conflicts[i] = fmt.Errorf("output directory %s is already used by %s",
+				filepath.Join(dirs[i], strings.TrimSuffix(filepath.Base(files[i]), filepath.Ext(files[i]))), files[j])
+			continue
+		}
+		owner[k] = i
 	}
-
-	return nil
+	return dirs, conflicts
 }
 
 func findOSVFiles(dir string) ([]string, error) {
@@ -246,6 +566,9 @@ func usage() {
 	fmt.Println("Commands:")
 	fmt.Println("  inspect, i     Parse and display the content of an OSV file")
 	fmt.Println("  extract, e     Extract videos, audio, and metadata from an OSV file")
+	fmt.Println("  stitch, s      Stitch front/rear fisheye videos into a 360 video (ffmpeg)")
+	fmt.Println("  inject, j      Write spherical video metadata into an MP4/MOV file")
+	fmt.Println("  protodump, pd  Dump djmd/dbgi packets as a protobuf field tree")
 	fmt.Println("  help, h         Show this help")
 	fmt.Println()
 	fmt.Println("Examples:")
@@ -253,142 +576,305 @@ func usage() {
 	fmt.Println("  osv2mov extract input.osv")
 	fmt.Println("  osv2mov extract -o output_dir input.osv")
 	fmt.Println("  osv2mov e -s -c input.osv")
+	fmt.Println("  osv2mov stitch input.osv")
+	fmt.Println("  osv2mov inject video_equirect.mp4")
+	fmt.Println("  osv2mov protodump -s 4 input.osv")
 	fmt.Println()
 	fmt.Println("Detailed help:")
 	fmt.Println("  osv2mov extract -h")
 	fmt.Println("  osv2mov e -h")
+	fmt.Println("  osv2mov stitch -h")
+	fmt.Println("  osv2mov inject -h")
+	fmt.Println("  osv2mov protodump -h")
 }
 
 func cmdInspect(path string) error {
-	raw, err := run("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", path)
+	m, err := openMP4(path)
 	if err != nil {
 		return err
 	}
-	var p probe
-	if err := json.Unmarshal(raw, &p); err != nil {
-		return err
+	defer m.Close()
+	sum := summarize(m.probe())
+	for _, d := range sum.Data {
+		if d["tag"] != "djmd" {
+			continue
+		}
+		if hdr, found, err := readIMUHeader(m, d["index"].(int)); err == nil && found {
+			d["imu_header"] = hdr
+		}
 	}
-	sum := summarize(&p)
 	b, _ := json.MarshalIndent(sum, "", "  ")
 	fmt.Println(string(b))
 	return nil
 }
 
-func cmdExtract(input, outdir, metaMode string, movMode, separateMode, csvMode, force, verbose bool) error {
-	if verbose {
-		fmt.Printf("Creating output directory: %s\n", outdir)
+func cmdExtract(ctx context.Context, input, outdir string, opts *extractOptions) (err error) {
+	if opts.Verbose {
+		fmt.Fprintf(opts.Log, "Creating output directory: %s\n", outdir)
 	}
 	if err := os.MkdirAll(outdir, 0o755); err != nil {
 		return err
 	}
 	base := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
 	subdir := filepath.Join(outdir, base)
-	if verbose {
-		fmt.Printf("Creating subdirectory: %s\n", subdir)
+	if opts.Verbose {
+		fmt.Fprintf(opts.Log, "Creating subdirectory: %s\n", subdir)
 	}
 	if err := os.MkdirAll(subdir, 0o755); err != nil {
 		return err
 	}
-	if verbose {
-		fmt.Printf("Parsing OSV file: %s\n", input)
-	}
-	raw, err := run("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", input)
+	outs, err := newOutputSet(input, subdir, opts)
 	if err != nil {
 		return err
 	}
-	var p probe
-	if err := json.Unmarshal(raw, &p); err != nil {
+	// Keep the record of what was written even if a later output fails.
+	defer func() {
+		if serr := outs.save(); err == nil {
+			err = serr
+		}
+	}()
+	if opts.Verbose {
+		fmt.Fprintf(opts.Log, "Parsing OSV file: %s\n", input)
+	}
+	p, err := probeFile(input)
+	if err != nil {
 		return err
 	}
-	if verbose {
-		fmt.Printf("Number of streams: %d\n", len(p.Streams))
+	if opts.Verbose {
+		fmt.Fprintf(opts.Log, "Number of streams: %d\n", len(p.Streams))
 	}
-	var vids []int
-	var auds []int
-	var thumbs []int
-	var djmd []int
-	var dbgi []int
-	for _, s := range p.Streams {
-		switch s.CodecType {
-		case "video":
-			if s.CodecName == "hevc" {
-				vids = append(vids, s.Index)
-			}
-			if s.Disposition.AttachedPic == 1 || s.CodecName == "mjpeg" {
-				thumbs = append(thumbs, s.Index)
-			}
-		case "audio":
-			auds = append(auds, s.Index)
-		case "data":
-			if s.CodecTagString == "djmd" {
-				djmd = append(djmd, s.Index)
-			}
-			if s.CodecTagString == "dbgi" {
-				dbgi = append(dbgi, s.Index)
-			}
-		}
+	st := classifyStreams(p)
+	vids, auds, thumbs, djmd, dbgi := st.Video, st.Audio, st.Thumb, st.DJMD, st.DBGI
+
+	if opts.Verbose {
+		fmt.Fprintf(opts.Log, "Video streams: %v\n", vids)
+		fmt.Fprintf(opts.Log, "Audio streams: %v\n", auds)
+		fmt.Fprintf(opts.Log, "Thumbnails: %v\n", thumbs)
+		fmt.Fprintf(opts.Log, "DJMD data: %v\n", djmd)
+		fmt.Fprintf(opts.Log, "DBGI data: %v\n", dbgi)
+		fmt.Fprintln(opts.Log)
 	}
-	sort.Ints(vids)
-	sort.Ints(auds)
-	sort.Ints(thumbs)
-	sort.Ints(djmd)
-	sort.Ints(dbgi)
 
-	if verbose {
-		fmt.Printf("Video streams: %v\n", vids)
-		fmt.Printf("Audio streams: %v\n", auds)
-		fmt.Printf("Thumbnails: %v\n", thumbs)
-		fmt.Printf("DJMD data: %v\n", djmd)
-		fmt.Printf("DBGI data: %v\n", dbgi)
-		fmt.Println()
+	if opts.MOV {
+		if opts.Verbose {
+			fmt.Fprintln(opts.Log, "Creating MOV files...")
+		}
+		if err := createMOVFiles(ctx, input, subdir, base, vids, auds, thumbs, djmd, dbgi, opts, outs); err != nil {
+			return err
+		}
 	}
 
-	if movMode {
-		if verbose {
-			fmt.Println("Creating MOV files...")
+	if opts.Separate {
+		if opts.Verbose {
+			fmt.Fprintln(opts.Log, "Creating separate files...")
 		}
-		if err := createMOVFiles(input, subdir, base, vids, auds, verbose, force); err != nil {
+		if err := createSeparateFiles(ctx, input, subdir, base, vids, auds, thumbs, djmd, dbgi, opts.MetaMode, opts.Log, opts.Verbose, outs); err != nil {
 			return err
 		}
 	}
 
-	if separateMode {
-		if verbose {
-			fmt.Println("Creating separate files...")
+	if !opts.MOV && !opts.Separate {
+		if opts.Verbose {
+			fmt.Fprintln(opts.Log, "Creating MOV files (default)...")
 		}
-		if err := createSeparateFiles(input, subdir, base, vids, auds, thumbs, djmd, dbgi, metaMode, verbose, force); err != nil {
+		if err := createMOVFiles(ctx, input, subdir, base, vids, auds, thumbs, djmd, dbgi, opts, outs); err != nil {
 			return err
 		}
 	}
 
-	if !movMode && !separateMode {
-		if verbose {
-			fmt.Println("Creating MOV files (default)...")
-		}
-		if err := createMOVFiles(input, subdir, base, vids, auds, verbose, force); err != nil {
+	// The metadata outputs below take little time; stop before them.
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	rawMeta := opts.Separate && (opts.MetaMode == "raw" || opts.MetaMode == "both")
+	decodeMeta := opts.CSV && (opts.MetaMode == "decode" || opts.MetaMode == "both")
+	if len(djmd) > 0 && (rawMeta || decodeMeta) {
+		if err := writeIMUHeaderJSON(input, djmd, subdir, base, opts.Log, opts.Verbose, outs); err != nil {
 			return err
 		}
 	}
 
-	if csvMode && (metaMode == "decode" || metaMode == "both") {
+	if decodeMeta {
 		if len(djmd) > 0 {
 			out := filepath.Join(subdir, base+"_djmd.csv")
-			if verbose {
-				fmt.Printf("Outputting IMU data to CSV: %s\n", out)
+			sig := fmt.Sprintf("timebase=%s units=%s,%s raw", opts.TimeBase, opts.Units.Gyro, opts.Units.Accel)
+			write, err := outs.check(out, sig)
+			if err != nil {
+				return err
+			}
+			if write {
+				if opts.Verbose {
+					fmt.Fprintf(opts.Log, "Outputting IMU data to CSV: %s\n", out)
+				}
+				videoIndex := -1
+				if len(vids) > 0 {
+					videoIndex = vids[0]
+				}
+				stats, err := decodeDataTrackToCSVCombined(input, djmd, videoIndex, out, opts.TimeBase, opts.Units)
+				if err != nil {
+					return err
+				}
+				outs.done(out, sig)
+				if opts.Verbose {
+					fmt.Fprintf(opts.Log, "CSV output completed: %s (%d records)\n", out, stats.Records)
+					if stats.Gaps > 0 || stats.Wraps > 0 || stats.Backsteps > 0 {
+						fmt.Fprintf(opts.Log, "IMU timing: %d gaps (max %.3f ms), %d wraparounds, %d backward steps\n",
+							stats.Gaps, stats.MaxGap*1000, stats.Wraps, stats.Backsteps)
+					}
+				}
+			}
+		}
+	}
+
+	if (opts.GPMF == "bin" || opts.GPMF == "both") && len(djmd) > 0 {
+		out := filepath.Join(subdir, base+"_gpmf.bin")
+		write, err := outs.check(out, "")
+		if err != nil {
+			return err
+		}
+		if write {
+			if opts.Verbose {
+				fmt.Fprintf(opts.Log, "Outputting GPMF telemetry: %s\n", out)
+			}
+			if err := writeGPMFBin(input, djmd, out); err != nil {
+				return err
+			}
+			outs.done(out, "")
+		}
+	}
+
+	if opts.GCSV && (opts.MetaMode == "decode" || opts.MetaMode == "both") {
+		if len(djmd) > 0 {
+			if err := writeGyroflowLogs(input, djmd, vids, subdir, base, opts.Log, opts.Verbose, outs); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.Orient.Format != "" && (opts.MetaMode == "decode" || opts.MetaMode == "both") {
+		if len(djmd) > 0 {
+			out := filepath.Join(subdir, base+"_orientation."+opts.Orient.Format)
+			sig := fmt.Sprintf("rate=%s filter=%s gain=%g", opts.Orient.Rate, opts.Orient.Filter, fusionGain(opts.Orient.Filter, opts.Orient.Gain))
+			write, err := outs.check(out, sig)
+			if err != nil {
+				return err
+			}
+			if write {
+				if opts.Verbose {
+					fmt.Fprintf(opts.Log, "Outputting fused orientation: %s\n", out)
+				}
+				videoIndex := -1
+				if len(vids) > 0 {
+					videoIndex = vids[0]
+				}
+				rows, err := writeOrientation(input, djmd, videoIndex, out, opts.Orient)
+				if err != nil {
+					return err
+				}
+				outs.done(out, sig)
+				if opts.Verbose {
+					fmt.Fprintf(opts.Log, "Orientation output completed: %s (%d rows)\n", out, rows)
+				}
+			}
+		}
+	}
+
+	if opts.Lens && (opts.MetaMode == "decode" || opts.MetaMode == "both") {
+		if len(dbgi) > 0 {
+			out := filepath.Join(subdir, base+"_lens.json")
+			write, err := outs.check(out, "")
+			if err != nil {
+				return err
+			}
+			if write {
+				if opts.Verbose {
+					fmt.Fprintf(opts.Log, "Outputting lens calibration: %s\n", out)
+				}
+				if err := writeLensCalibrationJSON(input, dbgi, out); err != nil {
+					return err
+				}
+				outs.done(out, "")
 			}
-			if err := decodeDataTrackToCSVCombined(input, djmd, out); err != nil {
+		}
+	}
+
+	if opts.Schema != nil && (opts.MetaMode == "decode" || opts.MetaMode == "both") {
+		tracks := []struct {
+			name    string
+			streams []int
+			msg     *protoMessage
+		}{
+			{"djmd", djmd, opts.DjmdMsg},
+			{"dbgi", dbgi, opts.DbgiMsg},
+		}
+		for _, t := range tracks {
+			if t.msg == nil || len(t.streams) == 0 {
+				continue
+			}
+			out := filepath.Join(subdir, base+"_"+t.name+".jsonl")
+			sig := "message=" + t.msg.Name
+			write, err := outs.check(out, sig)
+			if err != nil {
 				return err
 			}
-			if verbose {
-				fmt.Printf("CSV output completed: %s\n", out)
+			if !write {
+				continue
+			}
+			if opts.Verbose {
+				fmt.Fprintf(opts.Log, "Decoding %s packets as %s: %s\n", t.name, t.msg.Name, out)
 			}
+			if err := writeProtoJSONL(input, t.streams, opts.Schema, t.msg, out); err != nil {
+				return err
+			}
+			outs.done(out, sig)
 		}
 	}
 
 	return nil
 }
 
-func createMOVFiles(input, subdir, base string, vids, auds []int, verbose, force bool) error {
+// osvStreams lists the stream indices of an OSV file by role. Video[0] is
+// the front lens and Video[1] the rear lens.
+type osvStreams struct {
+	Video []int
+	Audio []int
+	Thumb []int
+	DJMD  []int
+	DBGI  []int
+}
+
+func classifyStreams(p *probe) osvStreams {
+	var st osvStreams
+	for _, s := range p.Streams {
+		switch s.CodecType {
+		case "video":
+			if s.CodecName == "hevc" {
+				st.Video = append(st.Video, s.Index)
+			}
+			if s.Disposition.AttachedPic == 1 || s.CodecName == "mjpeg" {
+				st.Thumb = append(st.Thumb, s.Index)
+			}
+		case "audio":
+			st.Audio = append(st.Audio, s.Index)
+		case "data":
+			if s.CodecTagString == "djmd" {
+				st.DJMD = append(st.DJMD, s.Index)
+			}
+			if s.CodecTagString == "dbgi" {
+				st.DBGI = append(st.DBGI, s.Index)
+			}
+		}
+	}
+	sort.Ints(st.Video)
+	sort.Ints(st.Audio)
+	sort.Ints(st.Thumb)
+	sort.Ints(st.DJMD)
+	sort.Ints(st.DBGI)
+	return st
+}
+
+func createMOVFiles(ctx context.Context, input, subdir, base string, vids, auds, thumbs, djmd, dbgi []int, opts *extractOptions, outs *outputSet) error {
 	if len(vids) == 0 {
 		return fmt.Errorf("no video streams found")
 	}
@@ -396,153 +882,204 @@ func createMOVFiles(input, subdir, base string, vids, auds []int, verbose, force
 		return fmt.Errorf("no audio streams found")
 	}
 
-	for i, vidIdx := range vids {
-		if i >= 2 {
-			break
+	// files[i] is empty when the MOV of lens i is skipped as up to date.
+	sig := fmt.Sprintf("keep=%v camm=%v gpmf=%v", opts.KeepData, opts.CAMM, opts.GPMF == "mov" || opts.GPMF == "both")
+	files := make([]string, min(len(vids), 2))
+	pending := 0
+	for i := range files {
+		out := filepath.Join(subdir, fmt.Sprintf("%s_%s.mov", base, lensName(i)))
+		write, err := outs.check(out, sig)
+		if err != nil {
+			return err
+		}
+		if write {
+			files[i] = out
+			pending++
+		}
+	}
+	if pending == 0 {
+		return nil
+	}
+
+	m, err := openMP4(input)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	var extra []*syntheticTrack
+	if opts.CAMM {
+		if len(djmd) == 0 {
+			return fmt.Errorf("no djmd streams found for CAMM track")
+		}
+		if opts.Verbose {
+			fmt.Fprintf(opts.Log, "Building CAMM track from djmd streams %v\n", djmd)
+		}
+		t, err := buildCAMMTrack(m, djmd, subdir)
+		if err != nil {
+			return fmt.Errorf("CAMM track creation error: %v", err)
+		}
+		defer t.Close()
+		extra = append(extra, t)
+	}
+	if opts.GPMF == "mov" || opts.GPMF == "both" {
+		if len(djmd) == 0 {
+			return fmt.Errorf("no djmd streams found for GPMF track")
+		}
+		if opts.Verbose {
+			fmt.Fprintf(opts.Log, "Building GPMF track from djmd streams %v\n", djmd)
+		}
+		t, err := buildGPMFTrack(m, djmd, subdir)
+		if err != nil {
+			return fmt.Errorf("GPMF track creation error: %v", err)
+		}
+		defer t.Close()
+		extra = append(extra, t)
+	}
+
+	for i, out := range files {
+		if out == "" {
+			continue
 		}
+		vidIdx := vids[i]
 		audioIdx := auds[0]
 		if len(auds) > i {
 			audioIdx = auds[i]
 		}
 
-		var suffix string
-		if i == 0 {
-			suffix = "front"
-		} else {
-			suffix = "rear"
-		}
-		out := filepath.Join(subdir, fmt.Sprintf("%s_%s.mov", base, suffix))
-		if !force {
-			if _, err := os.Stat(out); err == nil {
-				return fmt.Errorf("file already exists: %s (use -f to overwrite)", out)
+		if opts.Verbose {
+			if opts.KeepData {
+				fmt.Fprintf(opts.Log, "Creating MOV file: %s (Video:%d, Audio:%d, djmd:%v, dbgi:%v, Thumbnail:%v)\n", out, vidIdx, audioIdx, djmd, dbgi, thumbs)
+			} else {
+				fmt.Fprintf(opts.Log, "Creating MOV file: %s (Video:%d, Audio:%d)\n", out, vidIdx, audioIdx)
 			}
 		}
-		if verbose {
-			fmt.Printf("Creating MOV file: %s (Video:%d, Audio:%d)\n", out, vidIdx, audioIdx)
-		}
-		args := []string{
-			"-y", "-i", input,
-			"-map", fmt.Sprintf("0:%d", vidIdx),
-			"-map", fmt.Sprintf("0:%d", audioIdx),
-			"-c:v", "copy",
-			"-c:a", "copy",
-			"-f", "mov",
-			out,
+		tracks := []int{vidIdx, audioIdx}
+		if opts.KeepData {
+			tracks = append(tracks, djmd...)
+			tracks = append(tracks, dbgi...)
+			tracks = append(tracks, thumbs...)
 		}
-		if _, err := run("ffmpeg", args...); err != nil {
-			return fmt.Errorf("MOV file creation error (v%d): %v", i, err)
+		if err := remuxTracks(ctx, m, out, ftypQuickTime, tracks, extra...); err != nil {
+			return fmt.Errorf("MOV file creation error (v%d): %w", i, err)
 		}
-		if verbose {
-			fmt.Printf("Completed: %s\n", out)
+		outs.done(out, sig)
+		if opts.Verbose {
+			fmt.Fprintf(opts.Log, "Completed: %s\n", out)
 		}
 	}
 	return nil
 }
 
-func createSeparateFiles(input, subdir, base string, vids, auds, thumbs, djmd, dbgi []int, metaMode string, verbose, force bool) error {
-	if len(vids) > 0 {
-		out := filepath.Join(subdir, base+"_front.hevc.mp4")
-		if !force {
-			if _, err := os.Stat(out); err == nil {
-				return fmt.Errorf("file already exists: %s (use -f to overwrite)", out)
-			}
+func createSeparateFiles(ctx context.Context, input, subdir, base string, vids, auds, thumbs, djmd, dbgi []int, metaMode string, log io.Writer, verbose bool, outs *outputSet) error {
+	var files []splitOutput
+	add := func(desc string, o splitOutput) error {
+		if write, err := outs.check(o.path, ""); err != nil || !write {
+			return err
 		}
 		if verbose {
-			fmt.Printf("Creating video file: %s\n", out)
+			fmt.Fprintf(log, "Creating %s: %s\n", desc, o.path)
 		}
-		if _, err := run("ffmpeg", "-y", "-i", input, "-map", "0:"+strconv.Itoa(vids[0]), "-c", "copy", out); err != nil {
+		files = append(files, o)
+		return nil
+	}
+
+	if len(vids) > 0 {
+		if err := add("video file", splitOutput{path: filepath.Join(subdir, base+"_front.hevc.mp4"), track: vids[0], ftyp: ftypMP4}); err != nil {
 			return err
 		}
 	}
 	if len(vids) > 1 {
-		out := filepath.Join(subdir, base+"_rear.hevc.mp4")
-		if !force {
-			if _, err := os.Stat(out); err == nil {
-				return fmt.Errorf("file already exists: %s (use -f to overwrite)", out)
-			}
-		}
-		if verbose {
-			fmt.Printf("Creating second video file: %s\n", out)
-		}
-		if _, err := run("ffmpeg", "-y", "-i", input, "-map", "0:"+strconv.Itoa(vids[1]), "-c", "copy", out); err != nil {
+		if err := add("second video file", splitOutput{path: filepath.Join(subdir, base+"_rear.hevc.mp4"), track: vids[1], ftyp: ftypMP4}); err != nil {
 			return err
 		}
 	}
 	if len(auds) > 0 {
-		out := filepath.Join(subdir, base+".aac.m4a")
-		if !force {
-			if _, err := os.Stat(out); err == nil {
-				return fmt.Errorf("file already exists: %s (use -f to overwrite)", out)
-			}
-		}
-		if verbose {
-			fmt.Printf("Creating audio file: %s\n", out)
-		}
-		if _, err := run("ffmpeg", "-y", "-i", input, "-map", "0:"+strconv.Itoa(auds[0]), "-c", "copy", out); err != nil {
+		if err := add("audio file", splitOutput{path: filepath.Join(subdir, base+".aac.m4a"), track: auds[0], ftyp: ftypM4A}); err != nil {
 			return err
 		}
 	}
 	if len(thumbs) > 0 {
-		out := filepath.Join(subdir, base+"_thumb.jpg")
-		if !force {
-			if _, err := os.Stat(out); err == nil {
-				return fmt.Errorf("file already exists: %s (use -f to overwrite)", out)
-			}
-		}
-		if verbose {
-			fmt.Printf("Creating thumbnail: %s\n", out)
-		}
-		if _, err := run("ffmpeg", "-y", "-i", input, "-map", "0:"+strconv.Itoa(thumbs[0]), "-frames:v", "1", out); err != nil {
+		// The thumbnail track holds a single JPEG, written as is.
+		if err := add("thumbnail", splitOutput{path: filepath.Join(subdir, base+"_thumb.jpg"), track: thumbs[0], first: true}); err != nil {
 			return err
 		}
 	}
 	if metaMode == "raw" || metaMode == "both" {
 		for i, idx := range djmd {
-			out := filepath.Join(subdir, base+"_djmd_"+strconv.Itoa(i)+".bin")
-			if !force {
-				if _, err := os.Stat(out); err == nil {
-					return fmt.Errorf("file already exists: %s (use -f to overwrite)", out)
-				}
-			}
-			if verbose {
-				fmt.Printf("Creating DJMD data file: %s\n", out)
-			}
-			if _, err := run("ffmpeg", "-y", "-i", input, "-map", "0:"+strconv.Itoa(idx), "-c", "copy", "-f", "data", out); err != nil {
+			if err := add("DJMD data file", splitOutput{path: filepath.Join(subdir, base+"_djmd_"+strconv.Itoa(i)+".bin"), track: idx}); err != nil {
 				return err
 			}
 		}
 		for i, idx := range dbgi {
-			out := filepath.Join(subdir, base+"_dbgi_"+strconv.Itoa(i)+".bin")
-			if !force {
-				if _, err := os.Stat(out); err == nil {
-					return fmt.Errorf("file already exists: %s (use -f to overwrite)", out)
-				}
-			}
-			if verbose {
-				fmt.Printf("Creating DBGI data file: %s\n", out)
-			}
-			if _, err := run("ffmpeg", "-y", "-i", input, "-map", "0:"+strconv.Itoa(idx), "-c", "copy", "-f", "data", out); err != nil {
+			if err := add("DBGI data file", splitOutput{path: filepath.Join(subdir, base+"_dbgi_"+strconv.Itoa(i)+".bin"), track: idx}); err != nil {
 				return err
 			}
 		}
 	}
 
+	if len(files) > 0 {
+		m, err := openMP4(input)
+		if err != nil {
+			return err
+		}
+		defer m.Close()
+		if err := splitTracks(ctx, m, files); err != nil {
+			return err
+		}
+		for _, o := range files {
+			outs.done(o.path, "")
+		}
+	}
+
 	if verbose {
-		fmt.Println("All processing completed")
+		fmt.Fprintln(log, "All processing completed")
 	}
 	return nil
 }
 
-func run(name string, args ...string) ([]byte, error) {
-	cmd := exec.Command(name, args...)
+// run executes name and returns its combined output. Cancelling ctx kills
+// the process.
+func run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
 	cmd.Env = os.Environ()
 	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("%s failed: %v\n%s", name, err, string(out))
 	}
 	return out, nil
 }
 
+var errInterrupted = errors.New("interrupted")
+
+// interruptContext returns a context that is cancelled with errInterrupted
+// on the first SIGINT or SIGTERM, so that running work can stop and remove
+// its incomplete outputs. A second signal terminates the process at once.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		signal.Stop(sig)
+		fmt.Fprintln(os.Stderr, "Interrupted, cleaning up (press Ctrl-C again to quit immediately)")
+		cancel(errInterrupted)
+	}()
+	return ctx
+}
+
+// exitCode returns the process exit status for a command error: 130, as
+// for a shell job killed by SIGINT, after an interrupt, and 1 otherwise.
+func exitCode(err error) int {
+	if errors.Is(err, errInterrupted) {
+		return 130
+	}
+	return 1
+}
+
 type probe struct {
 	Streams []stream `json:"streams"`
 	Format  format   `json:"format"`
@@ -611,308 +1148,3 @@ func summarize(p *probe) *summary {
 	}
 	return sum
 }
-
-type packetDump struct {
-	Packets []packet `json:"packets"`
-}
-
-type packet struct {
-	PtsTime string `json:"pts_time"`
-	Data    string `json:"data"`
-}
-
-func decodeHexDump(s string) []byte {
-	var nibbles []byte
-	lines := strings.Split(s, "\n")
-	for _, ln := range lines {
-		idx := strings.Index(ln, ":")
-		if idx < 0 {
-			continue
-		}
-		hexpart := ln[idx+1:]
-		for i := 0; i < len(hexpart); i++ {
-			c := hexpart[i]
-			if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') {
-				nibbles = append(nibbles, c)
-			}
-		}
-	}
-	// pair nibbles into bytes
-	out := make([]byte, 0, len(nibbles)/2)
-	for i := 0; i+1 < len(nibbles); i += 2 {
-		var b [1]byte
-		if _, err := hex.Decode(b[:], []byte{nibbles[i], nibbles[i+1]}); err == nil {
-			out = append(out, b[0])
-		}
-	}
-	return out
-}
-
-func readVarint(b []byte, i int) (uint64, int) {
-	var v uint64
-	var shift uint
-	start := i
-	for i < len(b) {
-		c := b[i]
-		v |= uint64(c&0x7F) << shift
-		i++
-		if c < 0x80 {
-			return v, i - start
-		}
-		shift += 7
-		if shift > 63 {
-			break
-		}
-	}
-	return 0, 0
-}
-
-func decodeDataTrackToCSVCombined(input string, streamIndices []int, out string) error {
-	var allIMUData []IMURecord
-	var sampleRate float32 = 800.0
-	var globalSampleIndex int = 0
-
-	for _, streamIndex := range streamIndices {
-		raw, err := run("ffprobe", "-v", "error", "-print_format", "json", "-show_packets", "-show_data", "-select_streams", strconv.Itoa(streamIndex), input)
-		if err != nil {
-			return err
-		}
-		var dump packetDump
-		if err := json.Unmarshal(raw, &dump); err != nil {
-			return err
-		}
-
-		for _, p := range dump.Packets {
-			b := decodeHexDump(p.Data)
-			imuData := decodeIMUData(b, sampleRate)
-
-			// サンプルインデックスを連続させる
-			for i := range imuData {
-				imuData[i].SampleIndex = globalSampleIndex
-				globalSampleIndex++
-			}
-
-			allIMUData = append(allIMUData, imuData...)
-		}
-	}
-
-	if len(allIMUData) == 0 {
-		return fmt.Errorf("IMU data not found")
-	}
-
-	// 時間を再計算（連続したサンプルインデックスに基づく）
-	for i := range allIMUData {
-		allIMUData[i].Timestamp = float64(allIMUData[i].SampleIndex) / float64(sampleRate)
-	}
-
-	return writeIMUCSV(allIMUData, out)
-}
-
-type IMURecord struct {
-	Timestamp                                        float64
-	SampleIndex                                      int
-	Ch0, Ch1, Ch2, Ch3, Ch4, Ch5, Ch6, Ch7, Ch8, Ch9 int16
-}
-
-func decodeIMUData(b []byte, sampleRate float32) []IMURecord {
-	var records []IMURecord
-	i := 0
-	for i < len(b) {
-		key, n := readVarint(b, i)
-		if n == 0 {
-			break
-		}
-		i += n
-		fieldNum := int(key >> 3)
-		wireType := int(key & 0x7)
-
-		if fieldNum == 3 && wireType == 2 {
-			l, m := readVarint(b, i)
-			if m == 0 || int(l) < 0 || i+m+int(l) > len(b) {
-				break
-			}
-			i += m
-			payload := b[i : i+int(l)]
-			i += int(l)
-
-			imuRecords := parseIMUPayload(payload, sampleRate)
-			records = append(records, imuRecords...)
-		} else {
-			switch wireType {
-			case 0:
-				_, m := readVarint(b, i)
-				if m == 0 {
-					i = len(b)
-					break
-				}
-				i += m
-			case 1:
-				if i+8 > len(b) {
-					i = len(b)
-					break
-				}
-				i += 8
-			case 2:
-				l, m := readVarint(b, i)
-				if m == 0 || int(l) < 0 || i+m+int(l) > len(b) {
-					i = len(b)
-					break
-				}
-				i += m + int(l)
-			case 5:
-				if i+4 > len(b) {
-					i = len(b)
-					break
-				}
-				i += 4
-			default:
-				i = len(b)
-			}
-		}
-	}
-	return records
-}
-
-func parseIMUPayload(payload []byte, sampleRate float32) []IMURecord {
-	var records []IMURecord
-	i := 0
-
-	for i < len(payload) {
-		key, n := readVarint(payload, i)
-		if n == 0 {
-			break
-		}
-		i += n
-		fieldNum := int(key >> 3)
-		wireType := int(key & 0x7)
-
-		if fieldNum == 2 && wireType == 2 {
-			l, m := readVarint(payload, i)
-			if m == 0 || int(l) < 0 || i+m+int(l) > len(payload) {
-				break
-			}
-			i += m
-			headerData := payload[i : i+int(l)]
-			i += int(l)
-
-			if len(headerData) >= 20 {
-				sampleRate = float32(binary.LittleEndian.Uint32(headerData[0:4]))
-			}
-		} else if fieldNum == 3 && wireType == 2 {
-			l, m := readVarint(payload, i)
-			if m == 0 || int(l) < 0 || i+m+int(l) > len(payload) {
-				break
-			}
-			i += m
-			imuData := payload[i : i+int(l)]
-			i += int(l)
-
-			records = parseIMURecords(imuData, sampleRate)
-		} else {
-			switch wireType {
-			case 0:
-				_, m := readVarint(payload, i)
-				if m == 0 {
-					i = len(payload)
-					break
-				}
-				i += m
-			case 1:
-				if i+8 > len(payload) {
-					i = len(payload)
-					break
-				}
-				i += 8
-			case 2:
-				l, m := readVarint(payload, i)
-				if m == 0 || int(l) < 0 || i+m+int(l) > len(payload) {
-					i = len(payload)
-					break
-				}
-				i += m + int(l)
-			case 5:
-				if i+4 > len(payload) {
-					i = len(payload)
-					break
-				}
-				i += 4
-			default:
-				i = len(payload)
-			}
-		}
-	}
-	return records
-}
-
-func parseIMURecords(imuData []byte, sampleRate float32) []IMURecord {
-	var records []IMURecord
-	recordSize := 24
-
-	for i := 0; i+recordSize <= len(imuData); i += recordSize {
-		record := imuData[i : i+recordSize]
-
-		_ = binary.LittleEndian.Uint32(record[0:4])
-		ch0 := int16(binary.LittleEndian.Uint16(record[4:6]))
-		ch1 := int16(binary.LittleEndian.Uint16(record[6:8]))
-		ch2 := int16(binary.LittleEndian.Uint16(record[8:10]))
-		ch3 := int16(binary.LittleEndian.Uint16(record[10:12]))
-		ch4 := int16(binary.LittleEndian.Uint16(record[12:14]))
-		ch5 := int16(binary.LittleEndian.Uint16(record[14:16]))
-		ch6 := int16(binary.LittleEndian.Uint16(record[16:18]))
-		ch7 := int16(binary.LittleEndian.Uint16(record[18:20]))
-		ch8 := int16(binary.LittleEndian.Uint16(record[20:22]))
-		ch9 := int16(binary.LittleEndian.Uint16(record[22:24]))
-
-		sampleIndex := len(records)
-		timeSec := float64(sampleIndex) / float64(sampleRate)
-
-		imuRecord := IMURecord{
-			Timestamp:   timeSec,
-			SampleIndex: sampleIndex,
-			Ch0:         ch0,
-			Ch1:         ch1,
-			Ch2:         ch2,
-			Ch3:         ch3,
-			Ch4:         ch4,
-			Ch5:         ch5,
-			Ch6:         ch6,
-			Ch7:         ch7,
-			Ch8:         ch8,
-			Ch9:         ch9,
-		}
-
-		records = append(records, imuRecord)
-	}
-
-	return records
-}
-
-func writeIMUCSV(records []IMURecord, out string) error {
-	f, err := os.Create(out)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	w := bufio.NewWriter(f)
-	defer w.Flush()
-
-	header := "Timestamp(s),SampleIndex,Ch0,Ch1,Ch2,Ch3,Ch4,Ch5,Ch6,Ch7,Ch8,Ch9\n"
-	if _, err := w.WriteString(header); err != nil {
-		return err
-	}
-
-	for _, record := range records {
-		line := fmt.Sprintf("%.6f,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d\n",
-			record.Timestamp,
-			record.SampleIndex,
-			record.Ch0, record.Ch1, record.Ch2, record.Ch3, record.Ch4,
-			record.Ch5, record.Ch6, record.Ch7, record.Ch8, record.Ch9)
-
-		if _, err := w.WriteString(line); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
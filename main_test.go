@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBatchOutputDirs(t *testing.T) {
+	in := filepath.FromSlash("/data/in")
+	p := func(rel string) string { return filepath.Join(in, filepath.FromSlash(rel)) }
+	out := filepath.FromSlash("/data/out")
+	o := func(rel string) string { return filepath.Join(out, filepath.FromSlash(rel)) }
+
+	tests := []struct {
+		name      string
+		outdir    string
+		files     []string
+		dirs      []string
+		conflicts []string // substring of each file's error, "" for none
+	}{
+		{
+			"distinct names",
+			out,
+			[]string{p("a/CAM_0001.OSV"), p("b/CAM_0002.OSV")},
+			[]string{out, out},
+			[]string{"", ""},
+		},
+		{
+			// Card folders that reuse file names keep their folder.
+			"same name in two folders",
+			out,
+			[]string{p("card1/CAM_0001.OSV"), p("card2/CAM_0001.OSV"), p("card2/CAM_0002.OSV")},
+			[]string{o("card1"), o("card2"), out},
+			[]string{"", "", ""},
+		},
+		{
+			"names differing in case",
+			out,
+			[]string{p("a/cam_0001.osv"), p("b/CAM_0001.OSV")},
+			[]string{o("a"), o("b")},
+			[]string{"", ""},
+		},
+		{
+			// The same base name in one folder cannot be told apart.
+			"same folder",
+			out,
+			[]string{p("CAM_0001.OSV"), p("CAM_0001.osv")},
+			[]string{out, out},
+			[]string{"", "already used by " + p("CAM_0001.OSV")},
+		},
+		{
+			// Without -o every file writes next to itself.
+			"next to the input",
+			"",
+			[]string{p("card1/CAM_0001.OSV"), p("card2/CAM_0001.OSV")},
+			[]string{p("card1"), p("card2")},
+			[]string{"", ""},
+		},
+	}
+	for _, tt := range tests {
+		dirs, conflicts := batchOutputDirs(in, tt.outdir, tt.files)
+		if !reflect.DeepEqual(dirs, tt.dirs) {
+			t.Errorf("%s: dirs %v, want %v", tt.name, dirs, tt.dirs)
+		}
+		for i, want := range tt.conflicts {
+			err := conflicts[i]
+			if (err == nil) != (want == "") || (err != nil && !strings.Contains(err.Error(), want)) {
+				t.Errorf("%s: file %d: conflict %v, want %q", tt.name, i, err, want)
+			}
+		}
+	}
+}
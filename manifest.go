@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Incremental extraction. Each output subdirectory keeps a manifest of the
+// files written for its input: the input's size and modification time, and
+// for every output its own size and modification time plus the options its
+// content depends on. With -update an output whose entry still matches is
+// skipped, so rerunning over an archive only writes what is missing or
+// stale. Outputs only appear under their final name once complete, so an
+// entry is never recorded for a truncated file.
+//
+// The manifest is written on every run, with or without -update, so that a
+// later -update run knows the options of outputs written before it.
+
+const manifestName = ".osv2mov.json"
+
+type fileStamp struct {
+	Size  int64 `json:"size"`
+	MTime int64 `json:"mtime"` // Unix nanoseconds
+}
+
+func stampOf(fi os.FileInfo) fileStamp {
+	return fileStamp{fi.Size(), fi.ModTime().UnixNano()}
+}
+
+type manifestEntry struct {
+	fileStamp
+	Options string `json:"options,omitempty"`
+}
+
+type manifest struct {
+	Input   fileStamp                `json:"input"`
+	Outputs map[string]manifestEntry `json:"outputs"`
+}
+
+// outputSet decides for each output of one input whether it is written,
+// skipped as up to date or refused because it exists, and keeps the
+// manifest of its subdirectory.
+type outputSet struct {
+	force, update bool
+	log           io.Writer
+	verbose       bool
+	path          string // manifest file
+	input         os.FileInfo
+	m             manifest
+	dirty         bool
+}
+
+func newOutputSet(input, subdir string, opts *extractOptions) (*outputSet, error) {
+	fi, err := os.Stat(input)
+	if err != nil {
+		return nil, err
+	}
+	s := &outputSet{
+		force:   opts.Force,
+		update:  opts.Update,
+		log:     opts.Log,
+		verbose: opts.Verbose,
+		path:    filepath.Join(subdir, manifestName),
+		input:   fi,
+	}
+	// An unreadable manifest is started afresh.
+	if b, err := os.ReadFile(s.path); err == nil {
+		json.Unmarshal(b, &s.m)
+	}
+	if s.m.Input != stampOf(fi) || s.m.Outputs == nil {
+		// Nothing recorded for another version of the input is current.
+		s.m = manifest{Input: stampOf(fi), Outputs: map[string]manifestEntry{}}
+	}
+	return s, nil
+}
+
+// check returns whether out is to be written; sig names the options its
+// content depends on. An existing output is an error without -f, unless
+// -update finds it up to date, in which case it is skipped, or stale, in
+// which case it is replaced.
+func (s *outputSet) check(out, sig string) (bool, error) {
+	fi, err := os.Stat(out)
+	if err != nil || s.force {
+		return true, nil
+	}
+	if !s.update {
+		return false, fmt.Errorf("file already exists: %s (use -f to overwrite)", out)
+	}
+	if s.current(out, fi, sig) {
+		if s.verbose {
+			fmt.Fprintf(s.log, "Skipping up-to-date file: %s\n", out)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *outputSet) current(out string, fi os.FileInfo, sig string) bool {
+	if e, ok := s.m.Outputs[filepath.Base(out)]; ok {
+		return e.fileStamp == stampOf(fi) && e.Options == sig
+	}
+	// Written before there was a manifest: trust a file newer than the
+	// input that, for MP4/MOV outputs, has its moov. Its options are
+	// unknown, so it is recorded without any and the next run with options
+	// that matter replaces it.
+	if fi.Size() == 0 || fi.ModTime().Before(s.input.ModTime()) {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(out)) {
+	case ".mov", ".mp4", ".m4a":
+		m, err := openMP4(out)
+		if err != nil {
+			return false
+		}
+		m.Close()
+	}
+	s.done(out, "")
+	return true
+}
+
+// done records out as written with the options sig.
+func (s *outputSet) done(out, sig string) {
+	fi, err := os.Stat(out)
+	if err != nil {
+		return
+	}
+	s.m.Outputs[filepath.Base(out)] = manifestEntry{stampOf(fi), sig}
+	s.dirty = true
+}
+
+// save writes the manifest if any output was recorded.
+func (s *outputSet) save() error {
+	if !s.dirty {
+		return nil
+	}
+	b, err := json.MarshalIndent(s.m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeOutputFile(s.path, append(b, '\n')); err != nil {
+		return fmt.Errorf("manifest: %v", err)
+	}
+	s.dirty = false
+	return nil
+}
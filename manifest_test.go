@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputSet(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.osv")
+	out := filepath.Join(dir, "out.csv")
+	for _, p := range []string{input, out} {
+		if err := os.WriteFile(p, []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(input, past, past); err != nil {
+		t.Fatal(err)
+	}
+	open := func(opts extractOptions) *outputSet {
+		t.Helper()
+		opts.Log = io.Discard
+		s, err := newOutputSet(input, dir, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	check := func(s *outputSet, path, sig string, want bool) {
+		t.Helper()
+		write, err := s.check(path, sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if write != want {
+			t.Errorf("check(%s, %q) = %v, want %v", filepath.Base(path), sig, write, want)
+		}
+	}
+
+	// Without -f or -u an existing output is refused; a missing one is
+	// written.
+	s := open(extractOptions{})
+	if _, err := s.check(out, "a"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("existing output: error %v", err)
+	}
+	check(s, filepath.Join(dir, "missing.csv"), "a", true)
+	check(open(extractOptions{Force: true, Update: true}), out, "a", true)
+
+	// A legacy output newer than the input is trusted once, but recorded
+	// without options, so the next run with options replaces it.
+	s = open(extractOptions{Update: true})
+	check(s, out, "a", false)
+	if e := s.m.Outputs["out.csv"]; e.Options != "" {
+		t.Errorf("legacy output recorded with options %q", e.Options)
+	}
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	s = open(extractOptions{Update: true})
+	check(s, out, "a", true)
+	check(s, out, "", false)
+
+	// A recorded output is current while its options and stamp match.
+	s.done(out, "a")
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	s = open(extractOptions{Update: true})
+	check(s, out, "a", false)
+	check(s, out, "b", true)
+	if err := os.WriteFile(out, []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	check(s, out, "a", true)
+
+	// A changed input drops every entry; legacy outputs older than the
+	// input, or MOVs without a moov, are not trusted.
+	s.done(out, "a")
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	mov := filepath.Join(dir, "out.mov")
+	if err := os.WriteFile(mov, []byte("not a movie"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(input, time.Now().Add(time.Hour), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	s = open(extractOptions{Update: true})
+	if len(s.m.Outputs) != 0 {
+		t.Errorf("entries kept for a changed input: %v", s.m.Outputs)
+	}
+	check(s, out, "a", true)
+	if err := os.Chtimes(input, past, past); err != nil {
+		t.Fatal(err)
+	}
+	check(open(extractOptions{Update: true}), mov, "", true)
+}
@@ -0,0 +1,1012 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Minimal ISO-BMFF / QuickTime reader. Only the boxes needed to describe
+// the tracks of an OSV file and to locate their samples are decoded; raw
+// bytes of the track header boxes are kept so they can be written back
+// unchanged by the remuxer.
+
+const (
+	maxMoovSize = 1 << 30
+	// maxFixedSamples bounds the sample count of an stsz box with a fixed
+	// sample size, which has no table whose size would limit it. 2^26 is
+	// over 23 hours of 48 kHz PCM with one sample per frame.
+	maxFixedSamples = 1 << 26
+	// maxSampleSize bounds the buffer readSample allocates. Compressed
+	// 8K frames stay well below it.
+	maxSampleSize = 1 << 28
+)
+
+type mp4Box struct {
+	Type string
+	Raw  []byte // whole box including header
+	Data []byte // box body
+}
+
+func readBoxes(b []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return boxes, fmt.Errorf("truncated box header")
+		}
+		size := uint64(binary.BigEndian.Uint32(b[0:4]))
+		typ := string(b[4:8])
+		hdr := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return boxes, fmt.Errorf("truncated %s box header", typ)
+			}
+			size = binary.BigEndian.Uint64(b[8:16])
+			hdr = 16
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return boxes, fmt.Errorf("invalid %s box size %d", typ, size)
+		}
+		boxes = append(boxes, mp4Box{Type: typ, Raw: b[:size], Data: b[hdr:size]})
+		b = b[size:]
+	}
+	return boxes, nil
+}
+
+func findBox(boxes []mp4Box, typ string) *mp4Box {
+	for i := range boxes {
+		if boxes[i].Type == typ {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+type mp4File struct {
+	f    *os.File
+	Size int64
+
+	MajorBrand       string
+	MinorVersion     uint32
+	CompatibleBrands []string
+
+	Timescale    uint32
+	Duration     uint64
+	CreationTime uint64
+	Tags         map[string]string
+
+	Tracks []*mp4Track
+
+	mvhd []byte
+
+	// Position of the moov box in the file, header included.
+	moovOffset int64
+	moovSize   int64
+}
+
+type mp4Edit struct {
+	SegmentDuration uint64 // movie timescale
+	MediaTime       int64  // media timescale, -1 for an empty edit
+	MediaRate       int32  // 16.16 fixed point
+}
+
+// mp4TrackRef is one reference type of a tref box, e.g. "cdsc" from a
+// metadata track to the video it describes.
+type mp4TrackRef struct {
+	Type string
+	IDs  []uint32
+}
+
+type sttsEntry struct {
+	Count uint32
+	Delta uint32
+}
+
+type cttsEntry struct {
+	Count  uint32
+	Offset int32
+}
+
+type stscEntry struct {
+	FirstChunk      uint32
+	SamplesPerChunk uint32
+	DescIndex       uint32
+}
+
+type mp4Track struct {
+	ID           uint32
+	Handler      string
+	HandlerName  string
+	Timescale    uint32
+	Duration     uint64
+	Language     string
+	CreationTime uint64
+	Format       string
+	Width        int
+	Height       int
+	Edits        []mp4Edit
+	AudioObject  byte // MPEG-4 objectTypeIndication from esds, 0 if absent
+
+	tkhd          []byte
+	edts          []byte
+	trefs         []mp4TrackRef
+	mdhd          []byte
+	hdlr          []byte
+	mediaHeader   []byte // vmhd, smhd, nmhd or gmhd
+	dinf          []byte
+	sampleEntries [][]byte
+
+	stts         []sttsEntry
+	ctts         []cttsEntry
+	stsc         []stscEntry
+	sampleSizes  []uint32
+	chunkOffsets []uint64
+	syncSamples  []uint32 // nil when every sample is a sync sample
+}
+
+func openMP4(path string) (*mp4File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseMP4(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+func (m *mp4File) Close() error {
+	return m.f.Close()
+}
+
+func parseMP4(f *os.File) (*mp4File, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m := &mp4File{f: f, Size: fi.Size(), Tags: map[string]string{}}
+
+	var moov []byte
+	var off int64
+	hdr := make([]byte, 16)
+	for off < m.Size {
+		if m.Size-off < 8 {
+			break
+		}
+		if _, err := f.ReadAt(hdr[:8], off); err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		typ := string(hdr[4:8])
+		hsize := int64(8)
+		switch size {
+		case 0:
+			size = m.Size - off
+		case 1:
+			if _, err := f.ReadAt(hdr[8:16], off+8); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			hsize = 16
+		}
+		if size < hsize || off+size > m.Size {
+			return nil, fmt.Errorf("invalid %s box size %d at offset %d", typ, size, off)
+		}
+
+		switch typ {
+		case "ftyp", "moov":
+			if size > maxMoovSize {
+				return nil, fmt.Errorf("%s box too large (%d bytes)", typ, size)
+			}
+			body := make([]byte, size-hsize)
+			if _, err := f.ReadAt(body, off+hsize); err != nil {
+				return nil, err
+			}
+			if typ == "ftyp" {
+				m.parseFtyp(body)
+			} else {
+				moov = body
+				m.moovOffset, m.moovSize = off, size
+			}
+		case "moof":
+			return nil, fmt.Errorf("fragmented MP4 is not supported")
+		}
+		off += size
+	}
+
+	if moov == nil {
+		return nil, fmt.Errorf("moov box not found")
+	}
+	if err := m.parseMoov(moov); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *mp4File) parseFtyp(b []byte) {
+	if len(b) < 8 {
+		return
+	}
+	m.MajorBrand = string(b[0:4])
+	m.MinorVersion = binary.BigEndian.Uint32(b[4:8])
+	for i := 8; i+4 <= len(b); i += 4 {
+		m.CompatibleBrands = append(m.CompatibleBrands, string(b[i:i+4]))
+	}
+}
+
+func (m *mp4File) parseMoov(b []byte) error {
+	boxes, err := readBoxes(b)
+	if err != nil {
+		return fmt.Errorf("moov: %v", err)
+	}
+	for _, bx := range boxes {
+		switch bx.Type {
+		case "mvhd":
+			if err := m.parseMvhd(bx.Data); err != nil {
+				return err
+			}
+			m.mvhd = bx.Raw
+		case "trak":
+			t, err := parseTrak(bx.Data)
+			if err != nil {
+				return fmt.Errorf("trak %d: %v", len(m.Tracks), err)
+			}
+			m.Tracks = append(m.Tracks, t)
+		case "udta":
+			m.parseUdta(bx.Data)
+		}
+	}
+	if m.mvhd == nil {
+		return fmt.Errorf("mvhd box not found")
+	}
+	return nil
+}
+
+func (m *mp4File) parseMvhd(b []byte) error {
+	if len(b) < 4 {
+		return fmt.Errorf("mvhd: truncated")
+	}
+	if b[0] == 1 {
+		if len(b) < 32 {
+			return fmt.Errorf("mvhd: truncated")
+		}
+		m.CreationTime = binary.BigEndian.Uint64(b[4:12])
+		m.Timescale = binary.BigEndian.Uint32(b[20:24])
+		m.Duration = binary.BigEndian.Uint64(b[24:32])
+	} else {
+		if len(b) < 20 {
+			return fmt.Errorf("mvhd: truncated")
+		}
+		m.CreationTime = uint64(binary.BigEndian.Uint32(b[4:8]))
+		m.Timescale = binary.BigEndian.Uint32(b[12:16])
+		m.Duration = uint64(binary.BigEndian.Uint32(b[16:20]))
+	}
+	return nil
+}
+
+var udtaTagNames = map[string]string{
+	"\xa9nam": "title",
+	"\xa9day": "date",
+	"\xa9cmt": "comment",
+	"\xa9mak": "make",
+	"\xa9mod": "model",
+	"\xa9swr": "encoder",
+	"\xa9too": "encoder",
+	"\xa9xyz": "location",
+	"\xa9des": "description",
+}
+
+func (m *mp4File) parseUdta(b []byte) {
+	boxes, _ := readBoxes(b)
+	for _, bx := range boxes {
+		name, ok := udtaTagNames[bx.Type]
+		if !ok || len(bx.Data) < 4 {
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(bx.Data[0:2]))
+		if 4+n > len(bx.Data) {
+			n = len(bx.Data) - 4
+		}
+		m.Tags[name] = strings.TrimRight(string(bx.Data[4:4+n]), "\x00")
+	}
+}
+
+func parseTrak(b []byte) (*mp4Track, error) {
+	boxes, err := readBoxes(b)
+	if err != nil {
+		return nil, err
+	}
+	t := &mp4Track{}
+	for _, bx := range boxes {
+		switch bx.Type {
+		case "tkhd":
+			t.tkhd = bx.Raw
+			if len(bx.Data) < 1 {
+				return nil, fmt.Errorf("tkhd: truncated")
+			}
+			if bx.Data[0] == 1 && len(bx.Data) >= 24 {
+				t.ID = binary.BigEndian.Uint32(bx.Data[20:24])
+			} else if len(bx.Data) >= 16 {
+				t.ID = binary.BigEndian.Uint32(bx.Data[12:16])
+			}
+		case "edts":
+			t.edts = bx.Raw
+			if err := t.parseEdts(bx.Data); err != nil {
+				return nil, err
+			}
+		case "tref":
+			refs, err := readBoxes(bx.Data)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range refs {
+				ref := mp4TrackRef{Type: r.Type}
+				for i := 0; i+4 <= len(r.Data); i += 4 {
+					ref.IDs = append(ref.IDs, binary.BigEndian.Uint32(r.Data[i:]))
+				}
+				t.trefs = append(t.trefs, ref)
+			}
+		case "mdia":
+			if err := t.parseMdia(bx.Data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if t.mdhd == nil {
+		return nil, fmt.Errorf("mdhd box not found")
+	}
+	return t, nil
+}
+
+func (t *mp4Track) parseEdts(b []byte) error {
+	boxes, err := readBoxes(b)
+	if err != nil {
+		return err
+	}
+	elst := findBox(boxes, "elst")
+	if elst == nil {
+		return nil
+	}
+	d := elst.Data
+	if len(d) < 8 {
+		return fmt.Errorf("elst: truncated")
+	}
+	version := d[0]
+	count := int(binary.BigEndian.Uint32(d[4:8]))
+	entrySize := 12
+	if version == 1 {
+		entrySize = 20
+	}
+	if 8+count*entrySize > len(d) {
+		return fmt.Errorf("elst: truncated")
+	}
+	for i := 0; i < count; i++ {
+		e := d[8+i*entrySize:]
+		var edit mp4Edit
+		if version == 1 {
+			edit.SegmentDuration = binary.BigEndian.Uint64(e[0:8])
+			edit.MediaTime = int64(binary.BigEndian.Uint64(e[8:16]))
+			edit.MediaRate = int32(binary.BigEndian.Uint32(e[16:20]))
+		} else {
+			edit.SegmentDuration = uint64(binary.BigEndian.Uint32(e[0:4]))
+			edit.MediaTime = int64(int32(binary.BigEndian.Uint32(e[4:8])))
+			edit.MediaRate = int32(binary.BigEndian.Uint32(e[8:12]))
+		}
+		t.Edits = append(t.Edits, edit)
+	}
+	return nil
+}
+
+func (t *mp4Track) parseMdia(b []byte) error {
+	boxes, err := readBoxes(b)
+	if err != nil {
+		return err
+	}
+	for _, bx := range boxes {
+		switch bx.Type {
+		case "mdhd":
+			t.mdhd = bx.Raw
+			d := bx.Data
+			var lang uint16
+			if len(d) > 0 && d[0] == 1 {
+				if len(d) < 34 {
+					return fmt.Errorf("mdhd: truncated")
+				}
+				t.CreationTime = binary.BigEndian.Uint64(d[4:12])
+				t.Timescale = binary.BigEndian.Uint32(d[20:24])
+				t.Duration = binary.BigEndian.Uint64(d[24:32])
+				lang = binary.BigEndian.Uint16(d[32:34])
+			} else {
+				if len(d) < 22 {
+					return fmt.Errorf("mdhd: truncated")
+				}
+				t.CreationTime = uint64(binary.BigEndian.Uint32(d[4:8]))
+				t.Timescale = binary.BigEndian.Uint32(d[12:16])
+				t.Duration = uint64(binary.BigEndian.Uint32(d[16:20]))
+				lang = binary.BigEndian.Uint16(d[20:22])
+			}
+			t.Language = decodeLanguage(lang)
+		case "hdlr":
+			t.hdlr = bx.Raw
+			if len(bx.Data) >= 24 {
+				t.Handler = string(bx.Data[8:12])
+				t.HandlerName = decodeHandlerName(bx.Data[24:])
+			}
+		case "minf":
+			if err := t.parseMinf(bx.Data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func decodeLanguage(code uint16) string {
+	if code < 0x400 || code == 0x7FFF {
+		return "und"
+	}
+	return string([]byte{
+		byte(code>>10&0x1F) + 0x60,
+		byte(code>>5&0x1F) + 0x60,
+		byte(code&0x1F) + 0x60,
+	})
+}
+
+func decodeHandlerName(b []byte) string {
+	// QuickTime stores a Pascal string, ISO-BMFF a C string.
+	if len(b) > 0 && int(b[0]) == len(b)-1 {
+		b = b[1:]
+	}
+	return strings.TrimRight(string(b), "\x00")
+}
+
+func (t *mp4Track) parseMinf(b []byte) error {
+	boxes, err := readBoxes(b)
+	if err != nil {
+		return err
+	}
+	for _, bx := range boxes {
+		switch bx.Type {
+		case "vmhd", "smhd", "nmhd", "gmhd", "sthd", "hmhd":
+			t.mediaHeader = bx.Raw
+		case "dinf":
+			t.dinf = bx.Raw
+		case "stbl":
+			if err := t.parseStbl(bx.Data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *mp4Track) parseStbl(b []byte) error {
+	boxes, err := readBoxes(b)
+	if err != nil {
+		return err
+	}
+	for _, bx := range boxes {
+		d := bx.Data
+		var err error
+		switch bx.Type {
+		case "stsd":
+			err = t.parseStsd(d)
+		case "stts":
+			err = eachTableEntry(d, 8, func(e []byte) {
+				t.stts = append(t.stts, sttsEntry{
+					Count: binary.BigEndian.Uint32(e[0:4]),
+					Delta: binary.BigEndian.Uint32(e[4:8]),
+				})
+			})
+		case "ctts":
+			err = eachTableEntry(d, 8, func(e []byte) {
+				t.ctts = append(t.ctts, cttsEntry{
+					Count:  binary.BigEndian.Uint32(e[0:4]),
+					Offset: int32(binary.BigEndian.Uint32(e[4:8])),
+				})
+			})
+		case "stsc":
+			err = eachTableEntry(d, 12, func(e []byte) {
+				t.stsc = append(t.stsc, stscEntry{
+					FirstChunk:      binary.BigEndian.Uint32(e[0:4]),
+					SamplesPerChunk: binary.BigEndian.Uint32(e[4:8]),
+					DescIndex:       binary.BigEndian.Uint32(e[8:12]),
+				})
+			})
+		case "stsz":
+			err = t.parseStsz(d)
+		case "stz2":
+			err = fmt.Errorf("stz2 sample size box is not supported")
+		case "stco":
+			err = eachTableEntry(d, 4, func(e []byte) {
+				t.chunkOffsets = append(t.chunkOffsets, uint64(binary.BigEndian.Uint32(e)))
+			})
+		case "co64":
+			err = eachTableEntry(d, 8, func(e []byte) {
+				t.chunkOffsets = append(t.chunkOffsets, binary.BigEndian.Uint64(e))
+			})
+		case "stss":
+			t.syncSamples = []uint32{}
+			err = eachTableEntry(d, 4, func(e []byte) {
+				t.syncSamples = append(t.syncSamples, binary.BigEndian.Uint32(e))
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", bx.Type, err)
+		}
+	}
+	return nil
+}
+
+// eachTableEntry walks a full box holding a 32-bit entry count followed by
+// fixed-size entries.
+func eachTableEntry(d []byte, size int, fn func(e []byte)) error {
+	if len(d) < 8 {
+		return fmt.Errorf("truncated")
+	}
+	count := int(binary.BigEndian.Uint32(d[4:8]))
+	if count < 0 || count > (len(d)-8)/size {
+		return fmt.Errorf("entry count %d exceeds box size", count)
+	}
+	for i := 0; i < count; i++ {
+		fn(d[8+i*size : 8+(i+1)*size])
+	}
+	return nil
+}
+
+func (t *mp4Track) parseStsz(d []byte) error {
+	if len(d) < 12 {
+		return fmt.Errorf("truncated")
+	}
+	fixed := binary.BigEndian.Uint32(d[4:8])
+	count := int(binary.BigEndian.Uint32(d[8:12]))
+	if fixed != 0 {
+		if count > maxFixedSamples {
+			return fmt.Errorf("sample count %d too large", count)
+		}
+		t.sampleSizes = make([]uint32, count)
+		for i := range t.sampleSizes {
+			t.sampleSizes[i] = fixed
+		}
+		return nil
+	}
+	if count < 0 || count > (len(d)-12)/4 {
+		return fmt.Errorf("entry count %d exceeds box size", count)
+	}
+	t.sampleSizes = make([]uint32, count)
+	for i := range t.sampleSizes {
+		t.sampleSizes[i] = binary.BigEndian.Uint32(d[12+i*4:])
+	}
+	return nil
+}
+
+func (t *mp4Track) parseStsd(d []byte) error {
+	if len(d) < 8 {
+		return fmt.Errorf("truncated")
+	}
+	entries, err := readBoxes(d[8:])
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		t.sampleEntries = append(t.sampleEntries, e.Raw)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	first := entries[0]
+	t.Format = first.Type
+	switch t.Handler {
+	case "vide":
+		if len(first.Data) >= 28 {
+			t.Width = int(binary.BigEndian.Uint16(first.Data[24:26]))
+			t.Height = int(binary.BigEndian.Uint16(first.Data[26:28]))
+		}
+	case "soun":
+		t.AudioObject = audioObjectType(first.Data)
+	}
+	return nil
+}
+
+// audioSampleEntryChildren returns the boxes following the fixed part of an
+// audio sample entry, taking the QuickTime sound description versions into
+// account.
+func audioSampleEntryChildren(d []byte) []mp4Box {
+	if len(d) < 28 {
+		return nil
+	}
+	fixed := 28
+	switch binary.BigEndian.Uint16(d[8:10]) {
+	case 1:
+		fixed += 16
+	case 2:
+		fixed += 36
+	}
+	if fixed > len(d) {
+		return nil
+	}
+	boxes, _ := readBoxes(d[fixed:])
+	return boxes
+}
+
+func audioObjectType(d []byte) byte {
+	children := audioSampleEntryChildren(d)
+	esds := findBox(children, "esds")
+	if esds == nil {
+		if wave := findBox(children, "wave"); wave != nil {
+			inner, _ := readBoxes(wave.Data)
+			esds = findBox(inner, "esds")
+		}
+	}
+	if esds == nil || len(esds.Data) < 4 {
+		return 0
+	}
+	return esdsObjectType(esds.Data[4:])
+}
+
+// esdsObjectType walks the ES_Descriptor to the DecoderConfigDescriptor.
+func esdsObjectType(b []byte) byte {
+	readDesc := func(b []byte) (tag byte, body []byte, ok bool) {
+		if len(b) < 2 {
+			return 0, nil, false
+		}
+		tag = b[0]
+		var n int
+		i := 1
+		for ; i < len(b) && i < 5; i++ {
+			n = n<<7 | int(b[i]&0x7F)
+			if b[i]&0x80 == 0 {
+				i++
+				break
+			}
+		}
+		if i+n > len(b) {
+			return 0, nil, false
+		}
+		return tag, b[i : i+n], true
+	}
+	tag, es, ok := readDesc(b)
+	if !ok || tag != 0x03 || len(es) < 3 {
+		return 0
+	}
+	flags := es[2]
+	i := 3
+	if flags&0x80 != 0 {
+		i += 2
+	}
+	if flags&0x40 != 0 {
+		if i >= len(es) {
+			return 0
+		}
+		i += 1 + int(es[i])
+	}
+	if flags&0x20 != 0 {
+		i += 2
+	}
+	if i >= len(es) {
+		return 0
+	}
+	tag, dc, ok := readDesc(es[i:])
+	if !ok || tag != 0x04 || len(dc) < 1 {
+		return 0
+	}
+	return dc[0]
+}
+
+func (t *mp4Track) SampleCount() int {
+	return len(t.sampleSizes)
+}
+
+func (t *mp4Track) codecType() string {
+	switch t.Handler {
+	case "vide":
+		return "video"
+	case "soun":
+		return "audio"
+	case "text", "sbtl", "subt":
+		return "subtitle"
+	}
+	return "data"
+}
+
+func (t *mp4Track) codecName() string {
+	switch t.Format {
+	case "hvc1", "hev1":
+		return "hevc"
+	case "avc1", "avc3":
+		return "h264"
+	case "jpeg", "mjpa", "mjpg":
+		return "mjpeg"
+	case "png ":
+		return "png"
+	case "mp4a":
+		switch t.AudioObject {
+		case 0x69, 0x6B:
+			return "mp3"
+		}
+		return "aac"
+	case "lpcm", "sowt", "twos", "in24", "in32", "fl32":
+		return "pcm"
+	}
+	return ""
+}
+
+// frameRate guesses the nominal frame rate from the most frequent sample
+// duration, formatted like ffprobe's r_frame_rate.
+func (t *mp4Track) frameRate() string {
+	delta := t.nominalDelta()
+	if delta == 0 || t.Timescale == 0 {
+		return "0/0"
+	}
+	num, den := uint64(t.Timescale), uint64(delta)
+	g := gcd(num, den)
+	return fmt.Sprintf("%d/%d", num/g, den/g)
+}
+
+// nominalDelta returns the most frequent sample duration in media timescale.
+func (t *mp4Track) nominalDelta() uint32 {
+	var best sttsEntry
+	for _, e := range t.stts {
+		if e.Count > best.Count {
+			best = e
+		}
+	}
+	return best.Delta
+}
+
+// frameDuration returns the nominal sample duration in seconds.
+func (t *mp4Track) frameDuration() float64 {
+	if t.Timescale == 0 {
+		return 0
+	}
+	return float64(t.nominalDelta()) / float64(t.Timescale)
+}
+
+// movieTime maps a media time of t (seconds) onto the movie timeline.
+// Leading empty edits delay the track and the first non-empty edit selects
+// the media time shown at that point; later edits are not taken into
+// account.
+func (t *mp4Track) movieTime(media float64, movieTimescale uint32) float64 {
+	var start, mediaStart float64
+	for _, e := range t.Edits {
+		if e.MediaTime == -1 {
+			if movieTimescale != 0 {
+				start += float64(e.SegmentDuration) / float64(movieTimescale)
+			}
+			continue
+		}
+		mediaStart = float64(e.MediaTime) / float64(t.Timescale)
+		break
+	}
+	return start + media - mediaStart
+}
+
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func formatMP4Time(v uint64) string {
+	if v == 0 {
+		return ""
+	}
+	return mp4Epoch.Add(time.Duration(v) * time.Second).Format("2006-01-02T15:04:05.000000Z")
+}
+
+// probe converts the parsed container into the same shape ffprobe produced
+// with -show_streams -show_format.
+func (m *mp4File) probe() *probe {
+	p := &probe{}
+	for i, t := range m.Tracks {
+		s := stream{
+			Index:          i,
+			CodecName:      t.codecName(),
+			CodecType:      t.codecType(),
+			CodecTagString: t.Format,
+			Tags: map[string]any{
+				"language":     t.Language,
+				"handler_name": t.HandlerName,
+			},
+		}
+		if ct := formatMP4Time(t.CreationTime); ct != "" {
+			s.Tags["creation_time"] = ct
+		}
+		if s.CodecType == "video" {
+			s.Width = t.Width
+			s.Height = t.Height
+			s.RFrameRate = t.frameRate()
+			if s.CodecName == "mjpeg" && t.SampleCount() == 1 {
+				s.Disposition.AttachedPic = 1
+			}
+		}
+		p.Streams = append(p.Streams, s)
+	}
+
+	if m.Timescale != 0 {
+		p.Format.Duration = fmt.Sprintf("%.6f", float64(m.Duration)/float64(m.Timescale))
+	}
+	p.Format.Tags = map[string]string{}
+	for k, v := range m.Tags {
+		p.Format.Tags[k] = v
+	}
+	if m.MajorBrand != "" {
+		p.Format.Tags["major_brand"] = m.MajorBrand
+		p.Format.Tags["minor_version"] = fmt.Sprint(m.MinorVersion)
+		p.Format.Tags["compatible_brands"] = strings.Join(m.CompatibleBrands, "")
+	}
+	if ct := formatMP4Time(m.CreationTime); ct != "" {
+		p.Format.Tags["creation_time"] = ct
+	}
+	return p
+}
+
+func probeFile(path string) (*probe, error) {
+	m, err := openMP4(path)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+	return m.probe(), nil
+}
+
+type mp4Sample struct {
+	Index    int
+	Offset   uint64
+	Size     uint32
+	DTS      uint64 // media timescale
+	CTS      int64  // DTS plus composition offset
+	Duration uint32
+}
+
+type sampleIter struct {
+	t      *mp4Track
+	chunks []mp4Chunk
+	chunk  int
+	inner  int
+	offset uint64
+	dts    uint64
+
+	sttsIdx  int
+	sttsLeft uint32
+	cttsIdx  int
+	cttsLeft uint32
+}
+
+// samples returns an iterator over the samples of t in decode order.
+func (t *mp4Track) samples() (*sampleIter, error) {
+	chunks, err := t.chunks()
+	if err != nil {
+		return nil, err
+	}
+	it := &sampleIter{t: t, chunks: chunks}
+	if len(t.stts) > 0 {
+		it.sttsLeft = t.stts[0].Count
+	}
+	if len(t.ctts) > 0 {
+		it.cttsLeft = t.ctts[0].Count
+	}
+	if len(chunks) > 0 {
+		it.offset = chunks[0].Offset
+	}
+	return it, nil
+}
+
+func (it *sampleIter) Next() (mp4Sample, bool) {
+	for it.chunk < len(it.chunks) && it.inner >= it.chunks[it.chunk].Samples {
+		it.chunk++
+		it.inner = 0
+		if it.chunk < len(it.chunks) {
+			it.offset = it.chunks[it.chunk].Offset
+		}
+	}
+	if it.chunk >= len(it.chunks) {
+		return mp4Sample{}, false
+	}
+	t := it.t
+	idx := it.chunks[it.chunk].FirstSample + it.inner
+	s := mp4Sample{
+		Index:  idx,
+		Offset: it.offset,
+		Size:   t.sampleSizes[idx],
+		DTS:    it.dts,
+		CTS:    int64(it.dts),
+	}
+
+	for it.sttsLeft == 0 && it.sttsIdx+1 < len(t.stts) {
+		it.sttsIdx++
+		it.sttsLeft = t.stts[it.sttsIdx].Count
+	}
+	if it.sttsLeft > 0 {
+		s.Duration = t.stts[it.sttsIdx].Delta
+		it.sttsLeft--
+	}
+	for it.cttsLeft == 0 && it.cttsIdx+1 < len(t.ctts) {
+		it.cttsIdx++
+		it.cttsLeft = t.ctts[it.cttsIdx].Count
+	}
+	if it.cttsLeft > 0 {
+		s.CTS += int64(t.ctts[it.cttsIdx].Offset)
+		it.cttsLeft--
+	}
+
+	it.dts += uint64(s.Duration)
+	it.offset += uint64(s.Size)
+	it.inner++
+	return s, true
+}
+
+func (m *mp4File) readSample(s mp4Sample) ([]byte, error) {
+	if s.Size > maxSampleSize {
+		return nil, fmt.Errorf("sample size %d too large", s.Size)
+	}
+	if s.Offset > uint64(m.Size) || uint64(s.Size) > uint64(m.Size)-s.Offset {
+		return nil, fmt.Errorf("sample at %d (%d bytes) extends past the end of the file", s.Offset, s.Size)
+	}
+	b := make([]byte, s.Size)
+	if _, err := m.f.ReadAt(b, int64(s.Offset)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+type packet struct {
+	DTS      float64 // decode time in seconds
+	PTS      float64 // presentation time in seconds
+	Duration float64 // seconds
+	Data     []byte
+}
+
+// packetReader reads the samples of one track straight from the container
+// using its sample tables.
+type packetReader struct {
+	m     *mp4File
+	t     *mp4Track
+	index int
+	ts    float64
+	it    *sampleIter
+}
+
+func newPacketReader(m *mp4File, streamIndex int) (*packetReader, error) {
+	if streamIndex < 0 || streamIndex >= len(m.Tracks) {
+		return nil, fmt.Errorf("stream index %d out of range", streamIndex)
+	}
+	t := m.Tracks[streamIndex]
+	if t.Timescale == 0 {
+		return nil, fmt.Errorf("stream %d: zero timescale", streamIndex)
+	}
+	it, err := t.samples()
+	if err != nil {
+		return nil, fmt.Errorf("stream %d: %v", streamIndex, err)
+	}
+	return &packetReader{m: m, t: t, index: streamIndex, ts: float64(t.Timescale), it: it}, nil
+}
+
+// Read returns the next packet, or io.EOF after the last one.
+func (r *packetReader) Read() (packet, error) {
+	s, ok := r.it.Next()
+	if !ok {
+		return packet{}, io.EOF
+	}
+	b, err := r.m.readSample(s)
+	if err != nil {
+		return packet{}, fmt.Errorf("stream %d sample %d: %v", r.index, s.Index, err)
+	}
+	return packet{
+		DTS:      float64(s.DTS) / r.ts,
+		PTS:      float64(s.CTS) / r.ts,
+		Duration: float64(s.Duration) / r.ts,
+		Data:     b,
+	}, nil
+}
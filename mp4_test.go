@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadSampleBounds(t *testing.T) {
+	tests := []struct {
+		size uint32
+		want string
+	}{
+		{0xf0000000, "too large"},
+		{1 << 20, "past the end of the file"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "bad.mp4")
+		// The stsz size disagrees with the data actually in mdat.
+		writeTestMP4(t, path, []*testTrack{{
+			handler:  "meta",
+			entry:    makeBox("djmd", make([]byte, 8)),
+			mdhd:     makeFullBox("mdhd", 0, 0, u32s(0, 0, 1000, 10), []byte{0x55, 0xc4, 0, 0}),
+			stts:     []sttsEntry{{1, 10}},
+			sizes:    []uint32{tt.size},
+			perChunk: 1,
+			samples:  [][]byte{make([]byte, 16)},
+		}})
+		m, err := openMP4(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pr, err := newPacketReader(m, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pr.Read(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("size %d: error %v, want %q", tt.size, err, tt.want)
+		}
+		m.Close()
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+)
+
+// Fused orientation export. The quaternion rotates vectors from the IMU
+// frame (X forward, Y left, Z up) into the earth frame (Z up, X the
+// starting heading projected onto the horizontal plane), so it is the
+// camera's attitude; the Euler angles are derived from it.
+//
+// At frame rate, each row holds the orientation at the first IMU record of
+// a front lens video frame; at sample rate, every record gets a row. A file
+// without video has no frames and is written at sample rate.
+
+type orientationOptions struct {
+	Format string // csv|json
+	Rate   string // frame|sample
+	Filter string
+	Gain   float64
+}
+
+// orientationHeader holds the JSON fields that precede the samples.
+type orientationHeader struct {
+	Filter string  `json:"filter"`
+	Gain   float64 `json:"gain"`
+	Rate   string  `json:"rate"`
+	Axes   string  `json:"axes"`
+}
+
+type orientationRow struct {
+	T      float64    `json:"t"`
+	Frame  int        `json:"frame"`
+	Sample int        `json:"sample"`
+	Q      quat       `json:"q"`
+	YPR    [3]float64 `json:"ypr"`
+}
+
+func writeOrientation(input string, djmd []int, videoIndex int, out string, o orientationOptions) (int, error) {
+	f, err := newFusionFilter(o.Filter, o.Gain)
+	if err != nil {
+		return 0, err
+	}
+	m, err := openMP4(input)
+	if err != nil {
+		return 0, err
+	}
+	defer m.Close()
+	if err := checkIMUPlausible(m, djmd); err != nil {
+		return 0, err
+	}
+	r := newIMUReader(m, djmd)
+	if err := r.alignTo(videoIndex); err != nil {
+		return 0, err
+	}
+	if videoIndex < 0 {
+		o.Rate = "sample"
+	} else if o.Rate == "frame" && r.frameDuration <= 0 {
+		return 0, fmt.Errorf("video stream %d: frame duration unknown, cannot write orientation per frame", videoIndex)
+	}
+
+	file, err := createOutput(out)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+
+	if o.Format == "json" {
+		// The samples are streamed into the object rather than collected,
+		// so the header is written without its closing brace.
+		b, err := json.MarshalIndent(orientationHeader{
+			Filter: o.Filter,
+			Gain:   fusionGain(o.Filter, o.Gain),
+			Rate:   o.Rate,
+			Axes:   "imu x forward, y left, z up",
+		}, "", "  ")
+		if err != nil {
+			return 0, err
+		}
+		w.Write(b[:len(b)-len("\n}")])
+		w.WriteString(",\n  \"samples\": [")
+	} else {
+		fmt.Fprintf(w, "VideoTime(s),Frame,SampleIndex,QuatW,QuatX,QuatY,QuatZ,Yaw(deg),Pitch(deg),Roll(deg)\n")
+	}
+
+	rows, lastFrame := 0, -1
+	err = fuseIMU(r, f, func(rec IMURecord, q quat) error {
+		if o.Rate == "frame" {
+			if rec.VideoTime < 0 || rec.Frame <= lastFrame {
+				return nil
+			}
+			lastFrame = rec.Frame
+		}
+		yaw, pitch, roll := q.euler()
+		if o.Format == "json" {
+			b, err := json.Marshal(orientationRow{rec.VideoTime, rec.Frame, rec.SampleIndex, q, [3]float64{yaw, pitch, roll}})
+			if err != nil {
+				return err
+			}
+			if rows > 0 {
+				w.WriteString(",")
+			}
+			w.WriteString("\n    ")
+			w.Write(b)
+		} else {
+			fmt.Fprintf(w, "%.6f,%d,%d,%.8f,%.8f,%.8f,%.8f,%.4f,%.4f,%.4f\n",
+				rec.VideoTime, rec.Frame, rec.SampleIndex, q[0], q[1], q[2], q[3], yaw, pitch, roll)
+		}
+		rows++
+		return nil
+	})
+	if err != nil {
+		return rows, err
+	}
+	if o.Format == "json" {
+		w.WriteString("\n  ]\n}\n")
+	}
+	if err := w.Flush(); err != nil {
+		return rows, err
+	}
+	return rows, file.Commit()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testIMUPacket encodes a djmd packet with a header block and one record
+// per entry of chans.
+func testIMUPacket(rate, gyroRange, accelRange uint32, tick uint32, chans [][10]int16) []byte {
+	var hdr []byte
+	for _, v := range []uint32{rate, gyroRange, accelRange, 0, 0} {
+		hdr = binary.LittleEndian.AppendUint32(hdr, v)
+	}
+	var recs []byte
+	for i, c := range chans {
+		recs = binary.LittleEndian.AppendUint32(recs, tick+uint32(i)*1_000_000/rate)
+		for _, v := range c {
+			recs = binary.LittleEndian.AppendUint16(recs, uint16(v))
+		}
+	}
+	return pbBytes(3, pbBytes(2, hdr), pbBytes(3, recs))
+}
+
+// testStillIMU returns a djmd track of n packets of 40 records at 400 Hz
+// from a camera lying still, Z up, with 2000 deg/s and 8 g full scale.
+func testStillIMU(n int) *testTrack {
+	tr := &testTrack{
+		handler:  "meta",
+		entry:    makeBox("djmd", make([]byte, 8)),
+		mdhd:     makeFullBox("mdhd", 0, 0, u32s(0, 0, 1000, uint32(n*100)), []byte{0x55, 0xc4, 0, 0}),
+		stts:     []sttsEntry{{uint32(n), 100}},
+		perChunk: 1,
+	}
+	for p := 0; p < n; p++ {
+		chans := make([][10]int16, 40)
+		for i := range chans {
+			chans[i][5] = 4096 // 1 g
+		}
+		b := testIMUPacket(400, 2000, 8, uint32(p*100_000), chans)
+		tr.samples = append(tr.samples, b)
+		tr.sizes = append(tr.sizes, uint32(len(b)))
+	}
+	return tr
+}
+
+func testVideoTrack(frames, delta uint32) *testTrack {
+	sizes := make([]uint32, frames)
+	for i := range sizes {
+		sizes[i] = 8
+	}
+	return &testTrack{
+		handler:  "vide",
+		entry:    makeBox("avc1", make([]byte, 78)),
+		mdhd:     makeFullBox("mdhd", 0, 0, u32s(0, 0, 90000, frames*delta), []byte{0x55, 0xc4, 0, 0}),
+		stts:     []sttsEntry{{frames, delta}},
+		sizes:    sizes,
+		perChunk: int(frames),
+		samples:  testSamples(0, sizes),
+	}
+}
+
+func TestWriteOrientation(t *testing.T) {
+	tests := []struct {
+		name       string
+		video      *testTrack
+		videoIndex int
+		rate       string
+		rows       int // -1: error
+	}{
+		{"per frame", testVideoTrack(12, 3000), 0, "frame", 12},
+		{"per sample", testVideoTrack(12, 3000), 0, "sample", 160},
+		{"no video", testVideoTrack(12, 3000), -1, "frame", 160},
+		{"zero frame duration", testVideoTrack(12, 0), 0, "frame", -1},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		in := filepath.Join(dir, "in.mp4")
+		writeTestMP4(t, in, []*testTrack{tt.video, testStillIMU(4)})
+		out := filepath.Join(dir, "orientation.csv")
+		rows, err := writeOrientation(in, []int{1}, tt.videoIndex, out,
+			orientationOptions{Format: "csv", Rate: tt.rate, Filter: "madgwick"})
+		if tt.rows < 0 {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			if _, err := os.Stat(out); !os.IsNotExist(err) {
+				t.Errorf("%s: output written", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		b, _ := os.ReadFile(out)
+		if lines := strings.Count(string(b), "\n") - 1; rows != tt.rows || lines != tt.rows {
+			t.Errorf("%s: %d rows, %d lines, want %d", tt.name, rows, lines, tt.rows)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Outputs are written under a partial name next to their final path and
+// renamed into place only once complete and flushed to disk, so a file
+// under its final name is always whole: a crash, a full disk or an
+// interrupt leaves at most a partial file, which the next run overwrites.
+
+// partialPath returns the name an output is written under until it is
+// complete. The extension is kept for tools that pick the format from it.
+func partialPath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + ".partial" + ext
+}
+
+// finishPartial moves the partial file of path, written by another process
+// such as ffmpeg, to its final name if err is nil and removes it otherwise.
+// It returns err or the error of the move.
+func finishPartial(path string, err error) error {
+	tmp := partialPath(path)
+	if err == nil {
+		err = syncFile(tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return commitPartial(tmp, path)
+}
+
+// outputFile is an output file being written under its partial name.
+type outputFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+func createOutput(path string) (*outputFile, error) {
+	f, err := os.Create(partialPath(path))
+	if err != nil {
+		return nil, err
+	}
+	return &outputFile{File: f, path: path}, nil
+}
+
+// Commit flushes the file to disk, closes it and renames it to its final
+// name. The file is removed if any step fails.
+func (f *outputFile) Commit() error {
+	if f.done {
+		return os.ErrClosed
+	}
+	f.done = true
+	err := f.Sync()
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return commitPartial(f.Name(), f.path)
+}
+
+// Close closes and removes the file unless it has been committed, so that
+// deferring it cleans up after any error.
+func (f *outputFile) Close() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// writeOutputFile is os.WriteFile through a partial file.
+func writeOutputFile(path string, data []byte) error {
+	f, err := createOutput(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+func commitPartial(tmp, path string) error {
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir makes a rename in dir durable. Not every platform can sync a
+// directory (Windows cannot open one), so it is best effort.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
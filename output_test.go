@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartialPath(t *testing.T) {
+	for in, want := range map[string]string{
+		"a/b.mov":       "a/b.partial.mov",
+		"a/b.tar.gz":    "a/b.tar.partial.gz",
+		"a/noext":       "a/noext.partial",
+		".osv2mov.json": ".osv2mov.partial.json",
+	} {
+		if got := partialPath(in); got != want {
+			t.Errorf("partialPath(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	dir := t.TempDir()
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	// A committed file appears under its final name only.
+	out := filepath.Join(dir, "a.csv")
+	f, err := createOutput(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("data")
+	if exists(out) || !exists(partialPath(out)) {
+		t.Fatal("output not written under its partial name")
+	}
+	if err := f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(out); err != nil || string(b) != "data" {
+		t.Errorf("committed output %q, %v", b, err)
+	}
+	if exists(partialPath(out)) {
+		t.Errorf("partial file left behind after commit")
+	}
+	if err := f.Close(); err != nil || !exists(out) {
+		t.Errorf("Close after Commit: %v, output exists %v", err, exists(out))
+	}
+	if err := f.Commit(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("second Commit: %v", err)
+	}
+
+	// Closing without a commit removes the partial file and leaves an
+	// existing output alone.
+	f, err = createOutput(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("truncated")
+	f.Close()
+	if exists(partialPath(out)) {
+		t.Errorf("partial file left behind after close")
+	}
+	if b, _ := os.ReadFile(out); string(b) != "data" {
+		t.Errorf("output replaced by an uncommitted file: %q", b)
+	}
+
+	// A failed rename removes the partial file.
+	blocked := filepath.Join(dir, "blocked.csv")
+	if err := os.MkdirAll(filepath.Join(blocked, "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeOutputFile(blocked, []byte("data")); err == nil {
+		t.Errorf("writeOutputFile over a directory succeeded")
+	}
+	if exists(partialPath(blocked)) {
+		t.Errorf("partial file left behind after a failed rename")
+	}
+}
+
+func TestFinishPartial(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.mp4")
+	for _, fail := range []bool{true, false} {
+		if err := os.WriteFile(partialPath(out), []byte("video"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if fail {
+			err = errInterrupted
+		}
+		if got := finishPartial(out, err); got != err {
+			t.Errorf("finishPartial(%v) = %v", err, got)
+		}
+		if _, err := os.Stat(partialPath(out)); !os.IsNotExist(err) {
+			t.Errorf("fail=%v: partial file left behind", fail)
+		}
+		if _, err := os.Stat(out); (err == nil) == fail {
+			t.Errorf("fail=%v: output exists: %v", fail, err == nil)
+		}
+	}
+	if err := finishPartial(filepath.Join(dir, "missing.mp4"), nil); err == nil {
+		t.Errorf("finishPartial without a partial file succeeded")
+	}
+}
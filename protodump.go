@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"osv2mov/internal/protowire"
+)
+
+func cmdProtodumpWithFlags() {
+	fs := flag.NewFlagSet("protodump", flag.ExitOnError)
+
+	streamIndex := fs.Int("s", -1, "Stream index (default: first djmd stream)")
+	streamIndexLong := fs.Int("stream", -1, "Stream index (default: first djmd stream)")
+
+	first := fs.Int("p", 0, "Index of the first packet to dump")
+	firstLong := fs.Int("packet", 0, "Index of the first packet to dump")
+
+	count := fs.Int("n", 1, "Number of packets to dump")
+	countLong := fs.Int("count", 1, "Number of packets to dump")
+
+	depth := fs.Int("d", 8, "Maximum nesting depth")
+	depthLong := fs.Int("depth", 8, "Maximum nesting depth")
+
+	protoFile := fs.String("proto", "", "Schema: .proto file or FileDescriptorSet")
+	msgName := fs.String("msg", "", "Message type to decode packets as (requires -proto)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: osv2mov protodump [options] <input.osv> or <packet.bin>\n")
+		fmt.Fprintf(os.Stderr, "   or: osv2mov pd [options] <input.osv> or <packet.bin>\n\n")
+		fmt.Fprintf(os.Stderr, "Prints djmd/dbgi packets as a protobuf field tree without a schema.\n")
+		fmt.Fprintf(os.Stderr, "Files that are not MP4/MOV containers are dumped as one message.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fmt.Fprintf(os.Stderr, "  -s, -stream int\n")
+		fmt.Fprintf(os.Stderr, "         Stream index (default: first djmd stream)\n")
+		fmt.Fprintf(os.Stderr, "  -p, -packet int\n")
+		fmt.Fprintf(os.Stderr, "         Index of the first packet to dump (default: 0)\n")
+		fmt.Fprintf(os.Stderr, "  -n, -count int\n")
+		fmt.Fprintf(os.Stderr, "         Number of packets to dump (default: 1)\n")
+		fmt.Fprintf(os.Stderr, "  -d, -depth int\n")
+		fmt.Fprintf(os.Stderr, "         Maximum nesting depth (default: 8)\n")
+		fmt.Fprintf(os.Stderr, "  -proto string\n")
+		fmt.Fprintf(os.Stderr, "         Schema: .proto file or FileDescriptorSet\n")
+		fmt.Fprintf(os.Stderr, "  -msg string\n")
+		fmt.Fprintf(os.Stderr, "         Message type to decode packets as; prints JSON instead of a field tree\n")
+		fmt.Fprintf(os.Stderr, "  -h, -help\n")
+		fmt.Fprintf(os.Stderr, "         Show this help\n\n")
+		fmt.Fprintf(os.Stderr, "Examples:\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov protodump input.osv\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov pd -s 4 -p 10 -n 3 input.osv\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov pd input_djmd_0.bin\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov pd -proto osmo.proto -msg FrameMeta input.osv\n")
+	}
+
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		os.Exit(2)
+	}
+
+	args := fs.Args()
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Error: Input file not specified")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	pick := func(short, long *int, def int) int {
+		if *short != def {
+			return *short
+		}
+		return *long
+	}
+	opts := protodumpOptions{
+		Stream: pick(streamIndex, streamIndexLong, -1),
+		First:  pick(first, firstLong, 0),
+		Count:  pick(count, countLong, 1),
+		Depth:  pick(depth, depthLong, 8),
+	}
+
+	if (*protoFile == "") != (*msgName == "") {
+		fmt.Fprintln(os.Stderr, "Error: -proto and -msg must be given together")
+		os.Exit(2)
+	}
+	if *protoFile != "" {
+		schema, err := loadProtoSchema(*protoFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		if opts.Msg, err = schema.message(*msgName); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		opts.Schema = schema
+	}
+
+	if err := cmdProtodump(args[0], opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+type protodumpOptions struct {
+	Stream int
+	First  int
+	Count  int
+	Depth  int
+	Schema *protoSchema
+	Msg    *protoMessage
+}
+
+func cmdProtodump(path string, opts protodumpOptions) error {
+	m, err := openMP4(path)
+	if err != nil {
+		// Not a container: treat the file as a raw packet dump.
+		b, rerr := os.ReadFile(path)
+		if rerr != nil {
+			return rerr
+		}
+		fmt.Printf("%s (%d bytes)\n", path, len(b))
+		return dumpPacket(b, opts)
+	}
+	defer m.Close()
+
+	idx := opts.Stream
+	if idx < 0 {
+		for i, t := range m.Tracks {
+			if t.Format == "djmd" {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return fmt.Errorf("no djmd stream found; select one with -s")
+		}
+	}
+	pr, err := newPacketReader(m, idx)
+	if err != nil {
+		return err
+	}
+	for n := 0; n < opts.First+opts.Count; n++ {
+		p, err := pr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if n < opts.First {
+			continue
+		}
+		fmt.Printf("packet %d (stream %d %s, pts %.6f, %d bytes)\n", n, idx, m.Tracks[idx].Format, p.PTS, len(p.Data))
+		if err := dumpPacket(p.Data, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpPacket prints b as JSON when a schema is given, or as a field tree.
+func dumpPacket(b []byte, opts protodumpOptions) error {
+	if opts.Schema == nil {
+		dumpProto(os.Stdout, b, 1, opts.Depth)
+		return nil
+	}
+	v, err := opts.Schema.decode(opts.Msg, b)
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", out)
+	return nil
+}
+
+const dumpPreview = 8
+
+// dumpProto prints b as a field tree, descending into length-delimited
+// fields that look like nested messages.
+func dumpProto(w io.Writer, b []byte, indent, depth int) {
+	pad := strings.Repeat("  ", indent)
+	fields, err := protowire.Parse(b)
+	for _, f := range fields {
+		switch f.Wire {
+		case protowire.VarintType:
+			fmt.Fprintf(w, "%s%d: varint %d", pad, f.Num, f.Value)
+			if z := protowire.Zigzag(f.Value); f.Value > 1 && z < 0 {
+				fmt.Fprintf(w, " (zigzag %d)", z)
+			}
+			fmt.Fprintln(w)
+		case protowire.Fixed32Type:
+			v := uint32(f.Value)
+			fmt.Fprintf(w, "%s%d: fixed32 %d (int32 %d, float %g)\n", pad, f.Num, v, int32(v), math.Float32frombits(v))
+		case protowire.Fixed64Type:
+			fmt.Fprintf(w, "%s%d: fixed64 %d (int64 %d, double %g)\n", pad, f.Num, f.Value, int64(f.Value), math.Float64frombits(f.Value))
+		case protowire.BytesType:
+			dumpBytesField(w, f, pad, indent, depth)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s! %v\n", pad, err)
+	}
+}
+
+func dumpBytesField(w io.Writer, f protowire.Field, pad string, indent, depth int) {
+	kind := protowire.GuessKind(f.Bytes)
+	if kind == protowire.KindMessage && indent >= depth {
+		kind = protowire.KindBytes
+	}
+	fmt.Fprintf(w, "%s%d: bytes[%d] %s", pad, f.Num, len(f.Bytes), kind)
+	switch kind {
+	case protowire.KindMessage:
+		fmt.Fprintln(w)
+		dumpProto(w, f.Bytes, indent+1, depth)
+	case protowire.KindString:
+		fmt.Fprintf(w, " %q\n", f.Bytes)
+	case protowire.KindFloats:
+		n := len(f.Bytes) / 4
+		var ints, floats []string
+		for i := 0; i < n && i < dumpPreview; i++ {
+			v := binary.LittleEndian.Uint32(f.Bytes[i*4:])
+			ints = append(ints, fmt.Sprint(int32(v)))
+			floats = append(floats, fmt.Sprintf("%g", math.Float32frombits(v)))
+		}
+		more := ""
+		if n > dumpPreview {
+			more = " ..."
+		}
+		fmt.Fprintf(w, " [%d]\n%s  int32: %s%s\n%s  float: %s%s\n%s  hex: %s\n",
+			n, pad, strings.Join(ints, " "), more, pad, strings.Join(floats, " "), more, pad, hexPreview(f.Bytes))
+	case protowire.KindVarints:
+		vals, _ := protowire.PackedVarints(f.Bytes)
+		var parts []string
+		for i := 0; i < len(vals) && i < dumpPreview; i++ {
+			parts = append(parts, fmt.Sprint(vals[i]))
+		}
+		more := ""
+		if len(vals) > dumpPreview {
+			more = " ..."
+		}
+		fmt.Fprintf(w, " [%d] %s%s\n", len(vals), strings.Join(parts, " "), more)
+	default:
+		fmt.Fprintf(w, " %s\n", hexPreview(f.Bytes))
+	}
+}
+
+func hexPreview(b []byte) string {
+	const max = 32
+	if len(b) > max {
+		return hex.EncodeToString(b[:max]) + "..."
+	}
+	return hex.EncodeToString(b)
+}
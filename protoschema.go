@@ -0,0 +1,1041 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"osv2mov/internal/protowire"
+)
+
+// User-supplied protobuf schemas. A schema is loaded either from a .proto
+// source file (proto2/proto3 messages, enums, oneofs and maps; imports are
+// not followed) or from a compiled FileDescriptorSet as produced by
+// `protoc --descriptor_set_out`. Packets are then decoded into JSON using
+// the field names of the schema.
+
+type protoSchema struct {
+	messages map[string]*protoMessage // keyed by full name without leading dot
+	enums    map[string]*protoEnum
+}
+
+type protoMessage struct {
+	Name   string
+	Fields map[int]*protoFieldDesc
+}
+
+type protoFieldDesc struct {
+	Name     string
+	Number   int
+	Type     string // scalar type name, "message" or "enum"
+	TypeName string // full name of the message or enum type
+	Repeated bool
+
+	scope   string // message the field was declared in, for resolution
+	rawType string
+}
+
+type protoEnum struct {
+	Name   string
+	Values map[int32]string
+}
+
+var protoScalarTypes = map[string]bool{
+	"double": true, "float": true, "int32": true, "int64": true,
+	"uint32": true, "uint64": true, "sint32": true, "sint64": true,
+	"fixed32": true, "fixed64": true, "sfixed32": true, "sfixed64": true,
+	"bool": true, "string": true, "bytes": true,
+}
+
+func newProtoSchema() *protoSchema {
+	return &protoSchema{messages: map[string]*protoMessage{}, enums: map[string]*protoEnum{}}
+}
+
+// loadProtoSchema reads a .proto file or a FileDescriptorSet, telling them
+// apart by content.
+func loadProtoSchema(path string) (*protoSchema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s *protoSchema
+	if strings.HasSuffix(strings.ToLower(path), ".proto") || protowire.IsPrintable(b) {
+		s, err = parseProtoSource(string(b))
+	} else {
+		s, err = parseDescriptorSet(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(s.messages) == 0 {
+		return nil, fmt.Errorf("%s: no message types defined", path)
+	}
+	return s, nil
+}
+
+// message looks up a message by full name, or by a unique trailing part of
+// its name.
+func (s *protoSchema) message(name string) (*protoMessage, error) {
+	name = strings.TrimPrefix(name, ".")
+	if m, ok := s.messages[name]; ok {
+		return m, nil
+	}
+	var found *protoMessage
+	for full, m := range s.messages {
+		if strings.HasSuffix(full, "."+name) {
+			if found != nil {
+				return nil, fmt.Errorf("message name %q is ambiguous", name)
+			}
+			found = m
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("message %q not found in schema", name)
+	}
+	return found, nil
+}
+
+// resolve binds message and enum field types to their full names following
+// protobuf scoping rules: the innermost enclosing scope wins.
+func (s *protoSchema) resolve() error {
+	for _, m := range s.messages {
+		for _, f := range m.Fields {
+			if f.Type != "" {
+				continue
+			}
+			full, kind := s.lookupType(f.scope, f.rawType)
+			if kind == "" {
+				return fmt.Errorf("%s.%s: unknown type %q", m.Name, f.Name, f.rawType)
+			}
+			f.Type, f.TypeName = kind, full
+		}
+	}
+	return nil
+}
+
+func (s *protoSchema) lookupType(scope, name string) (string, string) {
+	kindOf := func(full string) string {
+		if _, ok := s.messages[full]; ok {
+			return "message"
+		}
+		if _, ok := s.enums[full]; ok {
+			return "enum"
+		}
+		return ""
+	}
+	if strings.HasPrefix(name, ".") {
+		full := name[1:]
+		return full, kindOf(full)
+	}
+	for {
+		full := name
+		if scope != "" {
+			full = scope + "." + name
+		}
+		if k := kindOf(full); k != "" {
+			return full, k
+		}
+		if scope == "" {
+			return "", ""
+		}
+		if i := strings.LastIndex(scope, "."); i >= 0 {
+			scope = scope[:i]
+		} else {
+			scope = ""
+		}
+	}
+}
+
+// ---- .proto source ----
+
+type protoToken struct {
+	text string
+	line int
+	str  bool // quoted string literal
+}
+
+func tokenizeProto(src string) ([]protoToken, error) {
+	var toks []protoToken
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			toks = append(toks, protoToken{text: src[i+1 : j], line: line, str: true})
+			i = j + 1
+		case isProtoIdentChar(c):
+			j := i
+			for j < len(src) && (isProtoIdentChar(src[j]) || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, protoToken{text: src[i:j], line: line})
+			i = j
+		case c == '.' && i+1 < len(src) && isProtoIdentChar(src[i+1]):
+			j := i + 1
+			for j < len(src) && (isProtoIdentChar(src[j]) || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, protoToken{text: src[i:j], line: line})
+			i = j
+		default:
+			toks = append(toks, protoToken{text: string(c), line: line})
+			i++
+		}
+	}
+	return toks, nil
+}
+
+func isProtoIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+type protoParser struct {
+	toks   []protoToken
+	pos    int
+	pkg    string
+	schema *protoSchema
+}
+
+func parseProtoSource(src string) (*protoSchema, error) {
+	toks, err := tokenizeProto(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &protoParser{toks: toks, schema: newProtoSchema()}
+	if err := p.parseFile(); err != nil {
+		return nil, err
+	}
+	if err := p.schema.resolve(); err != nil {
+		return nil, err
+	}
+	return p.schema, nil
+}
+
+func (p *protoParser) peek() string {
+	if p.pos >= len(p.toks) {
+		return ""
+	}
+	return p.toks[p.pos].text
+}
+
+func (p *protoParser) next() (protoToken, error) {
+	if p.pos >= len(p.toks) {
+		return protoToken{}, fmt.Errorf("unexpected end of file")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *protoParser) errorf(format string, args ...any) error {
+	line := 0
+	if p.pos > 0 && p.pos <= len(p.toks) {
+		line = p.toks[p.pos-1].line
+	}
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *protoParser) expect(text string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if t.text != text || t.str {
+		return p.errorf("expected %q, found %q", text, t.text)
+	}
+	return nil
+}
+
+// skipStatement skips to the end of the current statement, stepping over
+// aggregate option values in braces.
+func (p *protoParser) skipStatement() error {
+	depth := 0
+	for {
+		t, err := p.next()
+		if err != nil {
+			return err
+		}
+		if t.str {
+			continue
+		}
+		switch t.text {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 && p.peek() != ";" {
+				return nil
+			}
+		case ";":
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+func (p *protoParser) skipBlock() error {
+	for p.peek() != "{" {
+		if _, err := p.next(); err != nil {
+			return err
+		}
+	}
+	depth := 0
+	for {
+		t, err := p.next()
+		if err != nil {
+			return err
+		}
+		if t.str {
+			continue
+		}
+		switch t.text {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+func (p *protoParser) parseFile() error {
+	for p.pos < len(p.toks) {
+		t, _ := p.next()
+		switch t.text {
+		case ";":
+		case "syntax", "edition", "import", "option":
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		case "package":
+			name, err := p.next()
+			if err != nil {
+				return err
+			}
+			p.pkg = name.text
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+		case "message":
+			if err := p.parseMessage(p.pkg); err != nil {
+				return err
+			}
+		case "enum":
+			if err := p.parseEnum(p.pkg); err != nil {
+				return err
+			}
+		case "service", "extend":
+			if err := p.skipBlock(); err != nil {
+				return err
+			}
+		default:
+			return p.errorf("unexpected %q", t.text)
+		}
+	}
+	return nil
+}
+
+func joinProtoName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+func (p *protoParser) parseMessage(scope string) error {
+	name, err := p.next()
+	if err != nil {
+		return err
+	}
+	full := joinProtoName(scope, name.text)
+	msg := &protoMessage{Name: full, Fields: map[int]*protoFieldDesc{}}
+	p.schema.messages[full] = msg
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	return p.parseMessageBody(msg, full, "}")
+}
+
+func (p *protoParser) parseMessageBody(msg *protoMessage, full, end string) error {
+	for {
+		switch p.peek() {
+		case "":
+			return p.errorf("unexpected end of file in message %s", full)
+		case end:
+			p.pos++
+			return nil
+		case ";":
+			p.pos++
+		case "message":
+			p.pos++
+			if err := p.parseMessage(full); err != nil {
+				return err
+			}
+		case "enum":
+			p.pos++
+			if err := p.parseEnum(full); err != nil {
+				return err
+			}
+		case "oneof":
+			p.pos += 2
+			if err := p.expect("{"); err != nil {
+				return err
+			}
+			if err := p.parseMessageBody(msg, full, "}"); err != nil {
+				return err
+			}
+		case "option", "reserved", "extensions":
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		case "extend":
+			if err := p.skipBlock(); err != nil {
+				return err
+			}
+		case "map":
+			p.pos++
+			if err := p.parseMapField(msg, full); err != nil {
+				return err
+			}
+		default:
+			if err := p.parseField(msg, full); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *protoParser) parseField(msg *protoMessage, scope string) error {
+	f := &protoFieldDesc{scope: scope}
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	switch t.text {
+	case "repeated":
+		f.Repeated = true
+		t, err = p.next()
+	case "optional", "required":
+		t, err = p.next()
+	}
+	if err != nil {
+		return err
+	}
+	if t.text == "group" {
+		return p.errorf("groups are not supported")
+	}
+	if protoScalarTypes[t.text] {
+		f.Type = t.text
+	} else {
+		f.rawType = t.text
+	}
+	name, err := p.next()
+	if err != nil {
+		return err
+	}
+	f.Name = name.text
+	if err := p.expect("="); err != nil {
+		return err
+	}
+	num, err := p.next()
+	if err != nil {
+		return err
+	}
+	n, err := strconv.ParseInt(num.text, 0, 32)
+	if err != nil || n <= 0 {
+		return p.errorf("invalid field number %q", num.text)
+	}
+	f.Number = int(n)
+	if p.peek() == "[" {
+		// Field options such as packed do not change decoding: packed and
+		// unpacked encodings are both accepted.
+		for {
+			t, err := p.next()
+			if err != nil {
+				return err
+			}
+			if t.text == "]" && !t.str {
+				break
+			}
+		}
+	}
+	if err := p.expect(";"); err != nil {
+		return err
+	}
+	msg.Fields[f.Number] = f
+	return nil
+}
+
+func (p *protoParser) parseMapField(msg *protoMessage, scope string) error {
+	if err := p.expect("<"); err != nil {
+		return err
+	}
+	key, err := p.next()
+	if err != nil {
+		return err
+	}
+	if err := p.expect(","); err != nil {
+		return err
+	}
+	val, err := p.next()
+	if err != nil {
+		return err
+	}
+	if err := p.expect(">"); err != nil {
+		return err
+	}
+	name, err := p.next()
+	if err != nil {
+		return err
+	}
+	// A map is encoded as a repeated entry message with key = 1, value = 2.
+	entryName := joinProtoName(scope, protoMapEntryName(name.text))
+	entry := &protoMessage{Name: entryName, Fields: map[int]*protoFieldDesc{
+		1: {Name: "key", Number: 1, Type: key.text, scope: scope},
+		2: {Name: "value", Number: 2, scope: scope},
+	}}
+	if protoScalarTypes[val.text] {
+		entry.Fields[2].Type = val.text
+	} else {
+		entry.Fields[2].rawType = val.text
+	}
+	p.schema.messages[entryName] = entry
+
+	f := &protoFieldDesc{Name: name.text, Repeated: true, Type: "message", TypeName: entryName}
+	if err := p.expect("="); err != nil {
+		return err
+	}
+	num, err := p.next()
+	if err != nil {
+		return err
+	}
+	n, err := strconv.ParseInt(num.text, 0, 32)
+	if err != nil || n <= 0 {
+		return p.errorf("invalid field number %q", num.text)
+	}
+	f.Number = int(n)
+	if p.peek() == "[" {
+		for {
+			t, err := p.next()
+			if err != nil {
+				return err
+			}
+			if t.text == "]" && !t.str {
+				break
+			}
+		}
+	}
+	if err := p.expect(";"); err != nil {
+		return err
+	}
+	msg.Fields[f.Number] = f
+	return nil
+}
+
+// protoMapEntryName returns the name protoc gives the entry message of a
+// map field: the field name in CamelCase with "Entry" appended, so that
+// tag_counts becomes TagCountsEntry.
+func protoMapEntryName(field string) string {
+	var b strings.Builder
+	upper := true
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		switch {
+		case c == '_':
+			upper = true
+			continue
+		case upper && c >= 'a' && c <= 'z':
+			c -= 'a' - 'A'
+		}
+		b.WriteByte(c)
+		upper = false
+	}
+	return b.String() + "Entry"
+}
+
+func (p *protoParser) parseEnum(scope string) error {
+	name, err := p.next()
+	if err != nil {
+		return err
+	}
+	full := joinProtoName(scope, name.text)
+	e := &protoEnum{Name: full, Values: map[int32]string{}}
+	p.schema.enums[full] = e
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	for {
+		switch p.peek() {
+		case "":
+			return p.errorf("unexpected end of file in enum %s", full)
+		case "}":
+			p.pos++
+			return nil
+		case ";":
+			p.pos++
+		case "option", "reserved":
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		default:
+			vname, _ := p.next()
+			if err := p.expect("="); err != nil {
+				return err
+			}
+			num, err := p.next()
+			if err != nil {
+				return err
+			}
+			text := num.text
+			if text == "-" {
+				num, err = p.next()
+				if err != nil {
+					return err
+				}
+				text = "-" + num.text
+			}
+			v, err := strconv.ParseInt(text, 0, 32)
+			if err != nil {
+				return p.errorf("invalid enum value %q", text)
+			}
+			if _, dup := e.Values[int32(v)]; !dup {
+				e.Values[int32(v)] = vname.text
+			}
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ---- FileDescriptorSet ----
+
+// Field type numbers from google/protobuf/descriptor.proto.
+var descriptorTypeNames = map[uint64]string{
+	1: "double", 2: "float", 3: "int64", 4: "uint64", 5: "int32",
+	6: "fixed64", 7: "fixed32", 8: "bool", 9: "string", 11: "message",
+	12: "bytes", 13: "uint32", 14: "enum", 15: "sfixed32", 16: "sfixed64",
+	17: "sint32", 18: "sint64",
+}
+
+func parseDescriptorSet(b []byte) (*protoSchema, error) {
+	s := newProtoSchema()
+	fields, err := protowire.Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("not a FileDescriptorSet: %v", err)
+	}
+	for _, f := range fields {
+		if f.Num != 1 || f.Wire != protowire.BytesType {
+			continue
+		}
+		if err := s.addFileDescriptor(f.Bytes); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *protoSchema) addFileDescriptor(b []byte) error {
+	fields, err := protowire.Parse(b)
+	if err != nil {
+		return err
+	}
+	pkg := ""
+	for _, f := range fields {
+		if f.Num == 2 && f.Wire == protowire.BytesType {
+			pkg = string(f.Bytes)
+		}
+	}
+	for _, f := range fields {
+		if f.Wire != protowire.BytesType {
+			continue
+		}
+		switch f.Num {
+		case 4:
+			if err := s.addDescriptor(pkg, f.Bytes); err != nil {
+				return err
+			}
+		case 5:
+			if err := s.addEnumDescriptor(pkg, f.Bytes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *protoSchema) addDescriptor(scope string, b []byte) error {
+	fields, err := protowire.Parse(b)
+	if err != nil {
+		return err
+	}
+	var name string
+	for _, f := range fields {
+		if f.Num == 1 && f.Wire == protowire.BytesType {
+			name = string(f.Bytes)
+		}
+	}
+	full := joinProtoName(scope, name)
+	msg := &protoMessage{Name: full, Fields: map[int]*protoFieldDesc{}}
+	s.messages[full] = msg
+	for _, f := range fields {
+		if f.Wire != protowire.BytesType {
+			continue
+		}
+		switch f.Num {
+		case 2:
+			fd, err := parseFieldDescriptor(f.Bytes)
+			if err != nil {
+				return fmt.Errorf("%s: %v", full, err)
+			}
+			msg.Fields[fd.Number] = fd
+		case 3:
+			if err := s.addDescriptor(full, f.Bytes); err != nil {
+				return err
+			}
+		case 4:
+			if err := s.addEnumDescriptor(full, f.Bytes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseFieldDescriptor(b []byte) (*protoFieldDesc, error) {
+	fields, err := protowire.Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	fd := &protoFieldDesc{}
+	var typ uint64
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			fd.Name = string(f.Bytes)
+		case 3:
+			fd.Number = int(f.Value)
+		case 4:
+			fd.Repeated = f.Value == 3
+		case 5:
+			typ = f.Value
+		case 6:
+			fd.TypeName = strings.TrimPrefix(string(f.Bytes), ".")
+		}
+	}
+	name, ok := descriptorTypeNames[typ]
+	if !ok {
+		return nil, fmt.Errorf("field %s: unsupported type %d", fd.Name, typ)
+	}
+	fd.Type = name
+	return fd, nil
+}
+
+func (s *protoSchema) addEnumDescriptor(scope string, b []byte) error {
+	fields, err := protowire.Parse(b)
+	if err != nil {
+		return err
+	}
+	e := &protoEnum{Values: map[int32]string{}}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			e.Name = joinProtoName(scope, string(f.Bytes))
+		case 2:
+			vf, err := protowire.Parse(f.Bytes)
+			if err != nil {
+				return err
+			}
+			var vname string
+			var num int32
+			for _, v := range vf {
+				switch v.Num {
+				case 1:
+					vname = string(v.Bytes)
+				case 2:
+					num = int32(v.Value)
+				}
+			}
+			if _, dup := e.Values[num]; !dup {
+				e.Values[num] = vname
+			}
+		}
+	}
+	s.enums[e.Name] = e
+	return nil
+}
+
+// ---- decoding ----
+
+const maxProtoDepth = 64
+
+// decode converts b into a JSON-ready map keyed by field name. Fields not in
+// the schema, or whose wire type does not match, are kept under "_unknown"
+// keyed by field number.
+func (s *protoSchema) decode(msg *protoMessage, b []byte) (map[string]any, error) {
+	return s.decodeDepth(msg, b, 0)
+}
+
+func (s *protoSchema) decodeDepth(msg *protoMessage, b []byte, depth int) (map[string]any, error) {
+	if depth > maxProtoDepth {
+		return nil, fmt.Errorf("message nesting too deep")
+	}
+	fields, err := protowire.Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	// A non-repeated message field that occurs more than once is merged,
+	// which protobuf defines as parsing the concatenation of its
+	// occurrences. It is decoded once, where it first occurs.
+	merged := map[int][]byte{}
+	for _, f := range fields {
+		if fd := msg.Fields[f.Num]; fd != nil && fd.Type == "message" && !fd.Repeated && f.Wire == protowire.BytesType {
+			merged[f.Num] = append(merged[f.Num], f.Bytes...)
+		}
+	}
+	done := map[int]bool{}
+	out := map[string]any{}
+	unknown := map[string][]any{}
+	for _, f := range fields {
+		fd := msg.Fields[f.Num]
+		if b, ok := merged[f.Num]; ok && f.Wire == protowire.BytesType {
+			if done[f.Num] {
+				continue
+			}
+			f.Bytes, done[f.Num] = b, true
+		}
+		var vals []any
+		if fd != nil {
+			vals, err = s.decodeValue(fd, f, depth)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %v", msg.Name, fd.Name, err)
+			}
+		}
+		if vals == nil {
+			key := strconv.Itoa(f.Num)
+			unknown[key] = append(unknown[key], rawProtoValue(f))
+			continue
+		}
+		if fd.Repeated {
+			prev, _ := out[fd.Name].([]any)
+			out[fd.Name] = append(prev, vals...)
+		} else {
+			out[fd.Name] = vals[len(vals)-1]
+		}
+	}
+	if len(unknown) > 0 {
+		out["_unknown"] = unknown
+	}
+	return out, nil
+}
+
+// decodeValue returns the values carried by f, more than one for packed
+// repeated fields, or nil when the wire type does not fit the field type.
+func (s *protoSchema) decodeValue(fd *protoFieldDesc, f protowire.Field, depth int) ([]any, error) {
+	switch fd.Type {
+	case "string":
+		if f.Wire != protowire.BytesType {
+			return nil, nil
+		}
+		return []any{string(f.Bytes)}, nil
+	case "bytes":
+		if f.Wire != protowire.BytesType {
+			return nil, nil
+		}
+		return []any{hex.EncodeToString(f.Bytes)}, nil
+	case "message":
+		if f.Wire != protowire.BytesType {
+			return nil, nil
+		}
+		m := s.messages[fd.TypeName]
+		if m == nil {
+			return nil, fmt.Errorf("unknown message type %s", fd.TypeName)
+		}
+		v, err := s.decodeDepth(m, f.Bytes, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return []any{v}, nil
+	}
+
+	wire := scalarWireType(fd.Type)
+	if f.Wire == wire {
+		return []any{s.scalarValue(fd, f.Value)}, nil
+	}
+	if f.Wire != protowire.BytesType || !fd.Repeated {
+		return nil, nil
+	}
+	// Packed repeated scalars.
+	var vals []any
+	b := f.Bytes
+	for len(b) > 0 {
+		var v uint64
+		switch wire {
+		case protowire.VarintType:
+			x, n := protowire.ReadVarint(b, 0)
+			if n == 0 {
+				return nil, nil
+			}
+			v, b = x, b[n:]
+		case protowire.Fixed32Type:
+			if len(b) < 4 {
+				return nil, nil
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case protowire.Fixed64Type:
+			if len(b) < 8 {
+				return nil, nil
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		}
+		vals = append(vals, s.scalarValue(fd, v))
+	}
+	if vals == nil {
+		vals = []any{}
+	}
+	return vals, nil
+}
+
+func scalarWireType(typ string) int {
+	switch typ {
+	case "double", "fixed64", "sfixed64":
+		return protowire.Fixed64Type
+	case "float", "fixed32", "sfixed32":
+		return protowire.Fixed32Type
+	}
+	return protowire.VarintType
+}
+
+func (s *protoSchema) scalarValue(fd *protoFieldDesc, v uint64) any {
+	switch fd.Type {
+	case "double":
+		return jsonFloat(math.Float64frombits(v), 64)
+	case "float":
+		return jsonFloat(float64(math.Float32frombits(uint32(v))), 32)
+	case "int32", "sfixed32":
+		return int32(v)
+	case "int64", "sfixed64":
+		return int64(v)
+	case "uint32", "fixed32":
+		return uint32(v)
+	case "sint32":
+		return int32(protowire.Zigzag(v))
+	case "sint64":
+		return protowire.Zigzag(v)
+	case "bool":
+		return v != 0
+	case "enum":
+		if e := s.enums[fd.TypeName]; e != nil {
+			if name, ok := e.Values[int32(v)]; ok {
+				return name
+			}
+		}
+		return int32(v)
+	}
+	return v
+}
+
+// jsonFloat formats f with the shortest representation at its own precision.
+// NaN and infinities become the strings used by the protobuf JSON mapping,
+// since encoding/json cannot represent them.
+func jsonFloat(f float64, bits int) any {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, bits))
+}
+
+func rawProtoValue(f protowire.Field) any {
+	if f.Wire == protowire.BytesType {
+		return hex.EncodeToString(f.Bytes)
+	}
+	return f.Value
+}
+
+// writeProtoJSONL decodes every packet of the given streams with msg and
+// writes one JSON object per line.
+func writeProtoJSONL(input string, streamIndices []int, schema *protoSchema, msg *protoMessage, out string) error {
+	m, err := openMP4(input)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	f, err := createOutput(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	for _, idx := range streamIndices {
+		pr, err := newPacketReader(m, idx)
+		if err != nil {
+			return err
+		}
+		for n := 0; ; n++ {
+			p, err := pr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			rec := map[string]any{"stream": idx, "packet": n, "pts": p.PTS}
+			if v, err := schema.decode(msg, p.Data); err != nil {
+				rec["error"] = err.Error()
+			} else {
+				rec["message"] = v
+			}
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Commit()
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+
+	"osv2mov/internal/protowire"
+)
+
+// Wire format encoders for building test messages.
+
+func pbKey(num, wire int) []byte {
+	return binary.AppendUvarint(nil, uint64(num)<<3|uint64(wire))
+}
+
+func pbUint(num int, v uint64) []byte {
+	return binary.AppendUvarint(pbKey(num, protowire.VarintType), v)
+}
+
+func pbFixed32(num int, v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(pbKey(num, protowire.Fixed32Type), v)
+}
+
+func pbFixed64(num int, v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(pbKey(num, protowire.Fixed64Type), v)
+}
+
+func pbBytes(num int, parts ...[]byte) []byte {
+	payload := bytes.Join(parts, nil)
+	b := binary.AppendUvarint(pbKey(num, protowire.BytesType), uint64(len(payload)))
+	return append(b, payload...)
+}
+
+func pbString(num int, s string) []byte {
+	return pbBytes(num, []byte(s))
+}
+
+func pbCat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+const testProtoSource = `
+// Frame metadata.
+syntax = "proto3";
+
+package test.v1;
+
+import "google/protobuf/timestamp.proto";
+option java_package = "com.example.test";
+
+enum Mode {
+  MODE_UNKNOWN = 0;
+  MODE_VIDEO = 1;
+  MODE_PHOTO = 2 [deprecated = true];
+  MODE_ERROR = -1;
+}
+
+message Frame {
+  message Lens {
+    enum Kind {
+      KIND_NONE = 0;
+      KIND_FISHEYE = 1;
+    }
+    Kind kind = 1;
+    double fov = 2;
+  }
+  uint32 index = 1;
+  Lens lens = 2;
+  repeated Lens lenses = 3;
+  Mode mode = 4;
+  oneof payload {
+    string text = 5;
+    bytes blob = 6;
+  }
+  map<string, int32> tag_counts = 7;
+  map<int32, Lens> lens_by_id = 8;
+  repeated sint32 deltas = 9 [packed = true];
+  repeated float samples = 10;
+  sfixed64 stamp = 11;
+}
+`
+
+func TestParseProtoSource(t *testing.T) {
+	s, err := parseProtoSource(testProtoSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		msg      string
+		num      int
+		name     string
+		typ      string
+		typeName string
+		repeated bool
+	}{
+		{"test.v1.Frame", 1, "index", "uint32", "", false},
+		{"test.v1.Frame", 2, "lens", "message", "test.v1.Frame.Lens", false},
+		{"test.v1.Frame", 3, "lenses", "message", "test.v1.Frame.Lens", true},
+		{"test.v1.Frame", 4, "mode", "enum", "test.v1.Mode", false},
+		{"test.v1.Frame", 5, "text", "string", "", false},
+		{"test.v1.Frame", 6, "blob", "bytes", "", false},
+		{"test.v1.Frame", 7, "tag_counts", "message", "test.v1.Frame.TagCountsEntry", true},
+		{"test.v1.Frame", 8, "lens_by_id", "message", "test.v1.Frame.LensByIdEntry", true},
+		{"test.v1.Frame", 9, "deltas", "sint32", "", true},
+		{"test.v1.Frame", 10, "samples", "float", "", true},
+		{"test.v1.Frame", 11, "stamp", "sfixed64", "", false},
+		{"test.v1.Frame.Lens", 1, "kind", "enum", "test.v1.Frame.Lens.Kind", false},
+		{"test.v1.Frame.Lens", 2, "fov", "double", "", false},
+		{"test.v1.Frame.TagCountsEntry", 1, "key", "string", "", false},
+		{"test.v1.Frame.TagCountsEntry", 2, "value", "int32", "", false},
+		{"test.v1.Frame.LensByIdEntry", 1, "key", "int32", "", false},
+		{"test.v1.Frame.LensByIdEntry", 2, "value", "message", "test.v1.Frame.Lens", false},
+	}
+	for _, tt := range tests {
+		m := s.messages[tt.msg]
+		if m == nil {
+			t.Errorf("message %s not defined", tt.msg)
+			continue
+		}
+		f := m.Fields[tt.num]
+		if f == nil {
+			t.Errorf("%s: field %d not defined", tt.msg, tt.num)
+			continue
+		}
+		if f.Name != tt.name || f.Type != tt.typ || f.TypeName != tt.typeName || f.Repeated != tt.repeated {
+			t.Errorf("%s.%d = {%s %s %s %v}, want {%s %s %s %v}", tt.msg, tt.num,
+				f.Name, f.Type, f.TypeName, f.Repeated, tt.name, tt.typ, tt.typeName, tt.repeated)
+		}
+	}
+	mode := s.enums["test.v1.Mode"]
+	if mode == nil || mode.Values[-1] != "MODE_ERROR" || mode.Values[2] != "MODE_PHOTO" {
+		t.Errorf("enum test.v1.Mode = %v", mode)
+	}
+}
+
+func TestParseProtoSourceErrors(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		// Imports are not followed, so their types cannot be resolved.
+		{"imported type", `import "common.proto"; message A { common.Vec v = 1; }`, `unknown type "common.Vec"`},
+		{"group", `message A { optional group G = 1 { } }`, "groups are not supported"},
+		{"field number", `message A { int32 a = 0; }`, "invalid field number"},
+		{"unterminated", `message A { int32 a = 1;`, "unexpected end of file"},
+	}
+	for _, tt := range tests {
+		_, err := parseProtoSource(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestProtoMapEntryName(t *testing.T) {
+	tests := map[string]string{
+		"tags":        "TagsEntry",
+		"tag_counts":  "TagCountsEntry",
+		"lens_by_id":  "LensByIdEntry",
+		"foo__bar":    "FooBarEntry",
+		"x2_y":        "X2YEntry",
+		"alreadyCaml": "AlreadyCamlEntry",
+	}
+	for in, want := range tests {
+		if got := protoMapEntryName(in); got != want {
+			t.Errorf("protoMapEntryName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// Messages decoded by both the source and the descriptor set schema.
+var protoDecodeTests = []struct {
+	name string
+	in   []byte
+	want string
+}{
+	{
+		"scalars and enum",
+		pbCat(pbUint(1, 7), pbUint(4, 1), pbFixed64(11, uint64(math.MaxUint64))),
+		`{"index":7,"mode":"MODE_VIDEO","stamp":-1}`,
+	},
+	{
+		"negative enum value",
+		pbUint(4, uint64(math.MaxUint64)),
+		`{"mode":"MODE_ERROR"}`,
+	},
+	{
+		"unknown enum value",
+		pbUint(4, 9),
+		`{"mode":9}`,
+	},
+	{
+		"nested message",
+		pbBytes(2, pbUint(1, 1), pbFixed64(2, math.Float64bits(190.5))),
+		`{"lens":{"fov":190.5,"kind":"KIND_FISHEYE"}}`,
+	},
+	{
+		// Later scalars win, repeated fields append and nested messages
+		// merge recursively.
+		"merged message",
+		pbCat(pbBytes(2, pbUint(1, 1), pbFixed64(2, math.Float64bits(180))), pbUint(1, 3),
+			pbBytes(2, pbFixed64(2, math.Float64bits(200)))),
+		`{"index":3,"lens":{"fov":200,"kind":"KIND_FISHEYE"}}`,
+	},
+	{
+		"empty message",
+		pbCat(pbBytes(2), pbBytes(2)),
+		`{"lens":{}}`,
+	},
+	{
+		"repeated message",
+		pbCat(pbBytes(3, pbUint(1, 1)), pbBytes(3, pbFixed64(2, math.Float64bits(90)))),
+		`{"lenses":[{"kind":"KIND_FISHEYE"},{"fov":90}]}`,
+	},
+	{
+		"oneof",
+		pbString(5, "hello"),
+		`{"text":"hello"}`,
+	},
+	{
+		"oneof bytes",
+		pbBytes(6, []byte{0xde, 0xad}),
+		`{"blob":"dead"}`,
+	},
+	{
+		"maps",
+		pbCat(pbBytes(7, pbString(1, "a"), pbUint(2, 1)), pbBytes(7, pbString(1, "b"), pbUint(2, 2)),
+			pbBytes(8, pbUint(1, 4), pbBytes(2, pbUint(1, 1)))),
+		`{"lens_by_id":[{"key":4,"value":{"kind":"KIND_FISHEYE"}}],"tag_counts":[{"key":"a","value":1},{"key":"b","value":2}]}`,
+	},
+	{
+		"packed repeated",
+		pbCat(pbBytes(9, []byte{1, 4, 5}), pbBytes(10,
+			binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, math.Float32bits(0.5)), math.Float32bits(-2)))),
+		`{"deltas":[-1,2,-3],"samples":[0.5,-2]}`,
+	},
+	{
+		"unpacked repeated",
+		pbCat(pbUint(9, 1), pbUint(9, 4), pbFixed32(10, math.Float32bits(1.25))),
+		`{"deltas":[-1,2],"samples":[1.25]}`,
+	},
+	{
+		"unknown fields",
+		pbCat(pbUint(15, 3), pbString(1, "x"), pbString(16, "raw")),
+		`{"_unknown":{"1":["78"],"15":[3],"16":["726177"]}}`,
+	},
+}
+
+func testDecode(t *testing.T, s *protoSchema) {
+	t.Helper()
+	msg, err := s.message("Frame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range protoDecodeTests {
+		v, err := s.decode(msg, tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got, err := json.Marshal(v)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProtoDecodeSource(t *testing.T) {
+	s, err := parseProtoSource(testProtoSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDecode(t, s)
+}
+
+// Descriptor encoders following descriptor.proto, emitting fields in the
+// order protoc writes them.
+
+const (
+	labelOptional = 1
+	labelRepeated = 3
+)
+
+func descField(name string, num, label, typ int, typeName, jsonName string, extra ...[]byte) []byte {
+	parts := [][]byte{pbString(1, name), pbUint(3, uint64(num)), pbUint(4, uint64(label)), pbUint(5, uint64(typ))}
+	if typeName != "" {
+		parts = append(parts, pbString(6, typeName))
+	}
+	parts = append(parts, extra...)
+	parts = append(parts, pbString(10, jsonName))
+	return pbBytes(2, parts...)
+}
+
+func descEnumValue(name string, num int32, extra ...[]byte) []byte {
+	return pbBytes(2, append([][]byte{pbString(1, name), pbUint(2, uint64(int64(num)))}, extra...)...)
+}
+
+func descMapEntry(name string, key, value []byte) []byte {
+	return pbBytes(3, pbString(1, name), key, value, pbBytes(7, pbUint(7, 1)))
+}
+
+// testDescriptorSet is what protoc --include_imports --descriptor_set_out
+// writes for testProtoSource with an added import of common.proto and a
+// field of its type.
+func testDescriptorSet() []byte {
+	common := pbBytes(1,
+		pbString(1, "common.proto"),
+		pbString(2, "common"),
+		pbBytes(4, pbString(1, "Vec"),
+			descField("x", 1, labelOptional, 2, "", "x"),
+			descField("y", 2, labelOptional, 2, "", "y"),
+			descField("z", 3, labelOptional, 2, "", "z")),
+		pbString(12, "proto3"),
+	)
+	lens := pbBytes(3,
+		pbString(1, "Lens"),
+		descField("kind", 1, labelOptional, 14, ".test.v1.Frame.Lens.Kind", "kind"),
+		descField("fov", 2, labelOptional, 1, "", "fov"),
+		pbBytes(4, pbString(1, "Kind"), descEnumValue("KIND_NONE", 0), descEnumValue("KIND_FISHEYE", 1)),
+	)
+	frame := pbBytes(4,
+		pbString(1, "Frame"),
+		descField("index", 1, labelOptional, 13, "", "index"),
+		descField("lens", 2, labelOptional, 11, ".test.v1.Frame.Lens", "lens"),
+		descField("lenses", 3, labelRepeated, 11, ".test.v1.Frame.Lens", "lenses"),
+		descField("mode", 4, labelOptional, 14, ".test.v1.Mode", "mode"),
+		descField("text", 5, labelOptional, 9, "", "text", pbUint(9, 0)),
+		descField("blob", 6, labelOptional, 12, "", "blob", pbUint(9, 0)),
+		descField("tag_counts", 7, labelRepeated, 11, ".test.v1.Frame.TagCountsEntry", "tagCounts"),
+		descField("lens_by_id", 8, labelRepeated, 11, ".test.v1.Frame.LensByIdEntry", "lensById"),
+		descField("deltas", 9, labelRepeated, 17, "", "deltas", pbBytes(8, pbUint(2, 1))),
+		descField("samples", 10, labelRepeated, 2, "", "samples"),
+		descField("stamp", 11, labelOptional, 16, "", "stamp"),
+		descField("offset", 12, labelOptional, 11, ".common.Vec", "offset"),
+		lens,
+		descMapEntry("TagCountsEntry",
+			descField("key", 1, labelOptional, 9, "", "key"),
+			descField("value", 2, labelOptional, 5, "", "value")),
+		descMapEntry("LensByIdEntry",
+			descField("key", 1, labelOptional, 5, "", "key"),
+			descField("value", 2, labelOptional, 11, ".test.v1.Frame.Lens", "value")),
+		pbBytes(8, pbString(1, "payload")),
+	)
+	file := pbBytes(1,
+		pbString(1, "frame.proto"),
+		pbString(2, "test.v1"),
+		pbString(3, "google/protobuf/timestamp.proto"),
+		pbString(3, "common.proto"),
+		frame,
+		pbBytes(5, pbString(1, "Mode"),
+			descEnumValue("MODE_UNKNOWN", 0),
+			descEnumValue("MODE_VIDEO", 1),
+			descEnumValue("MODE_PHOTO", 2, pbBytes(3, pbUint(1, 1))),
+			descEnumValue("MODE_ERROR", -1)),
+		pbBytes(8, pbString(1, "com.example.test")),
+		pbString(12, "proto3"),
+	)
+	return pbCat(common, file)
+}
+
+func TestProtoDescriptorSet(t *testing.T) {
+	s, err := parseDescriptorSet(testDescriptorSet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDecode(t, s)
+
+	// Unlike a .proto source, the set carries the imported files.
+	msg, err := s.message("test.v1.Frame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.decode(msg, pbBytes(12, pbFixed32(1, math.Float32bits(1)), pbFixed32(3, math.Float32bits(-0.5))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(v)
+	if want := `{"offset":{"x":1,"z":-0.5}}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if protowire.IsPrintable(testDescriptorSet()) {
+		t.Errorf("descriptor set taken for .proto source")
+	}
+}
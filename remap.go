@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"path/filepath"
+)
+
+// Lens-calibrated equirectangular stitching. Every output pixel is traced
+// through the Kannala-Brandt model of the dbgi calibration to a pixel of
+// the front or rear fisheye, and the result is written as 16-bit PGM
+// tables for ffmpeg's remap filter. Coordinates address the two lenses
+// stacked side by side, front on the left.
+//
+// Directions use the front lens camera frame: X right, Y down, Z along
+// the optical axis. The rear lens frame comes from the extrinsic rotation,
+// whose columns are the rear axes in front coordinates; without extrinsics
+// the rear lens is taken to look exactly backwards. The lens baseline is
+// ignored, which is exact for distant scenes.
+//
+// With a seam blend width, each lens gets its own tables and an 8-bit mask
+// holds the rear lens weight, ramping linearly across the seam.
+
+// rearLensRotation is the rear lens frame without extrinsics: turned 180°
+// about the vertical, so X and Z point the other way.
+var rearLensRotation = [9]float64{-1, 0, 0, 0, 1, 0, 0, 0, -1}
+
+// remapNone marks output pixels that no lens covers; remap fills them
+// with black.
+const remapNone = math.MaxUint16
+
+type fisheyeLens struct {
+	fx, fy, cx, cy float64
+	k              [4]float64
+	rot            [9]float64 // lens axes in the front lens frame, row-major
+	maxTheta       float64
+	width, height  int
+	xoff           int // horizontal offset in the stacked frame
+}
+
+// newFisheyeLens scales l from its calibration size to the video size.
+func newFisheyeLens(l *lensIntrinsics, rot [9]float64, width, height, xoff int, fov float64) fisheyeLens {
+	sx, sy := 1.0, 1.0
+	if l.Width > 0 && l.Height > 0 {
+		sx = float64(width) / float64(l.Width)
+		sy = float64(height) / float64(l.Height)
+	}
+	f := fisheyeLens{
+		fx:       l.FocalLength[0] * sx,
+		fy:       l.FocalLength[1] * sy,
+		cx:       l.PrincipalPoint[0] * sx,
+		cy:       l.PrincipalPoint[1] * sy,
+		rot:      rot,
+		maxTheta: fov / 2 * math.Pi / 180,
+		width:    width,
+		height:   height,
+		xoff:     xoff,
+	}
+	copy(f.k[:], l.Distortion)
+	return f
+}
+
+// project maps direction d of the front lens frame to a pixel of the lens.
+// theta is the angle from the optical axis; ok is false when the direction
+// lies outside the field of view or the image.
+func (l *fisheyeLens) project(d [3]float64) (u, v, theta float64, ok bool) {
+	// Into the lens frame with the transposed rotation.
+	x := l.rot[0]*d[0] + l.rot[3]*d[1] + l.rot[6]*d[2]
+	y := l.rot[1]*d[0] + l.rot[4]*d[1] + l.rot[7]*d[2]
+	z := l.rot[2]*d[0] + l.rot[5]*d[1] + l.rot[8]*d[2]
+	r := math.Hypot(x, y)
+	theta = math.Atan2(r, z)
+	if theta > l.maxTheta {
+		return 0, 0, theta, false
+	}
+	t2 := theta * theta
+	td := theta * (1 + t2*(l.k[0]+t2*(l.k[1]+t2*(l.k[2]+t2*l.k[3]))))
+	u, v = l.cx, l.cy
+	if r > 0 {
+		u += l.fx * td * x / r
+		v += l.fy * td * y / r
+	}
+	ok = u >= 0 && v >= 0 && u < float64(l.width) && v < float64(l.height)
+	return u, v, theta, ok
+}
+
+// pixel returns the remap coordinates of (u, v) in the stacked frame.
+func (l *fisheyeLens) pixel(u, v float64) (uint16, uint16) {
+	x := min(int(math.Round(u)), l.width-1)
+	y := min(int(math.Round(v)), l.height-1)
+	return uint16(x + l.xoff), uint16(y)
+}
+
+// stitchLenses builds the front and rear lens models of the input from
+// its dbgi calibration. readLensCalibration has already rejected focal
+// lengths, principal points and rotations no fisheye lens could have;
+// here the calibration must also describe the video, at its size or
+// scaled uniformly from it.
+func stitchLenses(input string, st osvStreams, fov float64) ([2]fisheyeLens, error) {
+	var lenses [2]fisheyeLens
+	if len(st.DBGI) == 0 {
+		return lenses, fmt.Errorf("no dbgi streams found; calibrated stitching needs the lens calibration")
+	}
+	m, err := openMP4(input)
+	if err != nil {
+		return lenses, err
+	}
+	defer m.Close()
+	cal, err := readLensCalibration(m, st.DBGI)
+	if err != nil {
+		return lenses, err
+	}
+
+	front, rear := m.Tracks[st.Video[0]], m.Tracks[st.Video[1]]
+	if front.Width != rear.Width || front.Height != rear.Height {
+		return lenses, fmt.Errorf("front and rear videos differ in size (%dx%d, %dx%d)",
+			front.Width, front.Height, rear.Width, rear.Height)
+	}
+	if 2*front.Width >= remapNone || front.Height >= remapNone {
+		return lenses, fmt.Errorf("video size %dx%d too large for remap tables", front.Width, front.Height)
+	}
+	fl, rl := cal.lens(0), cal.lens(1)
+	if fl == nil || rl == nil {
+		return lenses, fmt.Errorf("calibration of both lenses not found in dbgi data")
+	}
+	for _, l := range []*lensIntrinsics{fl, rl} {
+		if l.Width*front.Height != l.Height*front.Width {
+			return lenses, fmt.Errorf("%s lens calibration size %dx%d does not match the %dx%d video",
+				l.Lens, l.Width, l.Height, front.Width, front.Height)
+		}
+	}
+	rot := rearLensRotation
+	if cal.Extrinsics != nil {
+		rot = cal.Extrinsics.Rotation
+	}
+	lenses[0] = newFisheyeLens(fl, [9]float64{1, 0, 0, 0, 1, 0, 0, 0, 1}, front.Width, front.Height, 0, fov)
+	lenses[1] = newFisheyeLens(rl, rot, rear.Width, rear.Height, front.Width, fov)
+	return lenses, nil
+}
+
+// stitchMapFiles returns the remap table paths: x and y for a hard seam,
+// or front x/y, rear x/y and the mask when blending.
+func stitchMapFiles(subdir, base string, blend bool) []string {
+	names := []string{"remap_x", "remap_y"}
+	if blend {
+		names = []string{"remap_front_x", "remap_front_y", "remap_rear_x", "remap_rear_y", "remap_mask"}
+	}
+	files := make([]string, len(names))
+	for i, n := range names {
+		files[i] = filepath.Join(subdir, fmt.Sprintf("%s_%s.pgm", base, n))
+	}
+	return files
+}
+
+// writeStitchMaps writes the remap tables for an equirectangular output of
+// opts.Width x opts.Height. On error or cancellation no table is left.
+func writeStitchMaps(ctx context.Context, lenses [2]fisheyeLens, opts *stitchOptions, files []string) error {
+	blend := opts.Blend > 0
+	var maps []*pgmWriter
+	defer func() {
+		for _, p := range maps {
+			p.f.Close()
+		}
+	}()
+	for i, f := range files {
+		maxval := math.MaxUint16
+		if blend && i == 4 {
+			maxval = math.MaxUint8
+		}
+		p, err := createPGM(f, opts.Width, opts.Height, maxval)
+		if err != nil {
+			return err
+		}
+		maps = append(maps, p)
+	}
+
+	view := stitchRotation(opts.Yaw, opts.Pitch, opts.Roll)
+	blendWidth := opts.Blend * math.Pi / 180
+	w, h := opts.Width, opts.Height
+	for j := 0; j < h; j++ {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		phi := math.Pi/2 - (float64(j)+0.5)/float64(h)*math.Pi
+		for i := 0; i < w; i++ {
+			lambda := (float64(i)+0.5)/float64(w)*2*math.Pi - math.Pi
+			d := rotate(view, [3]float64{
+				math.Cos(phi) * math.Sin(lambda),
+				-math.Sin(phi),
+				math.Cos(phi) * math.Cos(lambda),
+			})
+			uf, vf, tf, okf := lenses[0].project(d)
+			ur, vr, tr, okr := lenses[1].project(d)
+
+			if !blend {
+				x, y := uint16(remapNone), uint16(remapNone)
+				if okf && (!okr || tf <= tr) {
+					x, y = lenses[0].pixel(uf, vf)
+				} else if okr {
+					x, y = lenses[1].pixel(ur, vr)
+				}
+				maps[0].put16(x)
+				maps[1].put16(y)
+				continue
+			}
+
+			fx, fy := uint16(remapNone), uint16(remapNone)
+			if okf {
+				fx, fy = lenses[0].pixel(uf, vf)
+			}
+			rx, ry := uint16(remapNone), uint16(remapNone)
+			if okr {
+				rx, ry = lenses[1].pixel(ur, vr)
+			}
+			// Rear weight: 0 up to half the width before the seam, where
+			// both lenses are equally far off axis, 1 half the width after.
+			weight := 0.0
+			switch {
+			case okf && okr:
+				weight = math.Max(0, math.Min(1, 0.5+(tf-tr)/2/blendWidth))
+			case okr:
+				weight = 1
+			}
+			maps[0].put16(fx)
+			maps[1].put16(fy)
+			maps[2].put16(rx)
+			maps[3].put16(ry)
+			maps[4].w.WriteByte(byte(math.Round(weight * math.MaxUint8)))
+		}
+	}
+	for _, p := range maps {
+		if err := p.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stitchRotation returns the view rotation for yaw (positive looks right),
+// pitch (positive looks up) and roll in degrees, in the front lens frame.
+func stitchRotation(yaw, pitch, roll float64) [9]float64 {
+	rad := math.Pi / 180
+	sy, cy := math.Sincos(yaw * rad)
+	sp, cp := math.Sincos(pitch * rad)
+	sr, cr := math.Sincos(roll * rad)
+	ry := [9]float64{cy, 0, sy, 0, 1, 0, -sy, 0, cy}
+	rx := [9]float64{1, 0, 0, 0, cp, -sp, 0, sp, cp}
+	rz := [9]float64{cr, -sr, 0, sr, cr, 0, 0, 0, 1}
+	return mulMat3(ry, mulMat3(rx, rz))
+}
+
+func mulMat3(a, b [9]float64) [9]float64 {
+	var c [9]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			c[i*3+j] = a[i*3]*b[j] + a[i*3+1]*b[3+j] + a[i*3+2]*b[6+j]
+		}
+	}
+	return c
+}
+
+func rotate(m [9]float64, d [3]float64) [3]float64 {
+	return [3]float64{
+		m[0]*d[0] + m[1]*d[1] + m[2]*d[2],
+		m[3]*d[0] + m[4]*d[1] + m[5]*d[2],
+		m[6]*d[0] + m[7]*d[1] + m[8]*d[2],
+	}
+}
+
+// pgmWriter streams a binary (P5) PGM image row by row.
+type pgmWriter struct {
+	f *outputFile
+	w *bufio.Writer
+}
+
+func createPGM(path string, width, height, maxval int) (*pgmWriter, error) {
+	f, err := createOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &pgmWriter{f: f, w: bufio.NewWriterSize(f, 1<<20)}
+	fmt.Fprintf(p.w, "P5\n%d %d\n%d\n", width, height, maxval)
+	return p, nil
+}
+
+// put16 writes one 16-bit sample, big endian as PGM requires.
+func (p *pgmWriter) put16(v uint16) {
+	p.w.WriteByte(byte(v >> 8))
+	p.w.WriteByte(byte(v))
+}
+
+func (p *pgmWriter) Close() error {
+	if err := p.w.Flush(); err != nil {
+		return err
+	}
+	return p.f.Commit()
+}
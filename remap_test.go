@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFisheyeMP4 writes front and rear video tracks of the given size and a
+// dbgi track holding cal.
+func testFisheyeMP4(t *testing.T, path string, width, height uint16, cal *lensCalibration) osvStreams {
+	t.Helper()
+	entry := make([]byte, 78)
+	entry[24], entry[25] = byte(width>>8), byte(width)
+	entry[26], entry[27] = byte(height>>8), byte(height)
+	var tracks []*testTrack
+	for range 2 {
+		v := testVideoTrack(2, 3000)
+		v.entry = makeBox("avc1", entry)
+		tracks = append(tracks, v)
+	}
+	packet := testDbgiPacket(cal)
+	tracks = append(tracks, &testTrack{
+		handler:  "meta",
+		entry:    makeBox("dbgi", make([]byte, 8)),
+		mdhd:     makeFullBox("mdhd", 0, 0, u32s(0, 0, 1000, 10), []byte{0x55, 0xc4, 0, 0}),
+		stts:     []sttsEntry{{1, 10}},
+		sizes:    []uint32{uint32(len(packet))},
+		perChunk: 1,
+		samples:  [][]byte{packet},
+	})
+	writeTestMP4(t, path, tracks)
+	return osvStreams{Video: []int{0, 1}, DBGI: []int{2}}
+}
+
+func TestStitchLenses(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height uint16
+		edit          func(c *lensCalibration)
+		want          string // error, "" for none
+	}{
+		{"calibration size", 3840, 3840, nil, ""},
+		{"scaled", 1920, 1920, nil, ""},
+		{"other aspect ratio", 3840, 2160, nil, "front lens calibration size 3840x3840 does not match the 3840x2160 video"},
+		{"rear size", 3840, 3840, func(c *lensCalibration) { c.Lenses[1].Height = 2880 }, "rear lens calibration size 3840x2880"},
+		{"focal length", 3840, 3840, func(c *lensCalibration) { c.Lenses[0].FocalLength = [2]float64{1, 1} }, "focal length 1, 1"},
+		{"principal point", 3840, 3840, func(c *lensCalibration) { c.Lenses[1].PrincipalPoint[0] = -5 }, "principal point (-5, "},
+		{"rotation", 3840, 3840, func(c *lensCalibration) { c.Extrinsics.Rotation = [9]float64{0, 1, 0, 1, 0, 0, 0, 0, 1} }, "determinant -1"},
+	}
+	for _, tt := range tests {
+		cal := testCalibration()
+		if tt.edit != nil {
+			tt.edit(cal)
+		}
+		path := filepath.Join(t.TempDir(), "in.mp4")
+		st := testFisheyeMP4(t, path, tt.width, tt.height, cal)
+		lenses, err := stitchLenses(path, st, 190)
+		if tt.want != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		// The calibration is scaled to the video.
+		scale := float64(tt.width) / 3840
+		for i, l := range lenses {
+			c := cal.Lenses[i]
+			if l.width != int(tt.width) || l.xoff != i*int(tt.width) ||
+				math.Abs(l.fx-c.FocalLength[0]*scale) > 1e-3 || math.Abs(l.cy-c.PrincipalPoint[1]*scale) > 1e-3 {
+				t.Errorf("%s: lens %d = %+v", tt.name, i, l)
+			}
+		}
+		if lenses[1].rot != cal.Extrinsics.Rotation {
+			t.Errorf("%s: rear rotation %v", tt.name, lenses[1].rot)
+		}
+	}
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// Stream-copy MOV writer. Samples are copied chunk by chunk from the source
+// mdat and a new moov is built from the source track headers with freshly
+// computed chunk tables. Timing tables (stts/ctts/stss), edit lists and
+// sample descriptions are written back unchanged.
+
+type mp4Chunk struct {
+	Offset      uint64
+	Size        uint64
+	FirstSample int
+	Samples     int
+	DescIndex   uint32
+	DTS         uint64 // decode time of the first sample in media timescale
+}
+
+func (t *mp4Track) chunks() ([]mp4Chunk, error) {
+	if len(t.stsc) == 0 && len(t.chunkOffsets) > 0 {
+		return nil, fmt.Errorf("stsc box missing")
+	}
+	chunks := make([]mp4Chunk, 0, len(t.chunkOffsets))
+	sample := 0
+	var dts uint64
+	sttsIdx, sttsLeft := 0, uint32(0)
+	if len(t.stts) > 0 {
+		sttsLeft = t.stts[0].Count
+	}
+	for c := range t.chunkOffsets {
+		chunkNum := uint32(c + 1)
+		e := 0
+		for e+1 < len(t.stsc) && t.stsc[e+1].FirstChunk <= chunkNum {
+			e++
+		}
+		n := int(t.stsc[e].SamplesPerChunk)
+		if sample+n > len(t.sampleSizes) {
+			return nil, fmt.Errorf("chunk %d refers past the last sample", c)
+		}
+		ch := mp4Chunk{
+			Offset:      t.chunkOffsets[c],
+			FirstSample: sample,
+			Samples:     n,
+			DescIndex:   t.stsc[e].DescIndex,
+			DTS:         dts,
+		}
+		for i := 0; i < n; i++ {
+			ch.Size += uint64(t.sampleSizes[sample+i])
+			for sttsLeft == 0 && sttsIdx+1 < len(t.stts) {
+				sttsIdx++
+				sttsLeft = t.stts[sttsIdx].Count
+			}
+			if sttsLeft > 0 {
+				dts += uint64(t.stts[sttsIdx].Delta)
+				sttsLeft--
+			}
+		}
+		sample += n
+		chunks = append(chunks, ch)
+	}
+	if sample != len(t.sampleSizes) {
+		return nil, fmt.Errorf("chunk table covers %d of %d samples", sample, len(t.sampleSizes))
+	}
+	return chunks, nil
+}
+
+func appendBox(b []byte, typ string, parts ...[]byte) []byte {
+	size := 8
+	for _, p := range parts {
+		size += len(p)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func makeBox(typ string, parts ...[]byte) []byte {
+	return appendBox(nil, typ, parts...)
+}
+
+func makeFullBox(typ string, version byte, flags uint32, parts ...[]byte) []byte {
+	vf := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return makeBox(typ, append([][]byte{vf}, parts...)...)
+}
+
+var (
+	ftypQuickTime = makeBox("ftyp", []byte("qt  "), []byte{0, 0, 2, 0}, []byte("qt  "))
+	ftypMP4       = makeBox("ftyp", []byte("isom"), []byte{0, 0, 2, 0}, []byte("isomiso2mp41"))
+	ftypM4A       = makeBox("ftyp", []byte("M4A "), []byte{0, 0, 2, 0}, []byte("M4A isomiso2"))
+)
+
+type movWriter struct {
+	f         *outputFile
+	w         *bufio.Writer
+	pos       int64
+	mdatStart int64
+	mvhd      []byte
+	tracks    []*movTrack
+}
+
+type movTrack struct {
+	src          *mp4Track
+	id           uint32
+	chunkOffsets []uint64
+	chunkSamples []uint32
+	chunkDesc    []uint32
+	samples      int
+}
+
+func createMOV(path string, ftyp, mvhd []byte) (*movWriter, error) {
+	f, err := createOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	mw := &movWriter{f: f, w: bufio.NewWriterSize(f, 1<<20), mvhd: mvhd}
+	// mdat always uses a 64-bit size so it can be patched on Close.
+	hdr := make([]byte, 16)
+	binary.BigEndian.PutUint32(hdr[0:4], 1)
+	copy(hdr[4:8], "mdat")
+	for _, b := range [][]byte{ftyp, hdr} {
+		if err := mw.write(b); err != nil {
+			mw.abort()
+			return nil, err
+		}
+	}
+	mw.mdatStart = int64(len(ftyp))
+	return mw, nil
+}
+
+func (mw *movWriter) write(b []byte) error {
+	n, err := mw.w.Write(b)
+	mw.pos += int64(n)
+	return err
+}
+
+func (mw *movWriter) addTrack(src *mp4Track) *movTrack {
+	t := &movTrack{src: src, id: uint32(len(mw.tracks) + 1)}
+	mw.tracks = append(mw.tracks, t)
+	return t
+}
+
+func (mw *movWriter) writeChunk(t *movTrack, r io.Reader, size int64, samples int, desc uint32) error {
+	t.chunkOffsets = append(t.chunkOffsets, uint64(mw.pos))
+	t.chunkSamples = append(t.chunkSamples, uint32(samples))
+	t.chunkDesc = append(t.chunkDesc, desc)
+	t.samples += samples
+	n, err := io.CopyN(mw.w, r, size)
+	mw.pos += n
+	return err
+}
+
+// Close completes the file and moves it to its final name.
+func (mw *movWriter) Close() error {
+	if err := mw.finish(); err != nil {
+		mw.f.Close()
+		return err
+	}
+	return mw.f.Commit()
+}
+
+// abort removes the output without writing the moov.
+func (mw *movWriter) abort() {
+	mw.f.Close()
+}
+
+func (mw *movWriter) finish() error {
+	for _, t := range mw.tracks {
+		if t.samples != t.src.SampleCount() {
+			return fmt.Errorf("track %d: wrote %d of %d samples", t.id, t.samples, t.src.SampleCount())
+		}
+	}
+	if err := mw.w.Flush(); err != nil {
+		return err
+	}
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(mw.pos-mw.mdatStart))
+	if _, err := mw.f.WriteAt(size, mw.mdatStart+8); err != nil {
+		return err
+	}
+	moov, err := mw.buildMoov()
+	if err != nil {
+		return err
+	}
+	if _, err := mw.f.WriteAt(moov, mw.pos); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mw *movWriter) buildMoov() ([]byte, error) {
+	if len(mw.mvhd) < 12 {
+		return nil, fmt.Errorf("invalid mvhd")
+	}
+	mvhd := append([]byte(nil), mw.mvhd...)
+	binary.BigEndian.PutUint32(mvhd[len(mvhd)-4:], uint32(len(mw.tracks)+1))
+	parts := [][]byte{mvhd}
+	// Track references are rewritten to the new track IDs.
+	ids := map[uint32]uint32{}
+	for _, t := range mw.tracks {
+		if t.src.ID != 0 {
+			ids[t.src.ID] = t.id
+		}
+	}
+	for _, t := range mw.tracks {
+		trak, err := t.buildTrak(ids)
+		if err != nil {
+			return nil, fmt.Errorf("track %d: %v", t.id, err)
+		}
+		parts = append(parts, trak)
+	}
+	return makeBox("moov", parts...), nil
+}
+
+func (t *movTrack) buildTrak(ids map[uint32]uint32) ([]byte, error) {
+	src := t.src
+	if len(src.tkhd) < 32 {
+		return nil, fmt.Errorf("invalid tkhd")
+	}
+	tkhd := append([]byte(nil), src.tkhd...)
+	idOff := 20
+	if tkhd[8] == 1 {
+		idOff = 28
+	}
+	binary.BigEndian.PutUint32(tkhd[idOff:], t.id)
+
+	dinf := src.dinf
+	if dinf == nil {
+		dinf = makeBox("dinf", makeFullBox("dref", 0, 0, []byte{0, 0, 0, 1}, makeFullBox("url ", 0, 1)))
+	}
+	minf := [][]byte{}
+	if src.mediaHeader != nil {
+		minf = append(minf, src.mediaHeader)
+	}
+	minf = append(minf, dinf, t.buildStbl())
+
+	trak := [][]byte{tkhd}
+	if src.edts != nil {
+		trak = append(trak, src.edts)
+	}
+	if tref := buildTref(src.trefs, ids); tref != nil {
+		trak = append(trak, tref)
+	}
+	trak = append(trak, makeBox("mdia", src.mdhd, src.hdlr, makeBox("minf", minf...)))
+	return makeBox("trak", trak...), nil
+}
+
+// buildTref maps references to the output track IDs, dropping those to
+// tracks that were not copied. It returns nil when nothing is left.
+func buildTref(refs []mp4TrackRef, ids map[uint32]uint32) []byte {
+	var parts [][]byte
+	for _, r := range refs {
+		var b []byte
+		for _, id := range r.IDs {
+			if n, ok := ids[id]; ok {
+				b = binary.BigEndian.AppendUint32(b, n)
+			}
+		}
+		if b != nil {
+			parts = append(parts, makeBox(r.Type, b))
+		}
+	}
+	if parts == nil {
+		return nil
+	}
+	return makeBox("tref", parts...)
+}
+
+func (t *movTrack) buildStbl() []byte {
+	src := t.src
+	u32 := binary.BigEndian.AppendUint32
+
+	stsd := u32(nil, uint32(len(src.sampleEntries)))
+	for _, e := range src.sampleEntries {
+		stsd = append(stsd, e...)
+	}
+	parts := [][]byte{makeFullBox("stsd", 0, 0, stsd)}
+
+	stts := u32(nil, uint32(len(src.stts)))
+	for _, e := range src.stts {
+		stts = u32(u32(stts, e.Count), e.Delta)
+	}
+	parts = append(parts, makeFullBox("stts", 0, 0, stts))
+
+	if len(src.ctts) > 0 {
+		var version byte
+		ctts := u32(nil, uint32(len(src.ctts)))
+		for _, e := range src.ctts {
+			if e.Offset < 0 {
+				version = 1
+			}
+			ctts = u32(u32(ctts, e.Count), uint32(e.Offset))
+		}
+		parts = append(parts, makeFullBox("ctts", version, 0, ctts))
+	}
+
+	if src.syncSamples != nil {
+		stss := u32(nil, uint32(len(src.syncSamples)))
+		for _, s := range src.syncSamples {
+			stss = u32(stss, s)
+		}
+		parts = append(parts, makeFullBox("stss", 0, 0, stss))
+	}
+
+	var stsc []byte
+	var entries uint32
+	for i := range t.chunkSamples {
+		if i > 0 && t.chunkSamples[i] == t.chunkSamples[i-1] && t.chunkDesc[i] == t.chunkDesc[i-1] {
+			continue
+		}
+		stsc = u32(u32(u32(stsc, uint32(i+1)), t.chunkSamples[i]), t.chunkDesc[i])
+		entries++
+	}
+	parts = append(parts, makeFullBox("stsc", 0, 0, u32(nil, entries), stsc))
+
+	fixed := uint32(0)
+	if len(src.sampleSizes) > 0 {
+		fixed = src.sampleSizes[0]
+		for _, s := range src.sampleSizes {
+			if s != fixed {
+				fixed = 0
+				break
+			}
+		}
+	}
+	stsz := u32(u32(nil, fixed), uint32(len(src.sampleSizes)))
+	if fixed == 0 {
+		for _, s := range src.sampleSizes {
+			stsz = u32(stsz, s)
+		}
+	}
+	parts = append(parts, makeFullBox("stsz", 0, 0, stsz))
+
+	large := len(t.chunkOffsets) > 0 && t.chunkOffsets[len(t.chunkOffsets)-1] > math.MaxUint32
+	if large {
+		co := u32(nil, uint32(len(t.chunkOffsets)))
+		for _, o := range t.chunkOffsets {
+			co = binary.BigEndian.AppendUint64(co, o)
+		}
+		parts = append(parts, makeFullBox("co64", 0, 0, co))
+	} else {
+		co := u32(nil, uint32(len(t.chunkOffsets)))
+		for _, o := range t.chunkOffsets {
+			co = u32(co, uint32(o))
+		}
+		parts = append(parts, makeFullBox("stco", 0, 0, co))
+	}
+	return makeBox("stbl", parts...)
+}
+
+// syntheticTrack is a track generated from decoded data rather than copied
+// from the source file. Samples are appended to a temporary file, which the
+// chunk offsets refer to, and the header boxes are built by finish.
+type syntheticTrack struct {
+	track  *mp4Track
+	chunks []mp4Chunk
+	data   *os.File
+	w      *bufio.Writer
+	pos    uint64
+	dts    uint64
+}
+
+// newSyntheticTrack starts a track of the given sample entry format. The
+// media timescale must be set before the first sample is added.
+func newSyntheticTrack(dir, format string) (*syntheticTrack, error) {
+	f, err := os.CreateTemp(dir, "."+format+"-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &syntheticTrack{
+		track: &mp4Track{Handler: "meta", Format: format},
+		data:  f,
+		w:     bufio.NewWriter(f),
+	}, nil
+}
+
+// addSample appends one sample lasting delta media ticks. A new chunk is
+// started every half second of media time.
+func (s *syntheticTrack) addSample(b []byte, delta uint32) error {
+	t := s.track
+	if n := len(s.chunks); n == 0 || s.dts-s.chunks[n-1].DTS >= uint64(t.Timescale/2) {
+		s.chunks = append(s.chunks, mp4Chunk{Offset: s.pos, FirstSample: len(t.sampleSizes), DescIndex: 1, DTS: s.dts})
+	}
+	c := &s.chunks[len(s.chunks)-1]
+	c.Samples++
+	c.Size += uint64(len(b))
+
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	s.pos += uint64(len(b))
+	t.sampleSizes = append(t.sampleSizes, uint32(len(b)))
+	if n := len(t.stts); n > 0 && t.stts[n-1].Delta == delta {
+		t.stts[n-1].Count++
+	} else {
+		t.stts = append(t.stts, sttsEntry{Count: 1, Delta: delta})
+	}
+	s.dts += uint64(delta)
+	return nil
+}
+
+// finish flushes the samples and builds the header boxes of a timed
+// metadata track. start is the movie time of the first sample in media
+// ticks; handlerName is stored in hdlr.
+func (s *syntheticTrack) finish(movieTimescale uint32, start uint64, handlerName string) error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	t := s.track
+	u32 := binary.BigEndian.AppendUint32
+	toMovie := func(ticks uint64) uint32 {
+		return uint32(ticks * uint64(movieTimescale) / uint64(t.Timescale))
+	}
+	t.Duration = s.dts
+
+	// tkhd version 0: enabled track, identity matrix, no size.
+	tkhd := u32(u32(nil, 0), 0)              // creation, modification
+	tkhd = u32(u32(tkhd, 0), 0)              // track ID (set by the writer), reserved
+	tkhd = u32(tkhd, toMovie(start+s.dts))   // duration
+	tkhd = append(tkhd, make([]byte, 16)...) // reserved, layer, alternate group, volume, reserved
+	for _, v := range []uint32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000} {
+		tkhd = u32(tkhd, v)
+	}
+	tkhd = u32(u32(tkhd, 0), 0) // width, height
+	t.tkhd = makeFullBox("tkhd", 0, 1, tkhd)
+
+	// An empty edit delays the track to its first sample.
+	var elst []byte
+	entries := uint32(1)
+	if start > 0 {
+		elst = u32(u32(u32(elst, toMovie(start)), math.MaxUint32), 0x10000)
+		entries++
+	}
+	elst = u32(u32(u32(elst, toMovie(s.dts)), 0), 0x10000)
+	t.edts = makeBox("edts", makeFullBox("elst", 0, 0, u32(nil, entries), elst))
+
+	mdhd := u32(u32(u32(u32(nil, 0), 0), t.Timescale), uint32(s.dts))
+	mdhd = append(mdhd, 0x55, 0xC4, 0, 0) // language "und", quality
+	t.mdhd = makeFullBox("mdhd", 0, 0, mdhd)
+
+	hdlr := append([]byte("mhlr"), t.Handler...)
+	hdlr = append(hdlr, make([]byte, 12)...)
+	hdlr = append(hdlr, handlerName+"\x00"...)
+	t.hdlr = makeFullBox("hdlr", 0, 0, hdlr)
+
+	t.mediaHeader = makeFullBox("nmhd", 0, 0)
+	// MetaDataSampleEntry: six reserved bytes and data_reference_index 1.
+	t.sampleEntries = [][]byte{makeBox(t.Format, []byte{0, 0, 0, 0, 0, 0, 0, 1})}
+	return nil
+}
+
+// Close removes the temporary file holding the track's samples.
+func (s *syntheticTrack) Close() error {
+	err := s.data.Close()
+	if rerr := os.Remove(s.data.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// remuxTracks copies the given tracks of m into a new file at out,
+// interleaving chunks by decode time. Synthetic tracks are added after the
+// copied ones. Cancelling ctx stops the copy and removes the output.
+func remuxTracks(ctx context.Context, m *mp4File, out string, ftyp []byte, indices []int, extra ...*syntheticTrack) error {
+	type pending struct {
+		track *movTrack
+		data  io.ReaderAt
+		chunk mp4Chunk
+		time  float64
+		order int
+	}
+	mw, err := createMOV(out, ftyp, m.mvhd)
+	if err != nil {
+		return err
+	}
+	var queue []pending
+	for order, idx := range indices {
+		if idx < 0 || idx >= len(m.Tracks) {
+			mw.abort()
+			return fmt.Errorf("track index %d out of range", idx)
+		}
+		src := m.Tracks[idx]
+		chunks, err := src.chunks()
+		if err != nil {
+			mw.abort()
+			return fmt.Errorf("track %d: %v", idx, err)
+		}
+		if src.Timescale == 0 {
+			mw.abort()
+			return fmt.Errorf("track %d: zero timescale", idx)
+		}
+		t := mw.addTrack(src)
+		for _, c := range chunks {
+			queue = append(queue, pending{t, m.f, c, float64(c.DTS) / float64(src.Timescale), order})
+		}
+	}
+	for i, s := range extra {
+		t := mw.addTrack(s.track)
+		for _, c := range s.chunks {
+			queue = append(queue, pending{t, s.data, c, float64(c.DTS) / float64(s.track.Timescale), len(indices) + i})
+		}
+	}
+	sort.SliceStable(queue, func(i, j int) bool {
+		if queue[i].time != queue[j].time {
+			return queue[i].time < queue[j].time
+		}
+		return queue[i].order < queue[j].order
+	})
+	for _, p := range queue {
+		if ctx.Err() != nil {
+			mw.abort()
+			return context.Cause(ctx)
+		}
+		r := io.NewSectionReader(p.data, int64(p.chunk.Offset), int64(p.chunk.Size))
+		if err := mw.writeChunk(p.track, r, int64(p.chunk.Size), p.chunk.Samples, p.chunk.DescIndex); err != nil {
+			mw.abort()
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// splitOutput is one file written by splitTracks. With ftyp set it holds
+// the track alone in a new container; otherwise it holds the track's raw
+// sample data back to back, or only its first sample when first is set
+// (e.g. a JPEG thumbnail).
+type splitOutput struct {
+	path  string
+	track int
+	ftyp  []byte
+	first bool
+}
+
+// splitTracks writes all outputs in one pass over m. The chunks of every
+// output are merged by source offset, so the input is read front to back
+// once however many files it is split into. Each output only gets its
+// final name once complete; on error or cancellation none is left behind.
+func splitTracks(ctx context.Context, m *mp4File, outs []splitOutput) error {
+	type writer struct {
+		path   string
+		chunks []mp4Chunk
+		next   int
+		mw     *movWriter
+		t      *movTrack
+		f      *outputFile
+		w      *bufio.Writer
+	}
+	ws := make([]*writer, 0, len(outs))
+	abort := func() {
+		for _, w := range ws {
+			if w.mw != nil {
+				w.mw.abort()
+			} else {
+				w.f.Close()
+			}
+		}
+	}
+	for _, o := range outs {
+		if o.track < 0 || o.track >= len(m.Tracks) {
+			abort()
+			return fmt.Errorf("track index %d out of range", o.track)
+		}
+		src := m.Tracks[o.track]
+		chunks, err := src.chunks()
+		if err != nil {
+			abort()
+			return fmt.Errorf("track %d: %v", o.track, err)
+		}
+		w := &writer{path: o.path, chunks: chunks}
+		if o.first && len(chunks) > 0 {
+			c := chunks[0]
+			c.Size, c.Samples = uint64(src.sampleSizes[0]), 1
+			w.chunks = []mp4Chunk{c}
+		}
+		if o.ftyp != nil {
+			if w.mw, err = createMOV(o.path, o.ftyp, m.mvhd); err != nil {
+				abort()
+				return err
+			}
+			w.t = w.mw.addTrack(src)
+		} else {
+			if w.f, err = createOutput(o.path); err != nil {
+				abort()
+				return err
+			}
+			w.w = bufio.NewWriterSize(w.f, 1<<20)
+		}
+		ws = append(ws, w)
+	}
+
+	for {
+		if ctx.Err() != nil {
+			abort()
+			return context.Cause(ctx)
+		}
+		var w *writer
+		for _, c := range ws {
+			if c.next < len(c.chunks) && (w == nil || c.chunks[c.next].Offset < w.chunks[w.next].Offset) {
+				w = c
+			}
+		}
+		if w == nil {
+			break
+		}
+		c := w.chunks[w.next]
+		w.next++
+		r := io.NewSectionReader(m.f, int64(c.Offset), int64(c.Size))
+		var err error
+		if w.mw != nil {
+			err = w.mw.writeChunk(w.t, r, int64(c.Size), c.Samples, c.DescIndex)
+		} else {
+			_, err = io.CopyN(w.w, r, int64(c.Size))
+		}
+		if err != nil {
+			abort()
+			return err
+		}
+	}
+
+	// Every output is finished before any is committed, so that a failure
+	// leaves none of them behind.
+	for _, w := range ws {
+		var err error
+		if w.mw != nil {
+			err = w.mw.finish()
+		} else {
+			err = w.w.Flush()
+		}
+		if err != nil {
+			abort()
+			return err
+		}
+	}
+	for i, w := range ws {
+		f := w.f
+		if w.mw != nil {
+			f = w.mw.f
+		}
+		if err := f.Commit(); err != nil {
+			abort()
+			for _, c := range ws[:i] {
+				os.Remove(c.path)
+			}
+			return err
+		}
+	}
+	return nil
+}
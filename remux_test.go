@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testTrack describes one track of a synthetic MP4 built by writeTestMP4.
+type testTrack struct {
+	handler   string
+	entry     []byte // sample entry box
+	mdhd      []byte
+	edts      []byte
+	stts      []sttsEntry
+	ctts      []cttsEntry
+	sync      []uint32
+	sizes     []uint32
+	perChunk  int
+	co64      bool
+	samples   [][]byte
+	chunkOffs []uint64
+}
+
+func u32s(vs ...uint32) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// writeTestMP4 writes ftyp, an mdat with the chunks of all tracks
+// interleaved, and a moov describing them.
+func writeTestMP4(t *testing.T, path string, tracks []*testTrack) {
+	t.Helper()
+	dataStart := uint64(len(ftypMP4) + 8)
+	data, moov := layoutTestMP4(tracks, dataStart)
+	var file []byte
+	file = append(file, ftypMP4...)
+	file = appendBox(file, "mdat", data)
+	file = append(file, moov...)
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeFastStartMP4 is writeTestMP4 with the moov ahead of the mdat.
+func writeFastStartMP4(t *testing.T, path string, tracks []*testTrack) {
+	t.Helper()
+	// Chunk offsets do not change the size of the moov.
+	_, moov := layoutTestMP4(tracks, 0)
+	data, moov := layoutTestMP4(tracks, uint64(len(ftypMP4)+len(moov)+8))
+	var file []byte
+	file = append(file, ftypMP4...)
+	file = append(file, moov...)
+	file = appendBox(file, "mdat", data)
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// layoutTestMP4 returns the mdat payload of tracks, starting at file
+// offset dataStart, and the moov box describing it.
+func layoutTestMP4(tracks []*testTrack, dataStart uint64) (data, moovBox []byte) {
+	for _, tr := range tracks {
+		tr.chunkOffs = nil
+	}
+	for c := 0; ; c++ {
+		wrote := false
+		for _, tr := range tracks {
+			first := c * tr.perChunk
+			if first >= len(tr.samples) {
+				continue
+			}
+			tr.chunkOffs = append(tr.chunkOffs, dataStart+uint64(len(data)))
+			for _, s := range tr.samples[first:min(first+tr.perChunk, len(tr.samples))] {
+				data = append(data, s...)
+			}
+			wrote = true
+		}
+		if !wrote {
+			break
+		}
+	}
+
+	mvhd := makeFullBox("mvhd", 0, 0, u32s(0, 0, 1000, 5000, 0x00010000), []byte{1, 0}, make([]byte, 10),
+		u32s(0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000), make([]byte, 24), u32s(uint32(len(tracks)+1)))
+	moov := [][]byte{mvhd}
+	for i, tr := range tracks {
+		tkhd := makeFullBox("tkhd", 0, 7, u32s(0, 0, uint32(i+1), 0, 5000), make([]byte, 16),
+			u32s(0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000), u32s(0, 0))
+		hdlr := makeFullBox("hdlr", 0, 0, u32s(0), []byte(tr.handler), make([]byte, 12), []byte("Test\x00"))
+
+		var stbl [][]byte
+		stbl = append(stbl, makeFullBox("stsd", 0, 0, u32s(1), tr.entry))
+		stts := u32s(uint32(len(tr.stts)))
+		for _, e := range tr.stts {
+			stts = append(stts, u32s(e.Count, e.Delta)...)
+		}
+		stbl = append(stbl, makeFullBox("stts", 0, 0, stts))
+		if tr.ctts != nil {
+			ctts := u32s(uint32(len(tr.ctts)))
+			for _, e := range tr.ctts {
+				ctts = append(ctts, u32s(e.Count, uint32(e.Offset))...)
+			}
+			stbl = append(stbl, makeFullBox("ctts", 0, 0, ctts))
+		}
+		if tr.sync != nil {
+			stbl = append(stbl, makeFullBox("stss", 0, 0, u32s(uint32(len(tr.sync))), u32s(tr.sync...)))
+		}
+		var stsc []byte
+		n := uint32(0)
+		for c := range tr.chunkOffs {
+			k := min(tr.perChunk, len(tr.samples)-c*tr.perChunk)
+			if c == 0 || k != tr.perChunk {
+				stsc = append(stsc, u32s(uint32(c+1), uint32(k), 1)...)
+				n++
+			}
+		}
+		stbl = append(stbl, makeFullBox("stsc", 0, 0, u32s(n), stsc))
+		fixed := tr.sizes[0]
+		for _, s := range tr.sizes {
+			if s != fixed {
+				fixed = 0
+			}
+		}
+		stsz := u32s(fixed, uint32(len(tr.sizes)))
+		if fixed == 0 {
+			stsz = append(stsz, u32s(tr.sizes...)...)
+		}
+		stbl = append(stbl, makeFullBox("stsz", 0, 0, stsz))
+		if tr.co64 {
+			co := u32s(uint32(len(tr.chunkOffs)))
+			for _, o := range tr.chunkOffs {
+				co = binary.BigEndian.AppendUint64(co, o)
+			}
+			stbl = append(stbl, makeFullBox("co64", 0, 0, co))
+		} else {
+			co := u32s(uint32(len(tr.chunkOffs)))
+			for _, o := range tr.chunkOffs {
+				co = append(co, u32s(uint32(o))...)
+			}
+			stbl = append(stbl, makeFullBox("stco", 0, 0, co))
+		}
+
+		dinf := makeBox("dinf", makeFullBox("dref", 0, 0, u32s(1), makeFullBox("url ", 0, 1)))
+		minf := makeBox("minf", makeFullBox("vmhd", 0, 1, make([]byte, 8)), dinf, makeBox("stbl", stbl...))
+		moov = append(moov, makeBox("trak", tkhd, tr.edts, makeBox("mdia", tr.mdhd, hdlr, minf)))
+	}
+
+	return data, makeBox("moov", moov...)
+}
+
+func testSamples(seed byte, sizes []uint32) [][]byte {
+	out := make([][]byte, len(sizes))
+	for i, n := range sizes {
+		out[i] = make([]byte, n)
+		for j := range out[i] {
+			out[i][j] = seed + byte(i*31+j*7)
+		}
+	}
+	return out
+}
+
+func TestRemuxRoundTrip(t *testing.T) {
+	videoSizes := []uint32{10, 20, 15, 7, 30}
+	audioSizes := []uint32{16, 16, 16, 16}
+	video := &testTrack{
+		handler: "vide",
+		entry:   makeBox("avc1", make([]byte, 78)),
+		// Version 0 with a 90 kHz timescale and an initial empty edit.
+		mdhd:  makeFullBox("mdhd", 0, 0, u32s(0, 0, 90000, 9000), []byte{0x55, 0xc4, 0, 0}),
+		edts:  makeBox("edts", makeFullBox("elst", 0, 0, u32s(2, 1000, 0xffffffff, 0x00010000, 4000, 3000, 0x00010000))),
+		stts:  []sttsEntry{{2, 3000}, {3, 1000}},
+		ctts:  []cttsEntry{{1, 0}, {1, 3000}, {3, 0}},
+		sync:  []uint32{1, 4},
+		sizes: videoSizes,
+		// The last chunk holds fewer samples.
+		perChunk: 2,
+		samples:  testSamples(1, videoSizes),
+	}
+	audio := &testTrack{
+		handler: "soun",
+		entry:   makeBox("mp4a", make([]byte, 28)),
+		// Version 1 with a 48 kHz timescale and a 64-bit edit list.
+		mdhd:     makeFullBox("mdhd", 1, 0, make([]byte, 16), u32s(48000, 0, 4096), []byte{0x15, 0xc7, 0, 0}),
+		edts:     makeBox("edts", makeFullBox("elst", 1, 0, u32s(1, 0, 4000, 0, 1024, 0x00010000))),
+		stts:     []sttsEntry{{4, 1024}},
+		sizes:    audioSizes,
+		perChunk: 2,
+		co64:     true,
+		samples:  testSamples(100, audioSizes),
+	}
+
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.mp4")
+	writeTestMP4(t, in, []*testTrack{video, audio})
+	src, err := openMP4(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	out := filepath.Join(dir, "out.mov")
+	if err := remuxTracks(context.Background(), src, out, ftypQuickTime, []int{0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := openMP4(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if len(dst.Tracks) != 2 {
+		t.Fatalf("got %d tracks, want 2", len(dst.Tracks))
+	}
+	for i, want := range []*testTrack{video, audio} {
+		a, b := src.Tracks[i], dst.Tracks[i]
+		if !bytes.Equal(b.mdhd, want.mdhd) || !bytes.Equal(a.mdhd, want.mdhd) {
+			t.Errorf("track %d: mdhd changed", i)
+		}
+		if !bytes.Equal(b.edts, want.edts) || !bytes.Equal(a.edts, want.edts) {
+			t.Errorf("track %d: edts changed", i)
+		}
+		if !reflect.DeepEqual(b.stts, want.stts) || !reflect.DeepEqual(a.stts, want.stts) {
+			t.Errorf("track %d: stts %v, want %v", i, b.stts, want.stts)
+		}
+		if !reflect.DeepEqual(b.sampleSizes, want.sizes) || !reflect.DeepEqual(a.sampleSizes, want.sizes) {
+			t.Errorf("track %d: stsz %v, want %v", i, b.sampleSizes, want.sizes)
+		}
+		if !reflect.DeepEqual(b.ctts, a.ctts) || !reflect.DeepEqual(b.syncSamples, a.syncSamples) || !reflect.DeepEqual(b.Edits, a.Edits) {
+			t.Errorf("track %d: ctts, stss or edit list changed", i)
+		}
+
+		it, err := b.samples()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for s, ok := it.Next(); ok; s, ok = it.Next() {
+			got, err := dst.readSample(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n >= len(want.samples) || !bytes.Equal(got, want.samples[n]) {
+				t.Errorf("track %d: sample %d differs", i, n)
+			}
+			n++
+		}
+		if n != len(want.samples) {
+			t.Errorf("track %d: %d samples, want %d", i, n, len(want.samples))
+		}
+	}
+	if _, err := os.Stat(partialPath(out)); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind")
+	}
+}
+
+func TestSplitTracks(t *testing.T) {
+	sizes := []uint32{10, 20, 15}
+	good := func() *testTrack {
+		return &testTrack{
+			handler:  "meta",
+			entry:    makeBox("djmd", make([]byte, 8)),
+			mdhd:     makeFullBox("mdhd", 0, 0, u32s(0, 0, 1000, 30), []byte{0x55, 0xc4, 0, 0}),
+			stts:     []sttsEntry{{3, 10}},
+			sizes:    sizes,
+			perChunk: 2,
+			samples:  testSamples(7, sizes),
+		}
+	}
+	// The sample table of the broken track claims more data than the file
+	// holds, so copying it fails midway.
+	broken := good()
+	broken.sizes = []uint32{10, 20, 1 << 20}
+
+	for _, tt := range []struct {
+		name   string
+		tracks []*testTrack
+		block  bool // a directory in place of the second output fails its rename
+		fail   bool
+	}{
+		{"ok", []*testTrack{good(), good()}, false, false},
+		{"copy fails", []*testTrack{good(), broken}, false, true},
+		{"commit fails", []*testTrack{good(), good()}, true, true},
+	} {
+		dir := t.TempDir()
+		in := filepath.Join(dir, "in.mp4")
+		writeTestMP4(t, in, tt.tracks)
+		m, err := openMP4(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outs := []splitOutput{
+			{path: filepath.Join(dir, "a.mov"), track: 0, ftyp: ftypQuickTime},
+			{path: filepath.Join(dir, "b.bin"), track: 1},
+		}
+		if tt.block {
+			if err := os.MkdirAll(filepath.Join(outs[1].path, "x"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = splitTracks(context.Background(), m, outs)
+		m.Close()
+		if (err != nil) != tt.fail {
+			t.Fatalf("%s: error %v", tt.name, err)
+		}
+		for i, o := range outs {
+			if _, err := os.Stat(partialPath(o.path)); !os.IsNotExist(err) {
+				t.Errorf("%s: partial file of %s left behind", tt.name, o.path)
+			}
+			if tt.block && i == 1 {
+				continue
+			}
+			_, err := os.Stat(o.path)
+			if exists := err == nil; exists == tt.fail {
+				t.Errorf("%s: %s exists: %v", tt.name, o.path, exists)
+			}
+		}
+		if tt.fail {
+			continue
+		}
+		b, err := os.ReadFile(outs[1].path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := bytes.Join(testSamples(7, sizes), nil); !bytes.Equal(b, want) {
+			t.Errorf("raw output differs")
+		}
+		out, err := openMP4(outs[0].path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := out.Tracks[0].sampleSizes; !reflect.DeepEqual(got, sizes) {
+			t.Errorf("stsz %v, want %v", got, sizes)
+		}
+		out.Close()
+	}
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// Spherical video metadata, see
+// https://github.com/google/spatial-media/tree/master/docs. Two versions
+// are written into the first video track:
+//
+//	V1  uuid box in the trak holding GSpherical XML (equirectangular only)
+//	V2  st3d and sv3d{svhd, proj{prhd, equi|cbmp}} in the sample entry
+//
+// Existing spherical boxes are replaced, so injecting twice is harmless.
+// The moov box is rewritten in place; when it precedes mdat the chunk
+// offsets are shifted by the change in its size.
+
+var sphericalV1UUID = []byte{
+	0xff, 0xcc, 0x82, 0x63, 0xf8, 0x55, 0x4a, 0x93,
+	0x88, 0x14, 0x58, 0x7a, 0x02, 0x52, 0x1f, 0xdd,
+}
+
+// sphericalStereoModes maps the -stereo values to the st3d stereo_mode.
+var sphericalStereoModes = map[string]byte{
+	"mono":       0,
+	"top-bottom": 1,
+	"left-right": 2,
+}
+
+// visualSampleEntrySize is the size of the fixed fields of a visual sample
+// entry, which precede its child boxes.
+const visualSampleEntrySize = 78
+
+type sphericalMeta struct {
+	Projection string // equirectangular|cubemap
+	Stereo     string // mono|top-bottom|left-right
+	Yaw        float64
+	Pitch      float64
+	Roll       float64
+	V1         bool
+	V2         bool
+}
+
+func (s *sphericalMeta) validate() error {
+	if s.Projection != "equirectangular" && s.Projection != "cubemap" {
+		return fmt.Errorf("invalid projection: %s (expected equirectangular or cubemap)", s.Projection)
+	}
+	if _, ok := sphericalStereoModes[s.Stereo]; !ok {
+		return fmt.Errorf("invalid stereo mode: %s (expected mono, top-bottom or left-right)", s.Stereo)
+	}
+	if s.V1 && s.Projection != "equirectangular" {
+		return fmt.Errorf("V1 metadata supports equirectangular only")
+	}
+	if !s.V1 && !s.V2 {
+		return fmt.Errorf("no metadata version selected")
+	}
+	if math.Abs(s.Yaw) > 180 || math.Abs(s.Pitch) > 90 || math.Abs(s.Roll) > 180 {
+		return fmt.Errorf("pose out of range (yaw and roll within ±180, pitch within ±90)")
+	}
+	return nil
+}
+
+// v1Box returns the V1 uuid box.
+func (s *sphericalMeta) v1Box() []byte {
+	var x strings.Builder
+	x.WriteString(`<?xml version="1.0"?>`)
+	x.WriteString(`<rdf:SphericalVideo xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns:GSpherical="http://ns.google.com/videos/1.0/spherical/">`)
+	x.WriteString(`<GSpherical:Spherical>true</GSpherical:Spherical>`)
+	x.WriteString(`<GSpherical:Stitched>true</GSpherical:Stitched>`)
+	x.WriteString(`<GSpherical:StitchingSoftware>osv2mov</GSpherical:StitchingSoftware>`)
+	x.WriteString(`<GSpherical:ProjectionType>equirectangular</GSpherical:ProjectionType>`)
+	if s.Stereo != "mono" {
+		fmt.Fprintf(&x, `<GSpherical:StereoMode>%s</GSpherical:StereoMode>`, s.Stereo)
+	}
+	fmt.Fprintf(&x, `<GSpherical:InitialViewHeadingDegrees>%d</GSpherical:InitialViewHeadingDegrees>`, int(math.Round(s.Yaw)))
+	fmt.Fprintf(&x, `<GSpherical:InitialViewPitchDegrees>%d</GSpherical:InitialViewPitchDegrees>`, int(math.Round(s.Pitch)))
+	fmt.Fprintf(&x, `<GSpherical:InitialViewRollDegrees>%d</GSpherical:InitialViewRollDegrees>`, int(math.Round(s.Roll)))
+	x.WriteString(`</rdf:SphericalVideo>`)
+	return makeBox("uuid", sphericalV1UUID, []byte(x.String()))
+}
+
+// v2Boxes returns the st3d and sv3d boxes of the sample entry.
+func (s *sphericalMeta) v2Boxes() []byte {
+	fixed := func(deg float64) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(int32(math.Round(deg*65536))))
+	}
+	var proj []byte
+	if s.Projection == "cubemap" {
+		// Layout 0 is the 3x2 face arrangement of ffmpeg's c3x2.
+		proj = makeFullBox("cbmp", 0, 0, make([]byte, 8))
+	} else {
+		// Zero bounds: the frame covers the full sphere.
+		proj = makeFullBox("equi", 0, 0, make([]byte, 16))
+	}
+	st3d := makeFullBox("st3d", 0, 0, []byte{sphericalStereoModes[s.Stereo]})
+	sv3d := makeBox("sv3d",
+		makeFullBox("svhd", 0, 0, []byte("osv2mov\x00")),
+		makeBox("proj",
+			makeFullBox("prhd", 0, 0, fixed(s.Yaw), fixed(s.Pitch), fixed(s.Roll)),
+			proj,
+		),
+	)
+	return append(st3d, sv3d...)
+}
+
+// injectSpherical writes meta into the first video track of path. The
+// result goes to out, which may be path itself.
+func injectSpherical(ctx context.Context, path, out string, meta *sphericalMeta) error {
+	if err := meta.validate(); err != nil {
+		return err
+	}
+	m, err := openMP4(path)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	raw := make([]byte, m.moovSize)
+	if _, err := m.f.ReadAt(raw, m.moovOffset); err != nil {
+		return err
+	}
+	boxes, err := readBoxes(raw)
+	if err != nil || len(boxes) != 1 {
+		return fmt.Errorf("cannot read moov box: %v", err)
+	}
+	moov, err := rewriteSphericalMoov(boxes[0], meta)
+	if err != nil {
+		return err
+	}
+	if err := shiftChunkOffsets(moov, m.moovOffset+m.moovSize, int64(len(moov))-m.moovSize); err != nil {
+		return err
+	}
+
+	fi, err := m.f.Stat()
+	if err != nil {
+		return err
+	}
+	// The partial file is renamed over out only once it is complete, so
+	// an in-place injection never leaves a truncated input behind.
+	file, err := createOutput(out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	end := m.moovOffset + m.moovSize
+	if _, err := io.Copy(file, ctxReader{ctx, io.NewSectionReader(m.f, 0, m.moovOffset)}); err != nil {
+		return err
+	}
+	if _, err := file.Write(moov); err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, ctxReader{ctx, io.NewSectionReader(m.f, end, m.Size-end)}); err != nil {
+		return err
+	}
+	if err := file.Chmod(fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return file.Commit()
+}
+
+// ctxReader fails once ctx is cancelled, so that copying a large file
+// stops at the next read rather than at the end.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, context.Cause(r.ctx)
+	}
+	return r.r.Read(p)
+}
+
+// rewriteSphericalMoov returns moov with the spherical boxes of its first
+// video track replaced by meta.
+func rewriteSphericalMoov(moov mp4Box, meta *sphericalMeta) ([]byte, error) {
+	done := false
+	b, err := rewriteChildren(moov, 0, func(children []mp4Box) ([][]byte, error) {
+		parts := make([][]byte, len(children))
+		for i, c := range children {
+			parts[i] = c.Raw
+			if done || c.Type != "trak" || !isVideoTrak(c) {
+				continue
+			}
+			trak, err := rewriteSphericalTrak(c, meta)
+			if err != nil {
+				return nil, err
+			}
+			parts[i], done = trak, true
+		}
+		return parts, nil
+	})
+	if err == nil && !done {
+		err = fmt.Errorf("no video track found")
+	}
+	return b, err
+}
+
+func rewriteSphericalTrak(trak mp4Box, meta *sphericalMeta) ([]byte, error) {
+	path := []boxStep{{"mdia", 0}, {"minf", 0}, {"stbl", 0}, {"stsd", 8}, {"", visualSampleEntrySize}}
+	b, err := editPath(trak, 0, path, func(entry mp4Box) ([]byte, error) {
+		return rewriteChildren(entry, visualSampleEntrySize, func(children []mp4Box) ([][]byte, error) {
+			var parts [][]byte
+			for _, c := range children {
+				if c.Type != "st3d" && c.Type != "sv3d" {
+					parts = append(parts, c.Raw)
+				}
+			}
+			if meta.V2 {
+				parts = append(parts, meta.v2Boxes())
+			}
+			return parts, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := readBoxes(b)
+	if err != nil {
+		return nil, err
+	}
+	return rewriteChildren(boxes[0], 0, func(children []mp4Box) ([][]byte, error) {
+		var parts [][]byte
+		for _, c := range children {
+			if c.Type != "uuid" || !bytes.HasPrefix(c.Data, sphericalV1UUID) {
+				parts = append(parts, c.Raw)
+			}
+		}
+		if meta.V1 {
+			parts = append(parts, meta.v1Box())
+		}
+		return parts, nil
+	})
+}
+
+func isVideoTrak(trak mp4Box) bool {
+	t, err := parseTrak(trak.Data)
+	return err == nil && t.codecType() == "video" && t.codecName() != "mjpeg" && t.codecName() != "png"
+}
+
+// boxStep selects the first child of type typ ("" for any type) whose own
+// children start skip bytes into its body.
+type boxStep struct {
+	typ  string
+	skip int
+}
+
+// editPath follows path from box and replaces the box it ends at with the
+// result of fn, rebuilding the sizes of every box on the way.
+func editPath(box mp4Box, skip int, path []boxStep, fn func(mp4Box) ([]byte, error)) ([]byte, error) {
+	if len(path) == 0 {
+		return fn(box)
+	}
+	step := path[0]
+	return rewriteChildren(box, skip, func(children []mp4Box) ([][]byte, error) {
+		parts := make([][]byte, len(children))
+		found := false
+		for i, c := range children {
+			parts[i] = c.Raw
+			if found || (step.typ != "" && c.Type != step.typ) {
+				continue
+			}
+			b, err := editPath(c, step.skip, path[1:], fn)
+			if err != nil {
+				return nil, err
+			}
+			parts[i], found = b, true
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: %s box not found", box.Type, step.typ)
+		}
+		return parts, nil
+	})
+}
+
+// rewriteChildren rebuilds box from the first skip bytes of its body and
+// the parts fn returns for its child boxes.
+func rewriteChildren(box mp4Box, skip int, fn func([]mp4Box) ([][]byte, error)) ([]byte, error) {
+	if len(box.Data) < skip {
+		return nil, fmt.Errorf("truncated %s box", box.Type)
+	}
+	children, err := readBoxes(box.Data[skip:])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", box.Type, err)
+	}
+	parts, err := fn(children)
+	if err != nil {
+		return nil, err
+	}
+	return makeBox(box.Type, append([][]byte{box.Data[:skip]}, parts...)...), nil
+}
+
+// shiftChunkOffsets adds delta to every stco/co64 entry of moov that points
+// at or past from, patching moov in place.
+func shiftChunkOffsets(moov []byte, from, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	boxes, err := readBoxes(moov)
+	if err != nil || len(boxes) != 1 {
+		return fmt.Errorf("cannot read moov box: %v", err)
+	}
+	traks, err := readBoxes(boxes[0].Data)
+	if err != nil {
+		return err
+	}
+	for _, trak := range traks {
+		if trak.Type != "trak" {
+			continue
+		}
+		stbl := &trak
+		for _, typ := range []string{"mdia", "minf", "stbl"} {
+			children, err := readBoxes(stbl.Data)
+			if err != nil {
+				return err
+			}
+			if stbl = findBox(children, typ); stbl == nil {
+				break
+			}
+		}
+		if stbl == nil {
+			continue
+		}
+		tables, err := readBoxes(stbl.Data)
+		if err != nil {
+			return err
+		}
+		for _, t := range tables {
+			if len(t.Data) < 8 || (t.Type != "stco" && t.Type != "co64") {
+				continue
+			}
+			size := 4
+			if t.Type == "co64" {
+				size = 8
+			}
+			var overflow error
+			err := eachTableEntry(t.Data, size, func(e []byte) {
+				if size == 4 {
+					v := int64(binary.BigEndian.Uint32(e))
+					if v >= from {
+						v += delta
+						if v > math.MaxUint32 {
+							overflow = fmt.Errorf("%s: chunk offset exceeds 32 bits after resizing moov", t.Type)
+						}
+						binary.BigEndian.PutUint32(e, uint32(v))
+					}
+					return
+				}
+				if v := int64(binary.BigEndian.Uint64(e)); v >= from {
+					binary.BigEndian.PutUint64(e, uint64(v+delta))
+				}
+			})
+			if err == nil {
+				err = overflow
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gravityPose estimates the camera's pitch and roll in degrees from the
+// mean accelerometer reading over the first half second of input. The IMU
+// axes are taken as X forward through the front lens, Y to the left and Z
+// up, so a level camera reads +1 g on Z.
+func gravityPose(input string) (pitch, roll float64, err error) {
+	m, err := openMP4(input)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer m.Close()
+	st := classifyStreams(m.probe())
+	if len(st.DJMD) == 0 {
+		return 0, 0, fmt.Errorf("no djmd streams found in %s", input)
+	}
+	if err := checkIMUPlausible(m, st.DJMD); err != nil {
+		return 0, 0, err
+	}
+	r := newIMUReader(m, st.DJMD)
+	video := -1
+	if len(st.Video) > 0 {
+		video = st.Video[0]
+	}
+	if err := r.alignTo(video); err != nil {
+		return 0, 0, err
+	}
+
+	var ax, ay, az float64
+	n := 0
+	for {
+		rec, err := r.Read()
+		if err == io.EOF || (err == nil && rec.VideoTime >= 0.5) {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if rec.VideoTime < 0 {
+			continue
+		}
+		smp := rec.Sample(imuUnits{Accel: "g"})
+		ax, ay, az = ax+smp.AccelX, ay+smp.AccelY, az+smp.AccelZ
+		n++
+	}
+	if n == 0 {
+		return 0, 0, fmt.Errorf("IMU data not found")
+	}
+	pitch = math.Atan2(ax, math.Hypot(ay, az)) * 180 / math.Pi
+	roll = math.Atan2(ay, az) * 180 / math.Pi
+	return pitch, roll, nil
+}
+
+func cmdInjectWithFlags(ctx context.Context) {
+	fs := flag.NewFlagSet("inject", flag.ExitOnError)
+
+	output := fs.String("o", "", "Output file (default: modify input in place)")
+	outputLong := fs.String("output", "", "Output file (default: modify input in place)")
+
+	projection := fs.String("p", "equirectangular", "Projection: equirectangular|cubemap")
+	projectionLong := fs.String("projection", "equirectangular", "Projection: equirectangular|cubemap")
+	stereo := fs.String("stereo", "mono", "Stereo mode: mono|top-bottom|left-right")
+	yaw := fs.Float64("yaw", 0, "Initial yaw in degrees")
+	pitch := fs.Float64("pitch", 0, "Initial pitch in degrees")
+	roll := fs.Float64("roll", 0, "Initial roll in degrees")
+	from := fs.String("from", "", "Take pitch and roll from the gravity vector of an OSV file")
+	spec := fs.String("spec", "both", "Metadata version: v1|v2|both")
+
+	forceMode := fs.Bool("f", false, "Overwrite existing files")
+	forceModeLong := fs.Bool("force", false, "Overwrite existing files")
+
+	verboseMode := fs.Bool("v", false, "Show detailed output")
+	verboseModeLong := fs.Bool("verbose", false, "Show detailed output")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: osv2mov inject [options] <file.mp4>\n")
+		fmt.Fprintf(os.Stderr, "   or: osv2mov j [options] <file.mp4>\n\n")
+		fmt.Fprintf(os.Stderr, "Writes spherical video metadata (V1 uuid XML and V2 st3d/sv3d boxes)\n")
+		fmt.Fprintf(os.Stderr, "into the first video track of an MP4/MOV file.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fmt.Fprintf(os.Stderr, "  -o, -output string\n")
+		fmt.Fprintf(os.Stderr, "         Output file (default: modify input in place)\n")
+		fmt.Fprintf(os.Stderr, "  -p, -projection string\n")
+		fmt.Fprintf(os.Stderr, "         Projection: equirectangular | cubemap (default: equirectangular)\n")
+		fmt.Fprintf(os.Stderr, "  -stereo string\n")
+		fmt.Fprintf(os.Stderr, "         Stereo mode: mono | top-bottom | left-right (default: mono)\n")
+		fmt.Fprintf(os.Stderr, "  -yaw, -pitch, -roll float\n")
+		fmt.Fprintf(os.Stderr, "         Initial pose in degrees (default: 0)\n")
+		fmt.Fprintf(os.Stderr, "  -from string\n")
+		fmt.Fprintf(os.Stderr, "         Take pitch and roll from the gravity vector of an OSV file\n")
+		fmt.Fprintf(os.Stderr, "  -spec string\n")
+		fmt.Fprintf(os.Stderr, "         Metadata version: v1 | v2 | both (default: both; v2 only for cubemap)\n")
+		fmt.Fprintf(os.Stderr, "  -f, -force\n")
+		fmt.Fprintf(os.Stderr, "         Overwrite existing files\n")
+		fmt.Fprintf(os.Stderr, "  -v, -verbose\n")
+		fmt.Fprintf(os.Stderr, "         Show detailed output\n")
+		fmt.Fprintf(os.Stderr, "  -h, -help\n")
+		fmt.Fprintf(os.Stderr, "         Show this help\n\n")
+		fmt.Fprintf(os.Stderr, "Examples:\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov inject video_equirect.mp4\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov inject -p cubemap -o out.mp4 video_cubemap.mp4\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov j -from input.osv -yaw 90 video_equirect.mp4\n")
+	}
+
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		os.Exit(2)
+	}
+
+	args := fs.Args()
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Error: Input file not specified")
+		fs.Usage()
+		os.Exit(2)
+	}
+	input := args[0]
+
+	out := *output
+	if out == "" {
+		out = *outputLong
+	}
+	if out == "" {
+		out = input
+	} else if !(*forceMode || *forceModeLong) {
+		if _, err := os.Stat(out); err == nil {
+			fmt.Fprintf(os.Stderr, "Error: file already exists: %s (use -f to overwrite)\n", out)
+			os.Exit(1)
+		}
+	}
+
+	proj := *projection
+	if proj == "equirectangular" {
+		proj = *projectionLong
+	}
+	meta := &sphericalMeta{
+		Projection: proj,
+		Stereo:     *stereo,
+		Yaw:        *yaw,
+		Pitch:      *pitch,
+		Roll:       *roll,
+	}
+	switch *spec {
+	case "v1":
+		meta.V1 = true
+	case "v2":
+		meta.V2 = true
+	case "both":
+		meta.V1, meta.V2 = proj == "equirectangular", true
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid -spec value: %s (expected v1, v2 or both)\n", *spec)
+		os.Exit(2)
+	}
+
+	if *from != "" {
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		p, r, err := gravityPose(*from)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		// Explicit flags win over the measured pose.
+		if !set["pitch"] {
+			meta.Pitch = math.Round(p*100) / 100
+		}
+		if !set["roll"] {
+			meta.Roll = math.Round(r*100) / 100
+		}
+	}
+
+	verbose := *verboseMode || *verboseModeLong
+	if verbose {
+		fmt.Printf("Injecting %s %s metadata (yaw %g, pitch %g, roll %g) into %s\n",
+			meta.Projection, meta.Stereo, meta.Yaw, meta.Pitch, meta.Roll, out)
+	}
+	if err := injectSpherical(ctx, input, out, meta); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	if verbose {
+		fmt.Printf("Completed: %s\n", out)
+	}
+}
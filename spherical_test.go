@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testVideoTrak(co64 bool) *testTrack {
+	sizes := []uint32{10, 20, 15, 7}
+	return &testTrack{
+		handler:  "vide",
+		entry:    makeBox("avc1", make([]byte, 78)),
+		mdhd:     makeFullBox("mdhd", 0, 0, u32s(0, 0, 90000, 12000), []byte{0x55, 0xc4, 0, 0}),
+		stts:     []sttsEntry{{4, 3000}},
+		sizes:    sizes,
+		perChunk: 2,
+		co64:     co64,
+		samples:  testSamples(3, sizes),
+	}
+}
+
+// testVideoMP4 writes a file with one small avc1 track.
+func testVideoMP4(t *testing.T, path string, co64 bool) *testTrack {
+	t.Helper()
+	tr := testVideoTrak(co64)
+	writeTestMP4(t, path, []*testTrack{tr})
+	return tr
+}
+
+func TestInjectSphericalCancelled(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.mp4")
+	testVideoMP4(t, in, false)
+	orig, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errInterrupted)
+	meta := &sphericalMeta{Projection: "equirectangular", Stereo: "mono", V1: true, V2: true}
+	if err := injectSpherical(ctx, in, in, meta); !errors.Is(err, errInterrupted) {
+		t.Fatalf("injectSpherical: error %v, want %v", err, errInterrupted)
+	}
+	if b, err := os.ReadFile(in); err != nil || string(b) != string(orig) {
+		t.Errorf("input changed: %v", err)
+	}
+	if _, err := os.Stat(partialPath(in)); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind")
+	}
+}
+
+func TestInjectSphericalChunkOffsets(t *testing.T) {
+	meta := &sphericalMeta{Projection: "equirectangular", Stereo: "mono", V1: true, V2: true}
+	for _, co64 := range []bool{false, true} {
+		for _, fastStart := range []bool{false, true} {
+			name := map[bool]string{false: "stco", true: "co64"}[co64]
+			if fastStart {
+				// The moov grows ahead of the samples, so every chunk
+				// offset moves.
+				name += " fast start"
+			}
+			dir := t.TempDir()
+			in, out := filepath.Join(dir, "in.mp4"), filepath.Join(dir, "out.mp4")
+			tr := testVideoTrak(co64)
+			if fastStart {
+				writeFastStartMP4(t, in, []*testTrack{tr})
+			} else {
+				writeTestMP4(t, in, []*testTrack{tr})
+			}
+			if err := injectSpherical(context.Background(), in, out, meta); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			b, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(b, meta.v1Box()) || !bytes.Contains(b, meta.v2Boxes()) {
+				t.Errorf("%s: spherical boxes missing", name)
+			}
+			m, err := openMP4(out)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if fastStart != (m.moovOffset == int64(len(ftypMP4))) {
+				t.Errorf("%s: moov moved to %d", name, m.moovOffset)
+			}
+			it, err := m.Tracks[0].samples()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got [][]byte
+			for s, ok := it.Next(); ok; s, ok = it.Next() {
+				data, err := m.readSample(s)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				got = append(got, data)
+			}
+			m.Close()
+			if !reflect.DeepEqual(got, tr.samples) {
+				t.Errorf("%s: samples differ after injection", name)
+			}
+		}
+	}
+}
+
+func TestShiftChunkOffsets(t *testing.T) {
+	for _, co64 := range []bool{false, true} {
+		tr := testVideoTrak(co64)
+		_, moov := layoutTestMP4([]*testTrack{tr}, 100)
+		// Only the chunks at or past from move.
+		from := int64(tr.chunkOffs[1])
+		if err := shiftChunkOffsets(moov, from, 1000); err != nil {
+			t.Fatal(err)
+		}
+		want := []uint64{tr.chunkOffs[0], tr.chunkOffs[1] + 1000}
+		if got := testChunkOffsets(t, moov); !reflect.DeepEqual(got, want) {
+			t.Errorf("co64=%v: offsets %v, want %v", co64, got, want)
+		}
+		err := shiftChunkOffsets(moov, 0, math.MaxUint32)
+		if co64 && err != nil {
+			t.Errorf("co64: %v", err)
+		}
+		if !co64 && (err == nil || !strings.Contains(err.Error(), "exceeds 32 bits")) {
+			t.Errorf("stco overflow: error %v", err)
+		}
+	}
+}
+
+// testChunkOffsets parses moov and returns the chunk offsets of its track.
+func testChunkOffsets(t *testing.T, moov []byte) []uint64 {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "moov.mp4")
+	if err := os.WriteFile(path, append(append([]byte{}, ftypMP4...), moov...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := openMP4(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	return m.Tracks[0].chunkOffsets
+}
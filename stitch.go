@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Equirectangular/cubemap stitching through ffmpeg's v360 filter. The front
+// and rear fisheye streams are placed side by side and read as a dual
+// fisheye image, front lens on the left.
+
+// stitchProjections maps the -p values to the v360 output format and the
+// suffix of the output file.
+var stitchProjections = map[string]struct {
+	filter string
+	suffix string
+	size   string // default output size
+	meta   string // spherical metadata projection, "" if none applies
+}{
+	"e":    {"e", "equirect", "5760x2880", "equirectangular"},
+	"c3x2": {"c3x2", "cubemap", "4320x2880", "cubemap"},
+	"eac":  {"eac", "eac", "4320x2880", ""},
+}
+
+type stitchOptions struct {
+	Projection string
+	Width      int
+	Height     int
+	FOV        float64
+	Yaw        float64
+	Pitch      float64
+	Roll       float64
+	Codec      string
+	CRF        int
+	Preset     string
+	Force      bool
+	Verbose    bool
+	DryRun     bool
+	NoInject   bool
+	Calibrated bool
+	Blend      float64 // seam blend width in degrees, calibrated only
+	Level      bool
+	Fusion     string // fusion filter for leveling
+	FusionGain float64
+}
+
+func cmdStitchWithFlags(ctx context.Context) {
+	fs := flag.NewFlagSet("stitch", flag.ExitOnError)
+
+	outputDir := fs.String("o", "", "Output directory (default: same as input file)")
+	outputDirLong := fs.String("output", "", "Output directory (default: same as input file)")
+
+	projection := fs.String("p", "e", "Output projection: e|c3x2|eac")
+	projectionLong := fs.String("projection", "e", "Output projection: e|c3x2|eac")
+
+	size := fs.String("size", "", "Output size WxH (default: 5760x2880 for e, 4320x2880 otherwise)")
+	fov := fs.Float64("fov", 190, "Field of view of each fisheye lens in degrees")
+	yaw := fs.Float64("yaw", 0, "Yaw rotation in degrees")
+	pitch := fs.Float64("pitch", 0, "Pitch rotation in degrees")
+	roll := fs.Float64("roll", 0, "Roll rotation in degrees")
+
+	calibrated := fs.Bool("calibrated", false, "Stitch with the dbgi lens calibration (equirectangular only)")
+	blend := fs.Float64("blend", 0, "Seam blend width in degrees for -calibrated")
+	experimentalLens := fs.Bool("experimental-lens", false, "Allow -calibrated to decode the unconfirmed dbgi calibration layout")
+	level := fs.Bool("level", false, "Level the horizon using the IMU data (equirectangular only)")
+	fusion := fs.String("fusion", "madgwick", "Fusion filter for -level: madgwick|complementary")
+	fusionGainFlag := fs.Float64("fusion-gain", 0, "Fusion filter gain (default: 0.05 madgwick, 0.5 complementary)")
+
+	codec := fs.String("c", "libx265", "Video encoder: libx265|libx264")
+	codecLong := fs.String("codec", "libx265", "Video encoder: libx265|libx264")
+	crf := fs.Int("crf", 23, "Encoder CRF")
+	preset := fs.String("preset", "medium", "Encoder preset")
+
+	forceMode := fs.Bool("f", false, "Overwrite existing files")
+	forceModeLong := fs.Bool("force", false, "Overwrite existing files")
+
+	verboseMode := fs.Bool("v", false, "Show detailed output")
+	verboseModeLong := fs.Bool("verbose", false, "Show detailed output")
+
+	dryRun := fs.Bool("n", false, "Print the ffmpeg command without running it")
+	dryRunLong := fs.Bool("dry-run", false, "Print the ffmpeg command without running it")
+
+	noInject := fs.Bool("no-inject", false, "Do not write spherical metadata into the output")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: osv2mov stitch [options] <input.osv>\n")
+		fmt.Fprintf(os.Stderr, "   or: osv2mov s [options] <input.osv>\n\n")
+		fmt.Fprintf(os.Stderr, "Stitches the front and rear fisheye videos into one 360 video with\n")
+		fmt.Fprintf(os.Stderr, "ffmpeg's v360 filter and muxes in the audio track.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fmt.Fprintf(os.Stderr, "  -o, -output string\n")
+		fmt.Fprintf(os.Stderr, "         Output directory (default: same as input file)\n")
+		fmt.Fprintf(os.Stderr, "  -p, -projection string\n")
+		fmt.Fprintf(os.Stderr, "         Output projection: e (equirectangular) | c3x2 (cubemap) | eac (default: e)\n")
+		fmt.Fprintf(os.Stderr, "  -size string\n")
+		fmt.Fprintf(os.Stderr, "         Output size WxH (default: 5760x2880 for e, 4320x2880 otherwise)\n")
+		fmt.Fprintf(os.Stderr, "  -fov float\n")
+		fmt.Fprintf(os.Stderr, "         Field of view of each fisheye lens in degrees (default: 190)\n")
+		fmt.Fprintf(os.Stderr, "  -yaw, -pitch, -roll float\n")
+		fmt.Fprintf(os.Stderr, "         Rotation of the output in degrees (default: 0)\n")
+		fmt.Fprintf(os.Stderr, "  -calibrated\n")
+		fmt.Fprintf(os.Stderr, "         Stitch with the dbgi lens calibration instead of v360 (equirectangular only,\n")
+		fmt.Fprintf(os.Stderr, "         requires -experimental-lens)\n")
+		fmt.Fprintf(os.Stderr, "  -experimental-lens\n")
+		fmt.Fprintf(os.Stderr, "         Allow -calibrated to decode the dbgi calibration, whose layout is unconfirmed\n")
+		fmt.Fprintf(os.Stderr, "  -blend float\n")
+		fmt.Fprintf(os.Stderr, "         Seam blend width in degrees for -calibrated (default: 0, hard seam)\n")
+		fmt.Fprintf(os.Stderr, "  -level\n")
+		fmt.Fprintf(os.Stderr, "         Level the horizon frame by frame using the IMU data (equirectangular only)\n")
+		fmt.Fprintf(os.Stderr, "  -fusion string\n")
+		fmt.Fprintf(os.Stderr, "         Fusion filter for -level: madgwick | complementary (default: madgwick)\n")
+		fmt.Fprintf(os.Stderr, "  -fusion-gain float\n")
+		fmt.Fprintf(os.Stderr, "         Fusion filter gain (default: 0.05 for madgwick, 0.5 for complementary)\n")
+		fmt.Fprintf(os.Stderr, "  -c, -codec string\n")
+		fmt.Fprintf(os.Stderr, "         Video encoder: libx265 | libx264 (default: libx265)\n")
+		fmt.Fprintf(os.Stderr, "  -crf int\n")
+		fmt.Fprintf(os.Stderr, "         Encoder CRF (default: 23)\n")
+		fmt.Fprintf(os.Stderr, "  -preset string\n")
+		fmt.Fprintf(os.Stderr, "         Encoder preset (default: medium)\n")
+		fmt.Fprintf(os.Stderr, "  -no-inject\n")
+		fmt.Fprintf(os.Stderr, "         Do not write spherical metadata into the output\n")
+		fmt.Fprintf(os.Stderr, "  -n, -dry-run\n")
+		fmt.Fprintf(os.Stderr, "         Print the ffmpeg command without running it\n")
+		fmt.Fprintf(os.Stderr, "  -f, -force\n")
+		fmt.Fprintf(os.Stderr, "         Overwrite existing files\n")
+		fmt.Fprintf(os.Stderr, "  -v, -verbose\n")
+		fmt.Fprintf(os.Stderr, "         Show detailed output\n")
+		fmt.Fprintf(os.Stderr, "  -h, -help\n")
+		fmt.Fprintf(os.Stderr, "         Show this help\n\n")
+		fmt.Fprintf(os.Stderr, "Examples:\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov stitch input.osv\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov stitch -p eac -size 3840x2560 input.osv\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov s -c libx264 -crf 18 -yaw 90 input.osv\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov stitch -calibrated -experimental-lens -blend 4 input.osv\n")
+		fmt.Fprintf(os.Stderr, "  osv2mov stitch -level input.osv\n")
+	}
+
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		os.Exit(2)
+	}
+
+	args := fs.Args()
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Error: Input file not specified")
+		fs.Usage()
+		os.Exit(2)
+	}
+	input := args[0]
+
+	outdir := *outputDir
+	if outdir == "" {
+		outdir = *outputDirLong
+	}
+	if outdir == "" {
+		if filepath.IsAbs(input) {
+			outdir = filepath.Dir(input)
+		} else {
+			outdir = "."
+		}
+	}
+
+	proj := *projection
+	if proj == "e" {
+		proj = *projectionLong
+	}
+	p, ok := stitchProjections[proj]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: invalid projection: %s (expected e, c3x2 or eac)\n", proj)
+		os.Exit(2)
+	}
+
+	sz := *size
+	if sz == "" {
+		sz = p.size
+	}
+	w, h, err := parseSize(sz)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	enc := *codec
+	if enc == "libx265" {
+		enc = *codecLong
+	}
+	if enc != "libx265" && enc != "libx264" {
+		fmt.Fprintf(os.Stderr, "Error: invalid codec: %s (expected libx265 or libx264)\n", enc)
+		os.Exit(2)
+	}
+
+	if *calibrated && proj != "e" {
+		fmt.Fprintln(os.Stderr, "Error: -calibrated supports equirectangular output (-p e) only")
+		os.Exit(2)
+	}
+	if *calibrated && !*experimentalLens {
+		fmt.Fprintln(os.Stderr, "Error: -calibrated decodes a dbgi layout that has not been confirmed; add -experimental-lens to use it")
+		os.Exit(2)
+	}
+	if *level && proj != "e" {
+		fmt.Fprintln(os.Stderr, "Error: -level supports equirectangular output (-p e) only")
+		os.Exit(2)
+	}
+	if _, err := newFusionFilter(*fusion, *fusionGainFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if *blend < 0 || (*blend > 0 && !*calibrated) {
+		fmt.Fprintln(os.Stderr, "Error: -blend takes a non-negative width and requires -calibrated")
+		os.Exit(2)
+	}
+
+	opts := &stitchOptions{
+		Projection: proj,
+		Width:      w,
+		Height:     h,
+		FOV:        *fov,
+		Yaw:        *yaw,
+		Pitch:      *pitch,
+		Roll:       *roll,
+		Codec:      enc,
+		CRF:        *crf,
+		Preset:     *preset,
+		Force:      *forceMode || *forceModeLong,
+		Verbose:    *verboseMode || *verboseModeLong,
+		DryRun:     *dryRun || *dryRunLong,
+		NoInject:   *noInject,
+		Calibrated: *calibrated,
+		Blend:      *blend,
+		Level:      *level,
+		Fusion:     *fusion,
+		FusionGain: *fusionGainFlag,
+	}
+
+	if err := cmdStitch(ctx, input, outdir, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+func parseSize(s string) (int, int, error) {
+	ws, hs, ok := strings.Cut(strings.ToLower(s), "x")
+	w, werr := strconv.Atoi(ws)
+	h, herr := strconv.Atoi(hs)
+	if !ok || werr != nil || herr != nil || w <= 0 || h <= 0 || w%2 != 0 || h%2 != 0 {
+		return 0, 0, fmt.Errorf("invalid size: %s (expected WxH with even dimensions)", s)
+	}
+	return w, h, nil
+}
+
+func cmdStitch(ctx context.Context, input, outdir string, opts *stitchOptions) error {
+	p, err := probeFile(input)
+	if err != nil {
+		return err
+	}
+	st := classifyStreams(p)
+	if len(st.Video) < 2 {
+		return fmt.Errorf("need front and rear video streams, found %d", len(st.Video))
+	}
+
+	base := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+	subdir := filepath.Join(outdir, base)
+	out := filepath.Join(subdir, fmt.Sprintf("%s_%s.mp4", base, stitchProjections[opts.Projection].suffix))
+	// ffmpeg writes to the partial name; only a finished, tagged output is
+	// renamed to out.
+	dst := out
+	if !opts.DryRun {
+		dst = partialPath(out)
+	}
+	if !opts.DryRun && !opts.Force {
+		if _, err := os.Stat(out); err == nil {
+			return fmt.Errorf("file already exists: %s (use -f to overwrite)", out)
+		}
+	}
+
+	// Intermediate files (remap tables, leveling commands) are written
+	// even for a dry run so that the printed command can be run as is.
+	// Otherwise they are only needed while ffmpeg runs and are removed
+	// however cmdStitch returns.
+	var args []string
+	stage, post := opts, ""
+	if opts.Level || opts.Calibrated {
+		if err := os.MkdirAll(subdir, 0o755); err != nil {
+			return err
+		}
+	}
+	if opts.Level {
+		cmdFile := filepath.Join(subdir, base+"_level.cmd")
+		first, err := writeLevelCommands(input, st, opts, cmdFile)
+		if err != nil {
+			return err
+		}
+		if !opts.DryRun {
+			defer os.Remove(cmdFile)
+		}
+		if post, err = levelFilter(cmdFile, first); err != nil {
+			return err
+		}
+		// The view rotation is applied by the leveling pass, so the
+		// stitcher itself works unrotated.
+		s := *opts
+		s.Yaw, s.Pitch, s.Roll = 0, 0, 0
+		stage = &s
+	}
+	if opts.Calibrated {
+		lenses, err := stitchLenses(input, st, opts.FOV)
+		if err != nil {
+			return err
+		}
+		maps := stitchMapFiles(subdir, base, opts.Blend > 0)
+		if opts.Verbose {
+			fmt.Printf("Writing remap tables for %dx%d: %s\n", opts.Width, opts.Height, strings.Join(maps, ", "))
+		}
+		if err := writeStitchMaps(ctx, lenses, stage, maps); err != nil {
+			return err
+		}
+		if !opts.DryRun {
+			for _, f := range maps {
+				defer os.Remove(f)
+			}
+		}
+		args = calibratedStitchArgs(input, st, stage, maps, post, dst)
+	} else {
+		args = stitchArgs(input, st, stage, post, dst)
+	}
+	if opts.DryRun {
+		fmt.Println(shellJoin(append([]string{"ffmpeg"}, args...)))
+		return nil
+	}
+
+	if err := os.MkdirAll(subdir, 0o755); err != nil {
+		return err
+	}
+	if opts.Verbose {
+		fmt.Printf("Stitching %s (front:%d, rear:%d) to %s\n", input, st.Video[0], st.Video[1], out)
+		fmt.Println(shellJoin(append([]string{"ffmpeg"}, args...)))
+		// Let ffmpeg report progress directly; encoding takes a while.
+		cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err = cmd.Run(); ctx.Err() != nil {
+			err = context.Cause(ctx)
+		} else if err != nil {
+			err = fmt.Errorf("ffmpeg failed: %v", err)
+		}
+	} else {
+		_, err = run(ctx, "ffmpeg", args...)
+	}
+	if err == nil {
+		err = injectStitchMeta(ctx, dst, opts)
+	}
+	if err := finishPartial(out, err); err != nil {
+		return err
+	}
+	if opts.Verbose {
+		fmt.Printf("Completed: %s\n", out)
+	}
+	return nil
+}
+
+// injectStitchMeta marks a stitched output as 360 video. The rotation is
+// already applied to the pixels, so the pose stays zero. v360's eac layout
+// has no V1/V2 equivalent and is left untagged.
+func injectStitchMeta(ctx context.Context, out string, opts *stitchOptions) error {
+	proj := stitchProjections[opts.Projection].meta
+	if opts.NoInject || proj == "" {
+		if opts.Verbose && !opts.NoInject {
+			fmt.Printf("Note: no spherical metadata is defined for %s output\n", opts.Projection)
+		}
+		return nil
+	}
+	meta := &sphericalMeta{Projection: proj, Stereo: "mono", V1: proj == "equirectangular", V2: true}
+	if opts.Verbose {
+		fmt.Printf("Injecting %s spherical metadata into %s\n", proj, out)
+	}
+	return injectSpherical(ctx, out, out, meta)
+}
+
+// stitchArgs builds the ffmpeg arguments for stitching the first two video
+// streams and copying the first audio stream. post is appended to the
+// video filter chain.
+func stitchArgs(input string, st osvStreams, opts *stitchOptions, post, out string) []string {
+	filter := fmt.Sprintf("[0:%d][0:%d]hstack=inputs=2,"+
+		"v360=input=dfisheye:output=%s:ih_fov=%g:iv_fov=%g:yaw=%g:pitch=%g:roll=%g:w=%d:h=%d%s[v]",
+		st.Video[0], st.Video[1], stitchProjections[opts.Projection].filter,
+		opts.FOV, opts.FOV, opts.Yaw, opts.Pitch, opts.Roll, opts.Width, opts.Height, post)
+
+	args := []string{"-hide_banner", "-y", "-i", input, "-filter_complex", filter}
+	return append(args, stitchOutputArgs(st, opts, out)...)
+}
+
+// calibratedStitchArgs builds the ffmpeg arguments for stitching with the
+// remap tables of writeStitchMaps. remap needs a non-subsampled format,
+// and planar RGB lets the 8-bit mask weigh every plane alike.
+func calibratedStitchArgs(input string, st osvStreams, opts *stitchOptions, maps []string, post, out string) []string {
+	args := []string{"-hide_banner", "-y", "-i", input}
+	for _, f := range maps {
+		args = append(args, "-i", f)
+	}
+	stack := fmt.Sprintf("[0:%d][0:%d]hstack=inputs=2,format=gbrp10le", st.Video[0], st.Video[1])
+	filter := stack + "[s];[s][1:v][2:v]remap" + post + "[v]"
+	if len(maps) == 5 {
+		filter = stack + ",split=2[s0][s1];[s0][1:v][2:v]remap[f];[s1][3:v][4:v]remap[r];" +
+			"[5:v]format=gbrp10le[m];[f][r][m]maskedmerge" + post + "[v]"
+	}
+	args = append(args, "-filter_complex", filter)
+	return append(args, stitchOutputArgs(st, opts, out)...)
+}
+
+// stitchOutputArgs returns the mapping and encoder arguments shared by
+// both stitchers: the [v] filter output, the first audio stream and out.
+func stitchOutputArgs(st osvStreams, opts *stitchOptions, out string) []string {
+	args := []string{"-map", "[v]"}
+	if len(st.Audio) > 0 {
+		args = append(args, "-map", "0:"+strconv.Itoa(st.Audio[0]), "-c:a", "copy")
+	}
+	args = append(args, "-c:v", opts.Codec, "-preset", opts.Preset, "-crf", strconv.Itoa(opts.CRF))
+	if opts.Codec == "libx265" {
+		// Keep the 10-bit source depth and tag for QuickTime playback.
+		args = append(args, "-pix_fmt", "yuv420p10le", "-tag:v", "hvc1")
+	} else {
+		args = append(args, "-pix_fmt", "yuv420p")
+	}
+	return append(args, "-movflags", "+faststart", out)
+}
+
+// shellJoin quotes args for display as a shell command line.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a != "" && !strings.ContainsAny(a, " \t\n'\"\\$`*?[]()<>;&|!#~{}") {
+			quoted[i] = a
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}